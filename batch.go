@@ -0,0 +1,469 @@
+package ransuq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchScheduler is a Scheduler which runs each RemoteGeneratable as a job on
+// a cluster batch system such as SLURM or PBS. Each job is written as a shell
+// script which runs the Runner command on the spec of the job. The runner
+// writes a result file when the job is done, which the scheduler polls for.
+// Dir must be on a filesystem shared with the nodes, as must the inputs and
+// outputs of the jobs.
+type BatchScheduler struct {
+	// Local runs the Generatables which are not RemoteGeneratables, such as
+	// training. If it is nil, they fail.
+	Local Scheduler
+
+	// Dir holds the scripts, specs and results of the jobs.
+	Dir string
+
+	// Submit is the command which submits a job. The script is appended to
+	// the arguments. The first word of its output is the ID of the job.
+	Submit []string
+
+	// Status is the command which checks on a job. The ID of the job is
+	// appended to the arguments. The job is taken to have ended when the
+	// command fails or prints nothing. If Status is empty, only the result
+	// files are checked, so a job which dies without writing one is never
+	// finished.
+	Status []string
+
+	// Cancel is the command which removes a job from the batch system. The
+	// ID of the job is appended to the arguments. It is run for the jobs still
+	// queued or running when their context is cancelled or Quit is called. If
+	// Cancel is empty, those jobs are left in the batch system.
+	Cancel []string
+
+	// Runner is the command run by the script. The spec and result files are
+	// appended to the arguments.
+	Runner []string
+
+	// Directives returns the lines placed at the top of the script, after
+	// the interpreter line, such as "#SBATCH --ntasks=4". It may be nil.
+	Directives func(name string, cores int) []string
+
+	// PollInterval is the time between checks on the running jobs. If it is
+	// zero, DefaultBatchPollInterval is used.
+	PollInterval time.Duration
+
+	launch   sync.Once
+	quitOnce sync.Once
+	jobDir   string
+
+	mux     sync.Mutex
+	quit    chan struct{} // Nil until Launch
+	stopped bool
+	jobs    []*batchJob
+	nextID  int
+}
+
+// batchJob is a job submitted by the BatchScheduler.
+type batchJob struct {
+	gen     Generatable
+	seq     uint64
+	id      string // ID of the job in the batch system
+	result  string
+	missing int // Number of polls for which the batch system has not had the job
+	finish  func(error)
+}
+
+// DefaultBatchRunner is the Runner of the BatchSchedulers returned by
+// NewSlurmScheduler and NewPBSScheduler.
+var DefaultBatchRunner = []string{"ransuq", "runjob"}
+
+// DefaultBatchPollInterval is the PollInterval of the BatchSchedulers
+// returned by NewSlurmScheduler and NewPBSScheduler.
+const DefaultBatchPollInterval = 30 * time.Second
+
+// NewSlurmScheduler returns a BatchScheduler which submits jobs with sbatch,
+// checks them with squeue and cancels them with scancel.
+func NewSlurmScheduler(dir string) *BatchScheduler {
+	return &BatchScheduler{
+		Dir:    dir,
+		Submit: []string{"sbatch", "--parsable"},
+		Status: []string{"squeue", "--noheader", "--jobs"},
+		Cancel: []string{"scancel"},
+		Runner: DefaultBatchRunner,
+		Directives: func(name string, cores int) []string {
+			return []string{
+				"#SBATCH --job-name=" + name,
+				"#SBATCH --nodes=1",
+				fmt.Sprintf("#SBATCH --ntasks=%v", cores),
+			}
+		},
+		PollInterval: DefaultBatchPollInterval,
+	}
+}
+
+// NewPBSScheduler returns a BatchScheduler which submits jobs with qsub,
+// checks them with qstat and cancels them with qdel.
+func NewPBSScheduler(dir string) *BatchScheduler {
+	return &BatchScheduler{
+		Dir:    dir,
+		Submit: []string{"qsub"},
+		Status: []string{"qstat"},
+		Cancel: []string{"qdel"},
+		Runner: DefaultBatchRunner,
+		Directives: func(name string, cores int) []string {
+			return []string{
+				"#PBS -N " + name,
+				fmt.Sprintf("#PBS -l nodes=1:ppn=%v", cores),
+			}
+		},
+		PollInterval: DefaultBatchPollInterval,
+	}
+}
+
+// Launch creates the directory for the jobs of this run and starts polling.
+// Calling Launch again, or after Quit, has no effect.
+func (b *BatchScheduler) Launch() {
+	b.launch.Do(func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if b.stopped {
+			return
+		}
+		if b.Local != nil {
+			b.Local.Launch()
+		}
+		if b.PollInterval <= 0 {
+			b.PollInterval = DefaultBatchPollInterval
+		}
+		b.quit = make(chan struct{})
+		dir, err := filepath.Abs(b.Dir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0700)
+		}
+		if err == nil {
+			b.jobDir, err = ioutil.TempDir(dir, "batch")
+		}
+		if err != nil {
+			// The jobs fail when they are written.
+			Infof("batch: error creating job directory: %v", err)
+		}
+		go b.poll()
+	})
+}
+
+// Quit stops polling and cancels the jobs already submitted. They, and jobs
+// received afterwards, fail with ErrSchedulerStopped.
+func (b *BatchScheduler) Quit() {
+	b.quitOnce.Do(func() {
+		b.mux.Lock()
+		b.stopped = true
+		if b.quit != nil {
+			close(b.quit)
+		}
+		jobs := b.jobs
+		b.jobs = nil
+		b.mux.Unlock()
+		for _, job := range jobs {
+			b.cancel(job)
+			job.complete(ErrSchedulerStopped)
+		}
+	})
+	if b.Local != nil {
+		b.Local.Quit()
+	}
+}
+
+// cancel removes the job from the batch system.
+func (b *BatchScheduler) cancel(job *batchJob) {
+	if len(b.Cancel) == 0 {
+		return
+	}
+	_, err := b.run(b.Cancel, job.id)
+	if err != nil {
+		Infof("batch: error cancelling job %v: %v", job.id, err)
+	}
+}
+
+// complete finishes the job with the error.
+func (j *batchJob) complete(err error) {
+	emitJob(j.gen, Event{Kind: EventJobFinished, ID: j.gen.ID(), Seq: j.seq, Status: statusOf(err), Error: errString(err), Worker: "batch job " + j.id})
+	go j.finish(err)
+}
+
+// AddChannel receives Generatables on the input channel and submits each one
+// to the batch system, or sends it to Local if it is not a RemoteGeneratable.
+func (b *BatchScheduler) AddChannel(io GeneratableIO) {
+	splitChannel(io, b.Local, "batch", b.submit)
+}
+
+func (b *BatchScheduler) submit(gen Generatable, r RemoteGeneratable, finish func(error)) {
+	if t, ok := gen.(*trackedGeneratable); ok && t.ctx.Err() != nil {
+		go finish(ErrSkipped)
+		return
+	}
+	seq := nextJobSeq()
+	b.mux.Lock()
+	stopped := b.stopped
+	b.mux.Unlock()
+	if stopped {
+		emitJob(gen, Event{Kind: EventJobFinished, ID: gen.ID(), Seq: seq, Status: statusOf(ErrSchedulerStopped), Error: errString(ErrSchedulerStopped)})
+		go finish(ErrSchedulerStopped)
+		return
+	}
+	emitJob(gen, Event{Kind: EventJobQueued, ID: gen.ID(), Seq: seq, Cores: gen.NumCores()})
+	job, err := b.write(gen, r)
+	if err == nil {
+		job.id, err = b.run(b.Submit, job.script())
+		if err == nil && job.id == "" {
+			err = errors.New("no job ID in the output")
+		}
+		if err != nil {
+			err = errors.New("batch: error submitting job: " + err.Error())
+		}
+	}
+	if err != nil {
+		emitJob(gen, Event{Kind: EventJobFinished, ID: gen.ID(), Seq: seq, Status: statusOf(err), Error: errString(err)})
+		go finish(err)
+		return
+	}
+	if t, ok := gen.(*trackedGeneratable); ok {
+		t.start = time.Now()
+	}
+	job.seq = seq
+	job.finish = finish
+	emitJob(gen, Event{Kind: EventJobStarted, ID: gen.ID(), Seq: seq, Cores: gen.NumCores(), Worker: "batch job " + job.id})
+	b.mux.Lock()
+	stopped = b.stopped
+	if !stopped {
+		b.jobs = append(b.jobs, job)
+	}
+	b.mux.Unlock()
+	if stopped {
+		b.cancel(job)
+		job.complete(ErrSchedulerStopped)
+	}
+}
+
+// batchSpec is the spec file of a batch job.
+type batchSpec struct {
+	ID   string
+	Kind string
+	Spec []byte
+}
+
+// batchResult is the result file of a batch job.
+type batchResult struct {
+	Err string
+}
+
+// write writes the spec and the script of the job.
+func (b *BatchScheduler) write(gen Generatable, r RemoteGeneratable) (*batchJob, error) {
+	if b.jobDir == "" {
+		return nil, errors.New("batch: no job directory")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	b.mux.Lock()
+	b.nextID++
+	base := filepath.Join(b.jobDir, fmt.Sprintf("job%v", b.nextID))
+	b.mux.Unlock()
+
+	err = writeJobSpec(base+".json", gen.ID(), r)
+	if err != nil {
+		return nil, err
+	}
+
+	script := []string{"#!/bin/sh"}
+	if b.Directives != nil {
+		script = append(script, b.Directives(filepath.Base(base), gen.NumCores())...)
+	}
+	var command []string
+	for _, arg := range append(append([]string{}, b.Runner...), base+".json", base+".result") {
+		command = append(command, shellQuote(arg))
+	}
+	script = append(script,
+		"cd "+shellQuote(wd),
+		strings.Join(command, " "),
+	)
+	err = ioutil.WriteFile(base+".sh", []byte(strings.Join(script, "\n")+"\n"), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &batchJob{gen: gen, result: base + ".result"}, nil
+}
+
+func (j *batchJob) script() string {
+	return strings.TrimSuffix(j.result, ".result") + ".sh"
+}
+
+// run runs the command with the extra argument and returns the first word of
+// its output.
+func (b *BatchScheduler) run(command []string, arg string) (string, error) {
+	if len(command) == 0 {
+		return "", errors.New("no command")
+	}
+	args := append(append([]string{}, command[1:]...), arg)
+	out, err := exec.Command(command[0], args...).Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	// sbatch --parsable prints the job ID followed by the cluster name.
+	return strings.Split(fields[0], ";")[0], nil
+}
+
+func (b *BatchScheduler) poll() {
+	ticker := time.NewTicker(b.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		}
+		b.mux.Lock()
+		jobs := b.jobs
+		b.jobs = nil
+		b.mux.Unlock()
+
+		var running []*batchJob
+		for _, job := range jobs {
+			if t, ok := job.gen.(*trackedGeneratable); ok && t.ctx.Err() != nil {
+				b.cancel(job)
+				job.complete(t.ctx.Err())
+				continue
+			}
+			done, err := b.check(job)
+			if !done {
+				running = append(running, job)
+				continue
+			}
+			if t, ok := job.gen.(*trackedGeneratable); ok {
+				t.end = time.Now()
+			}
+			job.complete(err)
+		}
+		// Jobs still running when Quit was called are failed here, since
+		// Quit did not see them.
+		b.mux.Lock()
+		stopped := b.stopped
+		if !stopped {
+			b.jobs = append(running, b.jobs...)
+		}
+		b.mux.Unlock()
+		if stopped {
+			for _, job := range running {
+				b.cancel(job)
+				job.complete(ErrSchedulerStopped)
+			}
+			return
+		}
+	}
+}
+
+// batchMissingPolls is the number of polls for which the batch system may not
+// have a job before it is failed. The result file may not be visible as soon
+// as the job ends on a shared filesystem.
+const batchMissingPolls = 2
+
+// check returns whether the job is done and its error.
+func (b *BatchScheduler) check(job *batchJob) (done bool, err error) {
+	data, err := ioutil.ReadFile(job.result)
+	if err == nil {
+		return true, parseJobResult(data)
+	}
+	if len(b.Status) == 0 {
+		return false, nil
+	}
+	out, err := b.run(b.Status, job.id)
+	if err == nil && out != "" {
+		job.missing = 0
+		return false, nil
+	}
+	job.missing++
+	if job.missing < batchMissingPolls {
+		return false, nil
+	}
+	return true, fmt.Errorf("batch: job %v ended without a result. See the output of %v", job.id, job.script())
+}
+
+// RunJobFile runs the job in a spec file written by a BatchScheduler and
+// writes its result. The kind of the job must be registered. The error is
+// only for failures to read the spec or write the result; the error of the
+// job itself is written to the result file.
+func RunJobFile(specFile, resultFile string) error {
+	data, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return err
+	}
+	var spec batchSpec
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return errors.New("error reading job spec: " + err.Error())
+	}
+	gen, err := rebuildJob(spec.Kind, spec.Spec)
+	if err == nil {
+		seq := nextJobSeq()
+		Emit(Event{Kind: EventJobStarted, ID: spec.ID, Seq: seq, Cores: gen.NumCores()})
+		err = newTracked(gen, context.Background()).Run()
+		Emit(Event{Kind: EventJobFinished, ID: spec.ID, Seq: seq, Status: statusOf(err), Error: errString(err)})
+	}
+	return writeJobResult(resultFile, err)
+}
+
+// writeJobSpec writes the spec of the job for RunJobFile.
+func writeJobSpec(filename, id string, r RemoteGeneratable) error {
+	kind, spec, err := r.JobSpec()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(batchSpec{ID: id, Kind: kind, Spec: spec})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// writeJobResult writes the result file of a job with its error.
+func writeJobResult(filename string, jobErr error) error {
+	data, err := json.Marshal(batchResult{Err: errString(jobErr)})
+	if err != nil {
+		return err
+	}
+	// Write the result under another name first so the scheduler never
+	// reads part of it.
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// parseJobResult returns the error in the result file of a job.
+func parseJobResult(data []byte) error {
+	var result batchResult
+	err := json.Unmarshal(data, &result)
+	if err != nil {
+		return errors.New("error reading result: " + err.Error())
+	}
+	if result.Err != "" {
+		return errors.New(result.Err)
+	}
+	return nil
+}
+
+// shellQuote quotes the string for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
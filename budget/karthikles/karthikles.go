@@ -12,21 +12,13 @@ import (
 	"github.com/btracey/numcsv"
 	"github.com/btracey/quickplot"
 	"github.com/btracey/ransuq/internal/util"
+	"github.com/btracey/ransuq/settings"
 	"github.com/btracey/turbulence/sa"
 	"github.com/gonum/blas/goblas"
 	"github.com/gonum/matrix/mat64"
 	"github.com/gonum/stat"
 )
 
-var gopath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		log.Fatal("gopath not set")
-	}
-}
-
 func init() {
 	mat64.Register(goblas.Blas{})
 }
@@ -60,8 +52,12 @@ func main() {
 
 	reflen := 1 / 600.0 // Plate length
 
-	filename := filepath.Join(gopath, "data", "ransuq", "les_karthik", "sadata.txt")
-	newfilename := filepath.Join(gopath, "data", "ransuq", "les_karthik", "sadatacomputed.txt")
+	config, err := settings.DefaultConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	filename := filepath.Join(config.DataRoot, "les_karthik", "sadata.txt")
+	newfilename := filepath.Join(config.DataRoot, "les_karthik", "sadatacomputed.txt")
 	f, err := os.Open(filename)
 	defer f.Close()
 	if err != nil {
@@ -0,0 +1,200 @@
+package ransuq
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CatalogEntry describes the results saved in a Savepath. The settings are
+// parsed from the location of the Savepath under the results root, which is
+// <training>/<features>/<weight>/<algorithm>/<convergence>. They are empty if
+// the Savepath is not laid out that way.
+type CatalogEntry struct {
+	Savepath    string
+	Training    string
+	Features    string
+	Weight      string
+	Algorithm   string
+	Convergence string
+
+	Status  Status           `json:",omitempty"` // From the run report. Empty if there is no report
+	Error   string           `json:",omitempty"`
+	End     time.Time        `json:",omitempty"`
+	Trained bool             // Whether there is a trained algorithm
+	Result  *TrainResults    `json:",omitempty"` // From train_result.json
+	Folds   []MetricsSummary `json:",omitempty"` // From the summary of a cross-validation
+	Phases  []PhaseReport    `json:",omitempty"`
+}
+
+// Catalog is an index of the results under a root directory.
+type Catalog struct {
+	Root    string
+	Entries []*CatalogEntry
+}
+
+// ScanCatalog walks the root directory and returns an entry for every
+// Savepath, which is any directory with a run report or a trained algorithm.
+// The entries are sorted by Savepath.
+func ScanCatalog(root string) (*Catalog, error) {
+	c := &Catalog{Root: root}
+	err := filepath.Walk(root, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		_, reportErr := os.Stat(ReportFilename(dir))
+		_, algErr := os.Stat(PredictorFilename(dir))
+		if reportErr != nil && algErr != nil {
+			return nil
+		}
+		entry, err := loadCatalogEntry(root, dir)
+		if err != nil {
+			return err
+		}
+		c.Entries = append(c.Entries, entry)
+		// The rest of the directory holds the results of this Savepath,
+		// including the folds of a cross-validation.
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(bySavepath(c.Entries))
+	return c, nil
+}
+
+func loadCatalogEntry(root, savepath string) (*CatalogEntry, error) {
+	e := &CatalogEntry{Savepath: savepath}
+	rel, err := filepath.Rel(root, savepath)
+	if err == nil {
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) == 5 {
+			e.Training = parts[0]
+			e.Features = parts[1]
+			e.Weight = parts[2]
+			e.Algorithm = parts[3]
+			e.Convergence = parts[4]
+		}
+	}
+
+	report, err := LoadRunReport(savepath)
+	switch {
+	case err == nil:
+		e.Status = report.Status
+		e.Error = report.Error
+		e.End = report.End
+		e.Phases = report.Phases
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	_, err = os.Stat(PredictorFilename(savepath))
+	e.Trained = err == nil
+
+	f, err := os.Open(filepath.Join(PredictorDirectory(savepath), "train_result.json"))
+	switch {
+	case err == nil:
+		result := &TrainResults{}
+		err = json.NewDecoder(f).Decode(result)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		e.Result = result
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	e.Folds, err = readSummary(filepath.Join(CrossValidationDirectory(savepath), "summary.csv"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return e, nil
+}
+
+// CatalogFilter selects catalog entries. Each non-empty field is a pattern in
+// the syntax of path.Match which the matching field of the entry must match.
+type CatalogFilter struct {
+	Training    string
+	Features    string
+	Weight      string
+	Algorithm   string
+	Convergence string
+	Status      string
+}
+
+// Match returns whether the entry passes the filter. A malformed pattern
+// matches nothing.
+func (f CatalogFilter) Match(e *CatalogEntry) bool {
+	fields := [][2]string{
+		{f.Training, e.Training},
+		{f.Features, e.Features},
+		{f.Weight, e.Weight},
+		{f.Algorithm, e.Algorithm},
+		{f.Convergence, e.Convergence},
+		{f.Status, string(e.Status)},
+	}
+	for _, field := range fields {
+		if field[0] == "" {
+			continue
+		}
+		ok, err := path.Match(field[0], field[1])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the entries which pass the filter.
+func (c *Catalog) Find(f CatalogFilter) []*CatalogEntry {
+	var entries []*CatalogEntry
+	for _, e := range c.Entries {
+		if f.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+type bySavepath []*CatalogEntry
+
+func (b bySavepath) Len() int           { return len(b) }
+func (b bySavepath) Less(i, j int) bool { return b[i].Savepath < b[j].Savepath }
+func (b bySavepath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// readSummary reads the summary of a cross-validation written by writeSummary.
+func readSummary(filename string) ([]MetricsSummary, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var summary []MetricsSummary
+	for i, record := range records {
+		if i == 0 || len(record) != 8 {
+			continue
+		}
+		s := MetricsSummary{Output: record[0]}
+		s.Folds, _ = strconv.Atoi(record[1])
+		vals := []*float64{&s.MeanRMSE, &s.StdRMSE, &s.MeanMAE, &s.StdMAE, &s.MeanR2, &s.StdR2}
+		for j, v := range vals {
+			*v, _ = strconv.ParseFloat(record[j+2], 64)
+		}
+		summary = append(summary, s)
+	}
+	return summary, nil
+}
@@ -0,0 +1,254 @@
+// ransuq queries the results of past runs and runs jobs for a coordinator.
+//
+//	ransuq results ls [-root dir | -config file] [-features pattern] [-algorithm pattern] ...
+//	ransuq results show [-root dir | -config file] [-features pattern] ... [savepath ...]
+//	ransuq worker -connect network:address [-name name] [-cores n] [-capabilities list]
+//	ransuq runjob specfile resultfile
+//
+// ls prints a line for each run matching the filters and show prints the
+// details of each. The filters are shell patterns matched against the
+// settings of the run, for example -features=nondim_source -algorithm='net_*'.
+//
+// worker connects to a coordinator, such as mainscript run with -coordinator,
+// and runs the jobs it is sent until the coordinator quits. For example,
+//
+//	ransuq worker -connect tcp:head:7070 -cores 8 -capabilities su2
+//
+// runjob runs a job written by mainscript run with -batch. It is called by the
+// job scripts on the nodes of the cluster.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/btracey/ransuq"
+	_ "github.com/btracey/ransuq/datawrapper" // Register the remote job kinds
+	"github.com/btracey/ransuq/settings"
+	_ "github.com/btracey/ransuq/synthetic"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ransuq results ls|show [flags] [savepath ...]")
+	fmt.Fprintln(os.Stderr, "       ransuq worker -connect network:address [flags]")
+	fmt.Fprintln(os.Stderr, "       ransuq runjob specfile resultfile")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "results":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		results(os.Args[2], os.Args[3:])
+	case "worker":
+		worker(os.Args[2:])
+	case "runjob":
+		if len(os.Args) != 4 {
+			usage()
+		}
+		ransuq.SetEventSink(ransuq.QuietSink{W: os.Stdout})
+		err := ransuq.RunJobFile(os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatal("runjob: ", err)
+		}
+	default:
+		usage()
+	}
+}
+
+func worker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	connect := fs.String("connect", "", "network:address of the coordinator, for example tcp:head:7070 or unix:/tmp/ransuq.sock")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", fmt.Sprintf("%v-%v", hostname, os.Getpid()), "name of the worker")
+	cores := fs.Int("cores", runtime.NumCPU(), "number of cores the jobs may use")
+	defaultCapabilities := ""
+	if os.Getenv("SU2_RUN") != "" {
+		defaultCapabilities = ransuq.CapabilitySU2
+	}
+	capabilities := fs.String("capabilities", defaultCapabilities, "comma separated capabilities of the worker")
+	fs.Parse(args)
+
+	parts := strings.SplitN(*connect, ":", 2)
+	if len(parts) != 2 {
+		usage()
+	}
+	w := &ransuq.Worker{
+		Name:  *name,
+		Cores: *cores,
+	}
+	if *capabilities != "" {
+		w.Capabilities = strings.Split(*capabilities, ",")
+	}
+	ransuq.SetEventSink(ransuq.QuietSink{W: os.Stdout})
+	err := w.Run(parts[0], parts[1])
+	if err != nil {
+		log.Fatal("worker: ", err)
+	}
+}
+
+func results(cmd string, args []string) {
+	if cmd != "ls" && cmd != "show" {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("results "+cmd, flag.ExitOnError)
+	root := fs.String("root", "", "directory holding the results. Defaults to the ResultsRoot of the config")
+	configfile := fs.String("config", "", "JSON config file. If empty, the results are in $GOPATH/results/ransuq")
+	var filter ransuq.CatalogFilter
+	fs.StringVar(&filter.Training, "training", "", "pattern for the training data")
+	fs.StringVar(&filter.Features, "features", "", "pattern for the feature set")
+	fs.StringVar(&filter.Weight, "weight", "", "pattern for the weight function")
+	fs.StringVar(&filter.Algorithm, "algorithm", "", "pattern for the algorithm")
+	fs.StringVar(&filter.Convergence, "convergence", "", "pattern for the convergence settings")
+	fs.StringVar(&filter.Status, "status", "", "pattern for the status of the last run")
+	asJSON := fs.Bool("json", false, "print the entries as JSON")
+	fs.Parse(args)
+
+	if *root == "" {
+		config, err := getConfig(*configfile)
+		if err != nil {
+			log.Fatal("error getting config: ", err)
+		}
+		*root = config.ResultsRoot
+	}
+	catalog, err := ransuq.ScanCatalog(*root)
+	if err != nil {
+		log.Fatal("error reading results: ", err)
+	}
+	entries := catalog.Find(filter)
+	if fs.NArg() != 0 {
+		entries = withSavepaths(entries, fs.Args())
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(entries, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	switch cmd {
+	case "ls":
+		list(entries)
+	case "show":
+		for _, e := range entries {
+			show(e)
+		}
+	}
+}
+
+// getConfig loads the config file, or returns the default config if there is
+// no file.
+func getConfig(filename string) (*settings.Config, error) {
+	if filename == "" {
+		return settings.DefaultConfig()
+	}
+	return settings.LoadConfig(filename)
+}
+
+// withSavepaths returns the entries with one of the savepaths.
+func withSavepaths(entries []*ransuq.CatalogEntry, savepaths []string) []*ransuq.CatalogEntry {
+	want := make(map[string]bool)
+	for _, s := range savepaths {
+		want[filepath.Clean(s)] = true
+	}
+	var found []*ransuq.CatalogEntry
+	for _, e := range entries {
+		if want[filepath.Clean(e.Savepath)] {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func list(entries []*ransuq.CatalogEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TRAINING\tFEATURES\tWEIGHT\tALGORITHM\tCONVERGENCE\tSTATUS\tOBJECTIVE\tCV R2")
+	for _, e := range entries {
+		training := e.Training
+		if training == "" {
+			training = e.Savepath
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			training, e.Features, e.Weight, e.Algorithm, e.Convergence, status(e), objective(e), cvR2(e))
+	}
+	w.Flush()
+}
+
+func show(e *ransuq.CatalogEntry) {
+	fmt.Println(e.Savepath)
+	fmt.Printf("  training:    %v\n", e.Training)
+	fmt.Printf("  features:    %v\n", e.Features)
+	fmt.Printf("  weight:      %v\n", e.Weight)
+	fmt.Printf("  algorithm:   %v\n", e.Algorithm)
+	fmt.Printf("  convergence: %v\n", e.Convergence)
+	fmt.Printf("  status:      %v\n", status(e))
+	if !e.End.IsZero() {
+		fmt.Printf("  finished:    %v\n", e.End.Format("2006-01-02 15:04:05"))
+	}
+	if e.Error != "" {
+		fmt.Printf("  error:       %v\n", e.Error)
+	}
+	if e.Result != nil {
+		fmt.Printf("  objective:   %v (gradient norm %v, %v evaluations)\n",
+			e.Result.OptObj, e.Result.OptGradNorm, e.Result.FunctionEvaluations)
+	}
+	for _, p := range e.Phases {
+		fmt.Printf("  %v %v: %v", p.Phase, p.ID, p.Status)
+		if p.Error != "" {
+			fmt.Printf(": %v", p.Error)
+		}
+		fmt.Println()
+	}
+	for _, s := range e.Folds {
+		fmt.Printf("  cross-validation %v: RMSE %v ± %v, MAE %v ± %v, R2 %v ± %v over %v folds\n",
+			s.Output, s.MeanRMSE, s.StdRMSE, s.MeanMAE, s.StdMAE, s.MeanR2, s.StdR2, s.Folds)
+	}
+	fmt.Println()
+}
+
+func status(e *ransuq.CatalogEntry) string {
+	switch {
+	case e.Status != "":
+		return string(e.Status)
+	case e.Trained:
+		return "trained"
+	}
+	return "-"
+}
+
+func objective(e *ransuq.CatalogEntry) string {
+	if e.Result == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.6g", e.Result.OptObj)
+}
+
+func cvR2(e *ransuq.CatalogEntry) string {
+	if len(e.Folds) == 0 {
+		return "-"
+	}
+	var s string
+	for i, f := range e.Folds {
+		if i != 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%.4g", f.MeanR2)
+	}
+	return s
+}
@@ -0,0 +1,328 @@
+package ransuq
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CrossValidation trains a settings case on folds of a group of datasets and
+// tests each trained algorithm on the datasets held out of its fold. Every
+// fold trains on Base.TrainingData and the group datasets not in the fold, and
+// tests on the held out datasets and Base.TestingData. Datasets shared between
+// folds are only generated once.
+type CrossValidation struct {
+	Base  *Settings
+	Group []Dataset // Datasets split into folds
+	K     int       // Number of folds. Zero or len(Group) leaves out one dataset at a time
+
+	// NewTrainer returns a new trainer for a fold. Training changes the
+	// trainer, so the folds cannot share one while they run at the same time.
+	NewTrainer func() (*Trainer, error)
+}
+
+// Fold is one of the cases of a cross-validation.
+type Fold struct {
+	Index    int
+	HeldOut  []Dataset
+	Settings *Settings
+}
+
+// CrossValidationDirectory returns where the folds and the metrics of a
+// cross-validation of the settings are saved.
+func CrossValidationDirectory(savepath string) string {
+	return filepath.Join(savepath, "crossvalidation")
+}
+
+// Folds returns the folds of the cross-validation. Dataset i of the group is
+// held out in fold i mod K.
+func (cv *CrossValidation) Folds() ([]*Fold, error) {
+	k := cv.K
+	if k == 0 {
+		k = len(cv.Group)
+	}
+	if k < 2 || k > len(cv.Group) {
+		return nil, fmt.Errorf("crossvalidation: %v folds for %v datasets", k, len(cv.Group))
+	}
+	if cv.NewTrainer == nil {
+		return nil, errors.New("crossvalidation: NewTrainer is nil")
+	}
+	folds := make([]*Fold, k)
+	for i := range folds {
+		trainer, err := cv.NewTrainer()
+		if err != nil {
+			return nil, err
+		}
+		set := *cv.Base
+		set.Trainer = trainer
+		set.TrainingData = append([]Dataset{}, cv.Base.TrainingData...)
+		set.TestingData = nil
+		fold := &Fold{Index: i, Settings: &set}
+		for j, dataset := range cv.Group {
+			if j%k == i {
+				fold.HeldOut = append(fold.HeldOut, dataset)
+			} else {
+				set.TrainingData = append(set.TrainingData, dataset)
+			}
+		}
+		set.TestingData = append(append(set.TestingData, fold.HeldOut...), cv.Base.TestingData...)
+		set.Savepath = filepath.Join(CrossValidationDirectory(cv.Base.Savepath), "fold_"+strconv.Itoa(i))
+		folds[i] = fold
+	}
+	return folds, nil
+}
+
+// Metrics are the errors of a trained algorithm predicting one output on a
+// dataset.
+type Metrics struct {
+	Fold    int
+	Dataset string
+	Output  string
+	N       int // Number of data points
+	RMSE    float64
+	MAE     float64
+	R2      float64 // NaN if the output is constant on the dataset
+}
+
+// MetricsSummary is the mean and standard deviation across folds of the
+// metrics for one output on the held out datasets.
+type MetricsSummary struct {
+	Output   string
+	Folds    int
+	MeanRMSE float64
+	StdRMSE  float64
+	MeanMAE  float64
+	StdMAE   float64
+	MeanR2   float64 // Leaves out the datasets on which R2 is NaN
+	StdR2    float64
+}
+
+// CrossValidationResult is the outcome of a cross-validation.
+type CrossValidationResult struct {
+	Folds   []*Fold
+	Reports []*RunReport
+	Errs    []error   // Error for each fold
+	Metrics []Metrics // Metrics on the held out datasets of the folds that trained
+	Summary []MetricsSummary
+}
+
+// Run runs the folds with the pipeline, evaluates each trained algorithm on
+// its held out datasets, and saves the metrics as metrics.csv and summary.csv
+// in the CrossValidationDirectory. The held out datasets of each fold are saved
+// in folds.csv. Folds which did not train are left out of the metrics and
+// their error is in Errs.
+func (cv *CrossValidation) Run(ctx context.Context, p *Pipeline) (*CrossValidationResult, error) {
+	folds, err := cv.Folds()
+	if err != nil {
+		return nil, err
+	}
+	sets := make([]*Settings, len(folds))
+	for i, fold := range folds {
+		sets[i] = fold.Settings
+	}
+	r := &CrossValidationResult{Folds: folds}
+	r.Reports, r.Errs = p.Run(ctx, sets)
+
+	for i, fold := range folds {
+		sp, err := LoadScalePredictor(fold.Settings.Savepath)
+		if err != nil {
+			if r.Errs[i] == nil {
+				r.Errs[i] = err
+			}
+			continue
+		}
+		for _, dataset := range fold.HeldOut {
+			m, err := evaluate(sp, fold.Settings, dataset)
+			if err != nil {
+				r.Errs[i] = err
+				break
+			}
+			for j := range m {
+				m[j].Fold = i
+			}
+			r.Metrics = append(r.Metrics, m...)
+		}
+	}
+	r.Summary = summarizeMetrics(cv.Base.OutputFeatures, r.Metrics)
+
+	dir := CrossValidationDirectory(cv.Base.Savepath)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return r, err
+	}
+	err = writeFolds(filepath.Join(dir, "folds.csv"), folds)
+	if err != nil {
+		return r, err
+	}
+	err = writeMetrics(filepath.Join(dir, "metrics.csv"), r.Metrics)
+	if err != nil {
+		return r, err
+	}
+	return r, writeSummary(filepath.Join(dir, "summary.csv"), r.Summary)
+}
+
+// evaluate returns the metrics of the predictor for each output on the dataset.
+// R2 is undefined when the output is the same at every data point, so it is
+// NaN for those outputs.
+func evaluate(sp ScalePredictor, set *Settings, dataset Dataset) ([]Metrics, error) {
+	inputs, outputs, _, err := set.loader().LoadData(dataset, set.LoadStyle, set.InputFeatures, set.OutputFeatures, nil)
+	if err != nil {
+		return nil, err
+	}
+	nSamples, inputDim := inputs.Dims()
+	if nSamples == 0 {
+		return nil, fmt.Errorf("crossvalidation: held out dataset %v has no data points", dataset.ID())
+	}
+	nOutputs := len(set.OutputFeatures)
+
+	pred := make([]float64, nOutputs)
+	input := make([]float64, inputDim)
+	sumSq := make([]float64, nOutputs)
+	sumAbs := make([]float64, nOutputs)
+	sum := make([]float64, nOutputs)
+	sumTruthSq := make([]float64, nOutputs)
+	constant := make([]bool, nOutputs)
+	for j := range constant {
+		constant[j] = true
+	}
+	for i := 0; i < nSamples; i++ {
+		inputs.Row(input, i)
+		_, err := sp.Predict(input, pred)
+		if err != nil {
+			return nil, err
+		}
+		for j := range pred {
+			truth := outputs.At(i, j)
+			diff := pred[j] - truth
+			sumSq[j] += diff * diff
+			sumAbs[j] += math.Abs(diff)
+			sum[j] += truth
+			sumTruthSq[j] += truth * truth
+			if truth != outputs.At(0, j) {
+				constant[j] = false
+			}
+		}
+	}
+
+	metrics := make([]Metrics, nOutputs)
+	n := float64(nSamples)
+	for j := range metrics {
+		// The sums of squares cancel to rounding error rather than zero
+		// for a constant output, so it is checked for directly.
+		r2 := math.NaN()
+		if !constant[j] {
+			totalSq := sumTruthSq[j] - sum[j]*sum[j]/n
+			r2 = 1 - sumSq[j]/totalSq
+		}
+		metrics[j] = Metrics{
+			Dataset: dataset.ID(),
+			Output:  set.OutputFeatures[j],
+			N:       nSamples,
+			RMSE:    math.Sqrt(sumSq[j] / n),
+			MAE:     sumAbs[j] / n,
+			R2:      r2,
+		}
+	}
+	return metrics, nil
+}
+
+func summarizeMetrics(outputs []string, metrics []Metrics) []MetricsSummary {
+	summary := make([]MetricsSummary, len(outputs))
+	for i, output := range outputs {
+		var rmse, mae, r2 []float64
+		folds := make(map[int]bool)
+		for _, m := range metrics {
+			if m.Output != output {
+				continue
+			}
+			folds[m.Fold] = true
+			rmse = append(rmse, m.RMSE)
+			mae = append(mae, m.MAE)
+			if !math.IsNaN(m.R2) {
+				r2 = append(r2, m.R2)
+			}
+		}
+		summary[i] = MetricsSummary{Output: output, Folds: len(folds)}
+		summary[i].MeanRMSE, summary[i].StdRMSE = meanStd(rmse)
+		summary[i].MeanMAE, summary[i].StdMAE = meanStd(mae)
+		summary[i].MeanR2, summary[i].StdR2 = meanStd(r2)
+	}
+	return summary
+}
+
+// meanStd returns the mean and the sample standard deviation of x.
+func meanStd(x []float64) (mean, std float64) {
+	if len(x) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	for _, v := range x {
+		mean += v
+	}
+	mean /= float64(len(x))
+	if len(x) == 1 {
+		return mean, 0
+	}
+	for _, v := range x {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(x)-1))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', 8, 64)
+}
+
+func writeMetrics(filename string, metrics []Metrics) error {
+	records := [][]string{{"fold", "dataset", "output", "n", "rmse", "mae", "r2"}}
+	for _, m := range metrics {
+		records = append(records, []string{
+			strconv.Itoa(m.Fold), m.Dataset, m.Output, strconv.Itoa(m.N),
+			formatFloat(m.RMSE), formatFloat(m.MAE), formatFloat(m.R2),
+		})
+	}
+	return writeCSVFile(filename, records)
+}
+
+func writeSummary(filename string, summary []MetricsSummary) error {
+	records := [][]string{{"output", "folds", "mean_rmse", "std_rmse", "mean_mae", "std_mae", "mean_r2", "std_r2"}}
+	for _, s := range summary {
+		records = append(records, []string{
+			s.Output, strconv.Itoa(s.Folds),
+			formatFloat(s.MeanRMSE), formatFloat(s.StdRMSE),
+			formatFloat(s.MeanMAE), formatFloat(s.StdMAE),
+			formatFloat(s.MeanR2), formatFloat(s.StdR2),
+		})
+	}
+	return writeCSVFile(filename, records)
+}
+
+func writeCSVFile(filename string, records [][]string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(f).WriteAll(records)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeFolds(filename string, folds []*Fold) error {
+	records := [][]string{{"fold", "held_out", "savepath"}}
+	for _, fold := range folds {
+		ids := make([]string, len(fold.HeldOut))
+		for i, d := range fold.HeldOut {
+			ids[i] = d.ID()
+		}
+		records = append(records, []string{strconv.Itoa(fold.Index), strings.Join(ids, " "), fold.Settings.Savepath})
+	}
+	return writeCSVFile(filename, records)
+}
@@ -0,0 +1,233 @@
+package ransuq
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// DependencyError is the error of a job which was not run because a job it
+// depends on failed.
+type DependencyError struct {
+	Dep string // Key of the failed dependency
+	Err error
+}
+
+func (d DependencyError) Error() string {
+	return "dependency " + d.Dep + " failed: " + d.Err.Error()
+}
+
+// PanicError is the error of a job which panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", p.Value, p.Stack)
+}
+
+// JobError is the error of a job in a Graph.
+type JobError struct {
+	Phase Phase
+	ID    string
+	Err   error
+}
+
+func (j JobError) Error() string {
+	return string(j.Phase) + " " + j.ID + ": " + j.Err.Error()
+}
+
+// SubmitFunc sends a Generatable to the scheduler and blocks until it has
+// been run, returning the error from the run.
+type SubmitFunc func(Generatable) error
+
+// A Job is a node in a Graph. A job is run once all of its dependencies have
+// finished without error.
+type Job struct {
+	Phase Phase
+	ID    string
+	Deps  []*Job
+
+	// Run does the work of the job. Any Generatables should be run by calling
+	// submit so that they go through the scheduler. Run returns the artifacts
+	// produced by the job. A job that finishes without calling submit is
+	// marked as cached.
+	Run func(submit SubmitFunc) (artifacts []string, err error)
+
+	// Cached, if not nil, returns whether the work of the job has already
+	// been done. It is used for planning and must not run anything.
+	Cached func() bool
+
+	// Result is set once the job is finished.
+	Result JobResult
+
+	done chan struct{}
+}
+
+// Key returns the identifier of the job in the graph.
+func (j *Job) Key() string {
+	return string(j.Phase) + ":" + j.ID
+}
+
+// JobResult is the outcome of running a job.
+type JobResult struct {
+	Status    Status
+	Err       error
+	Start     time.Time
+	End       time.Time
+	Artifacts []string
+	Attempts  []Attempt // Runs of the Generatables submitted by the job
+}
+
+// report returns the report of the job.
+func (j *Job) report() PhaseReport {
+	return PhaseReport{
+		Phase:     j.Phase,
+		ID:        j.ID,
+		Start:     j.Result.Start,
+		End:       j.Result.End,
+		Status:    j.Result.Status,
+		Error:     errString(j.Result.Err),
+		Artifacts: j.Result.Artifacts,
+		Attempts:  j.Result.Attempts,
+	}
+}
+
+// Graph is a set of jobs with dependencies between them.
+type Graph struct {
+	Retry   RetryPolicy       // How failed Generatables are run again
+	Metrics *SchedulerMetrics // If not nil, records the scheduler events of the jobs of the graph
+
+	jobs  []*Job
+	byKey map[string]*Job
+}
+
+func NewGraph() *Graph {
+	return &Graph{
+		byKey: make(map[string]*Job),
+	}
+}
+
+// Add adds the job to the graph and returns it. If a job with the same key
+// is already in the graph, the existing job is returned instead. All of the
+// dependencies of the job must already be in the graph.
+func (g *Graph) Add(job *Job) *Job {
+	if existing, ok := g.byKey[job.Key()]; ok {
+		return existing
+	}
+	for _, dep := range job.Deps {
+		if g.byKey[dep.Key()] != dep {
+			panic("ransuq: dependency " + dep.Key() + " not in graph")
+		}
+	}
+	g.jobs = append(g.jobs, job)
+	g.byKey[job.Key()] = job
+	return job
+}
+
+// Jobs returns the jobs in the order they were added.
+func (g *Graph) Jobs() []*Job {
+	return g.jobs
+}
+
+// Run runs all of the jobs in the graph, sending Generatables to the
+// scheduler. A job whose dependency failed fails with a DependencyError, and
+// jobs not started before the context is cancelled are skipped. Run returns
+// once every job is finished.
+func (g *Graph) Run(ctx context.Context, scheduler Scheduler) {
+	for _, job := range g.jobs {
+		job.done = make(chan struct{})
+	}
+	wg := &sync.WaitGroup{}
+	for _, job := range g.jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			defer close(job.done)
+			g.runJob(ctx, scheduler, job)
+			Emit(Event{
+				Kind:   EventJobFinished,
+				Phase:  job.Phase,
+				ID:     job.ID,
+				Status: job.Result.Status,
+				Error:  errString(job.Result.Err),
+			})
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (g *Graph) runJob(ctx context.Context, scheduler Scheduler, job *Job) {
+	for _, dep := range job.Deps {
+		<-dep.done
+	}
+	job.Result.Start = time.Now()
+	defer func() {
+		job.Result.End = time.Now()
+	}()
+
+	for _, dep := range job.Deps {
+		switch dep.Result.Status {
+		case StatusSkipped:
+			job.Result.Status = StatusSkipped
+			job.Result.Err = ErrSkipped
+			return
+		case StatusFailed:
+			job.Result.Status = StatusFailed
+			job.Result.Err = DependencyError{Dep: dep.Key(), Err: dep.Result.Err}
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		job.Result.Status = StatusSkipped
+		job.Result.Err = ErrSkipped
+		return
+	}
+
+	var submitted bool
+	submit := func(gen Generatable) error {
+		submitted = true
+		return g.Retry.run(ctx, gen, func(gen Generatable) error {
+			return runOnScheduler(ctx, scheduler, gen, g.Metrics)
+		}, &job.Result.Attempts)
+	}
+	artifacts, err := callJob(job, submit)
+	job.Result.Err = err
+	job.Result.Status = statusOf(err)
+	if err == nil {
+		job.Result.Artifacts = artifacts
+		if !submitted {
+			job.Result.Status = StatusCached
+		}
+	}
+}
+
+// callJob runs the job, turning a panic into an error.
+func callJob(job *Job, submit SubmitFunc) (artifacts []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return job.Run(submit)
+}
+
+// runOnScheduler sends the Generatable to the scheduler on its own channel so
+// the result read back is always for this Generatable. The scheduler events
+// of the Generatable are recorded in the metrics if they are not nil.
+func runOnScheduler(ctx context.Context, scheduler Scheduler, gen Generatable, metrics *SchedulerMetrics) error {
+	io := GeneratableIO{
+		In:  make(chan Generatable),
+		Out: make(chan GenerateFinished),
+	}
+	scheduler.AddChannel(io)
+	t := newTracked(gen, ctx)
+	t.metrics = metrics
+	io.In <- t
+	close(io.In)
+	fin := <-io.Out
+	return fin.Err
+}
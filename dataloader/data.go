@@ -8,6 +8,12 @@ import (
 	"github.com/gonum/floats"
 )
 
+// Logf is called with progress messages. By default the messages are printed
+// to standard output.
+var Logf = func(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
 var identityFunc func([]float64) (float64, error) = func(d []float64) (float64, error) {
 	if len(d) != 1 {
 		return math.NaN(), fmt.Errorf("Length of data is not 1")
@@ -71,9 +77,9 @@ func Load(fields []string, datasets []*Dataset) ([][][]float64, error) {
 		go func(i int, dataset *Dataset) {
 			data[i], errors[i] = LoadFromDataset(fields, dataset)
 			if errors[i] != nil {
-				fmt.Println(dataset.Name, ": error loading: ", errors[i])
+				Logf("%v: error loading: %v", dataset.Name, errors[i])
 			} else {
-				fmt.Println(dataset.Name, ": loaded successfully")
+				Logf("%v: loaded successfully", dataset.Name)
 			}
 			w.Done()
 		}(i, dataset)
@@ -538,7 +538,7 @@ func (s *SU2_restart_2dturb) Fieldmap(fieldname string) *FieldTransformer {
 }
 
 func (s *SU2_restart_2dturb) NewAppendFields(filename string, newFilename string, newVarnames []string, newData [][]float64) error {
-	fmt.Println("in su2 new append fields")
+	Logf("appending fields %v to %v", newVarnames, filename)
 
 	// Check inputs
 	nNewVars := len(newVarnames)
@@ -1,6 +1,7 @@
 package ransuq
 
 import (
+	"context"
 	"sync"
 
 	"github.com/reggo/reggo/common"
@@ -18,6 +19,13 @@ type Generatable interface {
 	NumCores() int // Number of cores the job needs to run
 }
 
+// A ContextRunner is a Generatable that can stop partway through its run.
+// When the run is cancelled, RunContext should abort and return the context
+// error. Generatables which do not implement ContextRunner run to completion.
+type ContextRunner interface {
+	RunContext(ctx context.Context) error
+}
+
 // A CompGenerator is a type which can take in the trained algorithm and
 // return a Generatable dataset
 type Comparable interface {
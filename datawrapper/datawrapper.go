@@ -4,11 +4,15 @@ package datawrapper
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image/color"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -19,6 +23,7 @@ import (
 
 	"github.com/btracey/ransuq"
 	"github.com/btracey/ransuq/dataloader"
+	"github.com/btracey/su2tools/config"
 	"github.com/btracey/su2tools/config/enum"
 	"github.com/btracey/su2tools/driver"
 
@@ -27,18 +32,52 @@ import (
 	"github.com/gonum/matrix/mat64"
 )
 
+func init() {
+	// Send the progress of data loading to the ransuq events
+	dataloader.Logf = ransuq.Debugf
+}
+
 // SU2 is a type for loading SU2 data and running SU2 Cases
 type SU2 struct {
 	Driver                  *driver.Driver
 	Su2Caller               driver.Syscaller
+	SU2Path                 string // Directory holding the SU2 executables. If empty, they are found from $SU2_RUN and $PATH
 	IgnoreNames             []string
 	IgnoreFunc              func([]float64) bool
+	IgnoreSpec              string // Identifies IgnoreFunc in the training fingerprint
 	Name                    string
 	ComparisonPostprocessor Postprocessor
 	ExtraMlStrings          []string
 	ComparisonNameAddendum  string // Additional string to append after _ML in the comparison file
+
+	// RetryCFLFactor, if nonzero, multiplies the CFL number before a failed
+	// run is retried. The retry runs with a copy of the options, and the
+	// lowered CFL number is recorded in the working directory so that the
+	// case is still generated for the unchanged settings.
+	RetryCFLFactor float64
+
+	// Memory is the number of bytes needed to run SU2. If it is zero, the
+	// memory is estimated from the size of the mesh file.
+	Memory int64
+}
+
+// retryFilename is the file in the working directory which records the CFL
+// number of a retried run.
+const retryFilename = "ransuq_retry.json"
+
+// retryRecord is the CFL number of the settings and the lowered CFL number
+// the case was retried with. Pending is set until the attempt it was written
+// for has started.
+type retryRecord struct {
+	CflNumber      float64
+	RetryCflNumber float64
+	Pending        bool `json:",omitempty"`
 }
 
+// su2MeshMemoryFactor is the approximate ratio of the memory used by SU2 to
+// the size of its mesh file.
+const su2MeshMemoryFactor = 20
+
 func (su *SU2) ID() string {
 	return su.Name
 }
@@ -47,10 +86,54 @@ func (su *SU2) NumCores() int {
 	return su.Su2Caller.NumCores()
 }
 
+// MemoryEstimate returns the memory needed to run the case.
+func (su *SU2) MemoryEstimate() int64 {
+	if su.Memory != 0 {
+		return su.Memory
+	}
+	mesh := su.Driver.Options.MeshFilename
+	if !filepath.IsAbs(mesh) {
+		mesh = filepath.Join(su.Driver.Wd, mesh)
+	}
+	info, err := os.Stat(mesh)
+	if err != nil {
+		return 0
+	}
+	return su2MeshMemoryFactor * info.Size()
+}
+
 func (su *SU2) Identifier() string {
 	return su.Name
 }
 
+// Artifacts returns the files written by SU2 which are sent back from a
+// ransuq.Worker. These are the config and log, which are checked to see if the
+// case was computed, and the solution and restart files. The rest of the run
+// directory stays on the worker so that the reply stays small.
+func (su *SU2) Artifacts() []string {
+	d := su.Driver
+	return []string{
+		filepath.Join(d.Wd, d.Config),
+		filepath.Join(d.Wd, d.Stdout),
+		filepath.Join(d.Wd, d.Options.SolutionFlowFilename),
+		filepath.Join(d.Wd, d.Options.RestartFlowFilename),
+	}
+}
+
+// SourceFiles returns the flow solution the data are loaded from.
+func (su *SU2) SourceFiles() []string {
+	return []string{filepath.Join(su.Driver.Wd, su.Driver.Options.SolutionFlowFilename)}
+}
+
+// LoadSpec returns the ignore settings. It is empty if IgnoreFunc is set
+// without an IgnoreSpec, so the loaded data are not cached.
+func (su *SU2) LoadSpec() string {
+	if su.IgnoreFunc != nil && su.IgnoreSpec == "" {
+		return ""
+	}
+	return fmt.Sprintf("ignore %v %v", su.IgnoreNames, su.IgnoreSpec)
+}
+
 func (su *SU2) SetSyscaller(sys driver.Syscaller) {
 	su.Su2Caller = sys
 }
@@ -105,11 +188,12 @@ func (su *SU2) Load(fields []string) (common.RowMatrix, error) {
 func (su *SU2) Generated() bool {
 	_ = ransuq.Comparable(su)
 
-	status := su.Driver.Status()
+	d := su.ranDriver()
+	status := d.Status()
 
-	b := su.Driver.IsComputed(status)
+	b := d.IsComputed(status)
 	if !b {
-		fmt.Println("Not computed: ", b)
+		ransuq.Debugf("%v not computed: %v", su.Name, status)
 	}
 	return b
 
@@ -135,12 +219,153 @@ func (su *SU2) Generated() bool {
 	*/
 }
 
+// PrepareRetry lowers the CFL number by RetryCFLFactor for each failed
+// attempt before the case is run again. Driver is shared by every case using
+// the dataset, so it is not changed. Instead the lowered CFL number is
+// recorded in the working directory, and the next attempt runs with a copy of
+// the driver made from the record.
+func (su *SU2) PrepareRetry(attempt int, err error) error {
+	if su.RetryCFLFactor == 0 {
+		return nil
+	}
+	record := retryRecord{
+		CflNumber:      su.Driver.Options.CflNumber,
+		RetryCflNumber: su.Driver.Options.CflNumber * math.Pow(su.RetryCFLFactor, float64(attempt)),
+		Pending:        true,
+	}
+	err = os.MkdirAll(su.Driver.Wd, 0700)
+	if err != nil {
+		return err
+	}
+	err = su.writeRetry(record)
+	if err != nil {
+		return err
+	}
+	ransuq.Infof("%v: retrying with CFL number %v", su.Name, record.RetryCflNumber)
+	return nil
+}
+
+// readRetry returns the retry record in the working directory if it was
+// written for the CFL number of Driver.
+func (su *SU2) readRetry() (retryRecord, bool) {
+	var record retryRecord
+	b, err := ioutil.ReadFile(filepath.Join(su.Driver.Wd, retryFilename))
+	if err != nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil || record.CflNumber != su.Driver.Options.CflNumber {
+		return record, false
+	}
+	return record, true
+}
+
+func (su *SU2) writeRetry(record retryRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(su.Driver.Wd, retryFilename), b, 0600)
+}
+
+// withCFL returns a copy of the driver with the CFL number changed.
+func withCFL(d *driver.Driver, cfl float64) *driver.Driver {
+	retry := *d
+	retry.Options = d.Options.Copy()
+	retry.Options.CflNumber = cfl
+	if d.OptionList != nil {
+		retry.OptionList = make(config.OptionList, len(d.OptionList)+1)
+		for key, val := range d.OptionList {
+			retry.OptionList[key] = val
+		}
+		retry.OptionList["CflNumber"] = true
+	}
+	return &retry
+}
+
+// nextDriver returns the driver of the next attempt. The lowered CFL number
+// recorded by PrepareRetry is only used for the attempt it was prepared for,
+// so the record is marked as used, and later runs of the dataset, and their
+// job specs, use Driver again.
+func (su *SU2) nextDriver() (*driver.Driver, error) {
+	record, ok := su.readRetry()
+	if !ok || !record.Pending {
+		return su.Driver, nil
+	}
+	record.Pending = false
+	err := su.writeRetry(record)
+	if err != nil {
+		return nil, err
+	}
+	return withCFL(su.Driver, record.RetryCflNumber), nil
+}
+
+// ranDriver returns the driver whose options match the run in the working
+// directory. This is Driver unless the case was retried with a lower CFL
+// number for the current settings.
+func (su *SU2) ranDriver() *driver.Driver {
+	if su.Driver.IsComputed(su.Driver.Status()) {
+		return su.Driver
+	}
+	record, ok := su.readRetry()
+	if !ok {
+		return su.Driver
+	}
+	return withCFL(su.Driver, record.RetryCflNumber)
+}
+
+// Run runs SU2, first creating the directory containing the working
+// directory. The directories of comparisons are not created until they run so
+// that checking them has no side effects.
 func (su *SU2) Run() error {
-	err := su.Driver.Run(su.Su2Caller)
+	d, err := su.nextDriver()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(d.Wd), 0700)
+	if err != nil {
+		return err
+	}
+	caller := su.Su2Caller
+	if su.SU2Path != "" {
+		caller = pathCaller{Syscaller: caller, path: su.SU2Path}
+	}
+	err = d.Run(caller)
 	if err != nil {
 		return err
 	}
-	return su.Driver.CopyRestartToSolution()
+	return d.CopyRestartToSolution()
+}
+
+// pathCaller runs the executables in a directory rather than those found from
+// the environment of the process.
+type pathCaller struct {
+	driver.Syscaller
+	path string
+}
+
+// Syscall returns the command of the wrapped caller changed to run the
+// executable of that name in the directory. The directory is also given to
+// the command as SU2_RUN, which the SU2 python scripts use, and at the front
+// of its PATH.
+func (p pathCaller) Syscall(d *driver.Driver) *exec.Cmd {
+	cmd := p.Syscaller.Syscall(d)
+	if name := cmd.Args[0]; !strings.ContainsRune(name, filepath.Separator) {
+		exe := filepath.Join(p.path, name)
+		if _, err := os.Stat(exe); err == nil {
+			cmd.Path = exe
+			cmd.Err = nil
+		}
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env,
+		"SU2_RUN="+p.path,
+		"PATH="+p.path+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+	return cmd
 }
 
 func (su *SU2) Comparison(algfile string, outLoc string, featureSet string) (ransuq.Generatable, error) {
@@ -157,14 +382,9 @@ func (su *SU2) Comparison(algfile string, outLoc string, featureSet string) (ran
 	newName := drive.Name + "_ml" + su.ComparisonNameAddendum
 	newDir := filepath.Join(outLoc, newName)
 	postprocessDir := filepath.Join(newDir, "postprocess")
-	err := os.MkdirAll(newDir, 0700)
-	if err != nil {
-		return nil, err
-	}
 
 	wd := filepath.Join(newDir, "su2run")
 
-	fmt.Println("wd is ", wd)
 	mlDriver := &driver.Driver{
 		Name:    newName,
 		Options: drive.Options.Copy(),
@@ -186,23 +406,17 @@ func (su *SU2) Comparison(algfile string, outLoc string, featureSet string) (ran
 		return nil, err
 	}
 
-	fmt.Println("first abs mesh is", absMesh)
-
 	// Get the relative mesh path
 	relMesh, err := filepath.Rel(wd, absMesh)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("algfile is ", algfile)
-
 	// Alg filename given by me so it's an absolute path
 	relAlgFile, err := filepath.Rel(wd, algfile)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("rel algfile is", relAlgFile)
-	fmt.Println("rel mesh is", relMesh)
 
 	// Now, change the turbulence model to SA, and add the json file
 	mlDriver.Options.KindTurbModel = enum.Ml
@@ -223,9 +437,14 @@ func (su *SU2) Comparison(algfile string, outLoc string, featureSet string) (ran
 		SU2: &SU2{
 			Driver:      mlDriver,
 			Su2Caller:   su.Su2Caller,
+			SU2Path:     su.SU2Path,
 			IgnoreNames: su.IgnoreNames,
 			IgnoreFunc:  su.IgnoreFunc,
+			IgnoreSpec:  su.IgnoreSpec,
 			Name:        newName,
+
+			RetryCFLFactor: su.RetryCFLFactor,
+			Memory:         su.Memory,
 		},
 		OrigDriver:              su.Driver,
 		PostprocessDir:          postprocessDir,
@@ -241,9 +460,14 @@ type SU2ML struct {
 	ComparisonPostprocessor Postprocessor
 }
 
+// Artifacts returns the SU2 run directory and the comparison plots.
+func (su *SU2ML) Artifacts() []string {
+	return []string{su.SU2.Driver.Wd, su.PostprocessDir}
+}
+
 func (su *SU2ML) PostProcess() error {
 
-	status := su.Driver.Status()
+	status := su.ranDriver().Status()
 	if status != driver.ComputedSuccessfully {
 		if status == driver.ComputedWithError {
 			return nil
@@ -286,12 +510,11 @@ func (FlatplatePostprocessor) PostProcess(su *SU2ML) error {
 	// Want to call the flat-plate post process
 	//path := filepath.Join(su.SaveDir, "postprocess")
 	path := su.PostprocessDir
-	fmt.Println("path is for post process save", path)
 	err := flatplateCompare([]*driver.Driver{su.OrigDriver, su.SU2.Driver}, path)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("done post-process")
+	ransuq.Debugf("%v: flat plate postprocessing saved in %v", su.Name, path)
 
 	return nil
 }
@@ -299,13 +522,12 @@ func (FlatplatePostprocessor) PostProcess(su *SU2ML) error {
 type AirfoilPostprocessor struct{}
 
 func (AirfoilPostprocessor) PostProcess(su *SU2ML) error {
-	fmt.Println("in airfoil postprocess")
 	// Make a Cf plot comparing the ml and the original
 	err := makeCfPlot(su.OrigDriver, su.SU2.Driver, su.PostprocessDir)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("done post-process")
+	ransuq.Debugf("%v: airfoil postprocessing saved in %v", su.Name, su.PostprocessDir)
 	return err
 }
 
@@ -328,8 +550,6 @@ func makeCfPlot(orig, ml *driver.Driver, postprocessdir string) error {
 	origSurfFilename += ".csv"
 	newSurfFilename += ".csv"
 
-	fmt.Println("loading orig surf")
-
 	origSurf, err := os.Open(origSurfFilename)
 	defer origSurf.Close()
 	if err != nil {
@@ -370,10 +590,6 @@ func plotCfs(oldXs, newXs, oldCfs, newCfs []float64, filename string) error {
 		return err
 	}
 
-	/*
-		fmt.Println("old pts = ", oldPts)
-		fmt.Println(newPts)
-	*/
 	p.X.Min = 0
 	p.X.Max = 1
 	p.X.Label.Text = "x/c"
@@ -417,7 +633,6 @@ func readCfInfo(r io.Reader) ([]float64, []float64, error) {
 	cr.LazyQuotes = true
 	records, err := cr.ReadAll()
 	if err != nil {
-		fmt.Println("error reading all")
 		panic(err)
 		return nil, nil, err
 	}
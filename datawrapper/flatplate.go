@@ -1,7 +1,6 @@
 package datawrapper
 
 import (
-	"fmt"
 	"image/color"
 	"math"
 	"os"
@@ -19,8 +18,6 @@ import (
 	"github.com/gonum/plot/plotter"
 )
 
-var _ = fmt.Println
-
 var colorwheel []color.RGBA = []color.RGBA{{R: 255, B: 128, A: 255}, {B: 255, A: 255}, {G: 255, A: 255}, {R: 0, G: 0, B: 0, A: 255}}
 
 // FlatplateCompare compares the predictions of the drivers. The first driver
@@ -65,15 +62,11 @@ func flatplateCompare(drivers []*driver.Driver, resultLocation string) error {
 		}
 	}
 
-	fmt.Println("Starting data load")
-
-	fmt.Println("Datasets = ", datasets)
 	//datasets := mldriver.ConstructDataloaders(drivers)
 	data, err := dataloader.Load(inputNames, datasets)
 	if err != nil {
 		return err
 	}
-	fmt.Println("Done loading data")
 
 	/*
 		gamma := drivers[0].Options.GammaValue
@@ -290,11 +283,8 @@ func calculateSkinFrictionCoefficient(data [][][]float64, fields map[string]int,
 }
 
 func plotSkinFrictionCoefficient(xs, cfs [][]float64, title string, labels []string) (*plot.Plot, error) {
-	fmt.Println("In plot skin friction coefficient")
-
 	// Create a series of lines
 	p, _ := plot.New()
-	fmt.Println("Done making new plot")
 	p.Title.Text = " "
 	p.X.Label.Text = "X"
 	p.Y.Label.Text = "Cf"
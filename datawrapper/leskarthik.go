@@ -2,6 +2,7 @@ package datawrapper
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/btracey/ransuq/dataloader"
 	"github.com/gonum/matrix/mat64"
@@ -14,6 +15,7 @@ type CSV struct {
 	Name        string
 	IgnoreNames []string
 	IgnoreFunc  func([]float64) bool
+	IgnoreSpec  string // Identifies IgnoreFunc in the training fingerprint
 	FieldMap    map[string]string
 }
 
@@ -21,6 +23,25 @@ func (csv *CSV) ID() string {
 	return csv.Name
 }
 
+// Artifacts returns the location of the CSV file.
+func (csv *CSV) Artifacts() []string {
+	return []string{csv.Location}
+}
+
+// SourceFiles returns the location of the CSV file.
+func (csv *CSV) SourceFiles() []string {
+	return []string{csv.Location}
+}
+
+// LoadSpec returns the ignore settings and the field map. It is empty if
+// IgnoreFunc is set without an IgnoreSpec, so the loaded data are not cached.
+func (csv *CSV) LoadSpec() string {
+	if csv.IgnoreFunc != nil && csv.IgnoreSpec == "" {
+		return ""
+	}
+	return fmt.Sprintf("ignore %v %v fields %v", csv.IgnoreNames, csv.IgnoreSpec, csv.FieldMap)
+}
+
 func (csv *CSV) Load(fields []string) (common.RowMatrix, error) {
 	loader := &dataloader.Dataset{
 		Name:     csv.Name,
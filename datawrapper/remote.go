@@ -0,0 +1,100 @@
+package datawrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/btracey/ransuq"
+	"github.com/btracey/su2tools/driver"
+)
+
+// su2JobKind is the kind of the remote jobs which run SU2.
+const su2JobKind = "su2"
+
+// su2Spec is the spec of a remote SU2 job. The Syscaller is rebuilt from its
+// kind and number of cores, so a case which needs several cores runs with
+// them on the worker. The SU2Path is only used if it exists where the job is
+// run, so that a worker on another machine uses its own SU2.
+type su2Spec struct {
+	Driver  *driver.Driver
+	Caller  string // Kind of the Syscaller, as given by CallerKind
+	Cores   int
+	SU2Path string
+}
+
+var (
+	callerMux sync.RWMutex
+	callers   = map[string]func(cores int) driver.Syscaller{
+		CallerKind(driver.Serial{}): func(int) driver.Syscaller { return driver.Serial{} },
+	}
+)
+
+// CallerKind returns the name a Syscaller is registered under, which is the
+// name of its type.
+func CallerKind(caller driver.Syscaller) string {
+	return fmt.Sprintf("%T", caller)
+}
+
+// RegisterCaller sets the function which rebuilds the Syscallers of the kind
+// with the number of cores when an SU2 case is run by a ransuq.Worker, a
+// batch job or a subprocess. Serial callers are registered already. It is
+// normally called from init.
+func RegisterCaller(kind string, rebuild func(cores int) driver.Syscaller) {
+	callerMux.Lock()
+	callers[kind] = rebuild
+	callerMux.Unlock()
+}
+
+func rebuildCaller(kind string, cores int) (driver.Syscaller, error) {
+	callerMux.RLock()
+	rebuild, ok := callers[kind]
+	callerMux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("SU2 caller %q not registered", kind)
+	}
+	return rebuild(cores), nil
+}
+
+func init() {
+	ransuq.RegisterJobKind(su2JobKind, func(spec []byte) (ransuq.Generatable, error) {
+		var s su2Spec
+		err := json.Unmarshal(spec, &s)
+		if err != nil {
+			return nil, err
+		}
+		caller, err := rebuildCaller(s.Caller, s.Cores)
+		if err != nil {
+			return nil, err
+		}
+		if s.SU2Path != "" {
+			if _, err := os.Stat(s.SU2Path); err != nil {
+				s.SU2Path = ""
+			}
+		}
+		return &SU2{Driver: s.Driver, Su2Caller: caller, SU2Path: s.SU2Path, Name: s.Driver.Name}, nil
+	})
+}
+
+// JobSpec returns the driver of the next attempt of the case and its caller so
+// it can be run by a ransuq.Worker. The mesh and the other inputs of the case
+// must be at the same paths on the worker.
+func (su *SU2) JobSpec() (string, []byte, error) {
+	d, err := su.nextDriver()
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := json.Marshal(su2Spec{
+		Driver:  d,
+		Caller:  CallerKind(su.Su2Caller),
+		Cores:   su.Su2Caller.NumCores(),
+		SU2Path: su.SU2Path,
+	})
+	return su2JobKind, b, err
+}
+
+// Requirements returns that the case must run on a worker with SU2.
+func (su *SU2) Requirements() []string {
+	return []string{ransuq.CapabilitySU2}
+}
@@ -0,0 +1,199 @@
+package ransuq
+
+import (
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeterministicScheduler is a Scheduler for tests which runs one job at a
+// time in the calling process. Each time a job finishes, it waits until no new
+// jobs have arrived for Settle, and then chooses the next job from those
+// waiting using a random source seeded with Seed. The waiting jobs are sorted
+// by ID before choosing, so the order only depends on the seed and the IDs as
+// long as every job which will be sent arrives within Settle of the one before
+// it.
+//
+// Faults may be injected by job ID to test the handling of failures.
+type DeterministicScheduler struct {
+	Seed   int64
+	Settle time.Duration
+	Faults map[string]Fault
+
+	launch   sync.Once
+	quitOnce sync.Once
+	quit     chan struct{}
+	jobs     chan *deterministicJob
+
+	mux   sync.Mutex
+	order []string
+	runs  map[string]int
+}
+
+// Fault is a failure injected by the DeterministicScheduler when running a
+// job.
+type Fault struct {
+	Delay time.Duration // Time to wait before running the job
+	Err   error         // If not nil, returned instead of running the job
+	Panic interface{}   // If not nil, the job panics with this value instead of running
+
+	// Times is the number of runs of the job which have the fault, after
+	// which it runs as normal. Zero is every run.
+	Times int
+}
+
+// DefaultSettle is the Settle of the scheduler returned by
+// NewDeterministicScheduler.
+const DefaultSettle = 20 * time.Millisecond
+
+type deterministicJob struct {
+	gen    Generatable
+	seq    uint64
+	finish func(error)
+}
+
+func NewDeterministicScheduler(seed int64) *DeterministicScheduler {
+	return &DeterministicScheduler{
+		Seed:   seed,
+		Settle: DefaultSettle,
+	}
+}
+
+// Launch starts running jobs. Calling Launch again has no effect. AddChannel
+// and Quit call Launch, so it need not be called first.
+func (d *DeterministicScheduler) Launch() {
+	d.launch.Do(func() {
+		d.quit = make(chan struct{})
+		d.jobs = make(chan *deterministicJob)
+		d.runs = make(map[string]int)
+		go d.run()
+	})
+}
+
+// Quit stops the scheduler once the running job finishes. Waiting jobs fail
+// with ErrSchedulerStopped. Calling Quit again has no effect.
+func (d *DeterministicScheduler) Quit() {
+	d.Launch()
+	d.quitOnce.Do(func() {
+		close(d.quit)
+	})
+}
+
+// AddChannel receives Generatables on the input channel and sends each one
+// back on the output channel once it has run. The output channel is closed
+// after the input channel is closed and every job has been sent back.
+func (d *DeterministicScheduler) AddChannel(io GeneratableIO) {
+	d.Launch()
+	go func() {
+		wg := &sync.WaitGroup{}
+		for gen := range io.In {
+			wg.Add(1)
+			gen := gen
+			job := &deterministicJob{
+				gen: gen,
+				seq: nextJobSeq(),
+				finish: func(err error) {
+					io.Out <- GenerateFinished{gen, err}
+					wg.Done()
+				},
+			}
+			select {
+			case d.jobs <- job:
+			case <-d.quit:
+				emitJob(gen, Event{Kind: EventJobFinished, ID: gen.ID(), Seq: job.seq, Status: statusOf(ErrSchedulerStopped), Error: ErrSchedulerStopped.Error()})
+				go job.finish(ErrSchedulerStopped)
+			}
+		}
+		wg.Wait()
+		close(io.Out)
+	}()
+}
+
+// Order returns the IDs of the jobs in the order they were run.
+func (d *DeterministicScheduler) Order() []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return append([]string(nil), d.order...)
+}
+
+func (d *DeterministicScheduler) run() {
+	rnd := rand.New(rand.NewSource(d.Seed))
+	var waiting []*deterministicJob
+	receive := func(job *deterministicJob) {
+		emitJob(job.gen, Event{Kind: EventJobQueued, ID: job.gen.ID(), Seq: job.seq, Cores: job.gen.NumCores()})
+		waiting = append(waiting, job)
+	}
+	for {
+		if len(waiting) == 0 {
+			select {
+			case job := <-d.jobs:
+				receive(job)
+			case <-d.quit:
+				return
+			}
+			continue
+		}
+		select {
+		case job := <-d.jobs:
+			receive(job)
+			continue
+		case <-time.After(d.Settle):
+		case <-d.quit:
+			for _, job := range waiting {
+				emitJob(job.gen, Event{Kind: EventJobFinished, ID: job.gen.ID(), Seq: job.seq, Status: statusOf(ErrSchedulerStopped), Error: ErrSchedulerStopped.Error()})
+				go job.finish(ErrSchedulerStopped)
+			}
+			return
+		}
+
+		// Sort by ID so the choice does not depend on the order the jobs
+		// arrived in.
+		sort.Stable(byJobID(waiting))
+		i := rnd.Intn(len(waiting))
+		job := waiting[i]
+		waiting = append(waiting[:i], waiting[i+1:]...)
+
+		id := job.gen.ID()
+		emitJob(job.gen, Event{Kind: EventJobStarted, ID: id, Seq: job.seq, Cores: job.gen.NumCores()})
+		err := d.runJob(job.gen)
+		emitJob(job.gen, Event{Kind: EventJobFinished, ID: id, Seq: job.seq, Status: statusOf(err), Error: errString(err)})
+		go job.finish(err)
+	}
+}
+
+// runJob runs the job with any fault for it, turning a panic into an error.
+func (d *DeterministicScheduler) runJob(gen Generatable) (err error) {
+	id := gen.ID()
+	d.mux.Lock()
+	d.order = append(d.order, id)
+	d.runs[id]++
+	fault, ok := d.Faults[id]
+	if ok && fault.Times != 0 && d.runs[id] > fault.Times {
+		ok = false
+	}
+	d.mux.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	if ok {
+		time.Sleep(fault.Delay)
+		if fault.Panic != nil {
+			panic(fault.Panic)
+		}
+		if fault.Err != nil {
+			return fault.Err
+		}
+	}
+	return gen.Run()
+}
+
+type byJobID []*deterministicJob
+
+func (b byJobID) Len() int           { return len(b) }
+func (b byJobID) Less(i, j int) bool { return b[i].gen.ID() < b[j].gen.ID() }
+func (b byJobID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
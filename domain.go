@@ -0,0 +1,365 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"errors"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gonum/matrix/mat64"
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/stat"
+	"github.com/reggo/reggo/common"
+)
+
+// ExtrapolationFilename is the name of the file in the postprocessing
+// directory of a testing dataset which stores its ExtrapolationReport.
+const ExtrapolationFilename = "extrapolation.json"
+
+// DomainQuantile is the quantile of the Mahalanobis distances of the training
+// inputs used as the Threshold of an InputDomain.
+var DomainQuantile = 0.99
+
+// domainRidge is added to the variances, relative to the largest, so that the
+// covariance can be factored when a feature is constant or the features are
+// linearly dependent.
+const domainRidge = 1e-10
+
+// InputDomain describes the inputs the algorithm was trained on. A point is
+// extrapolated if it is outside the bounds of the training inputs, or if its
+// Mahalanobis distance from the training inputs is more than Threshold.
+type InputDomain struct {
+	Features  []string
+	Min       []float64
+	Max       []float64
+	Mean      []float64
+	Chol      [][]float64 // Lower Cholesky factor of the covariance
+	Threshold float64
+}
+
+// NewInputDomain returns the domain of the training inputs.
+func NewInputDomain(features []string, inputs common.RowMatrix) (*InputDomain, error) {
+	nSamples, dim := inputs.Dims()
+	if nSamples == 0 {
+		return nil, errors.New("no training inputs")
+	}
+	if dim != len(features) {
+		return nil, errors.New("number of features does not match the inputs")
+	}
+	d := &InputDomain{
+		Features: features,
+		Min:      make([]float64, dim),
+		Max:      make([]float64, dim),
+		Mean:     make([]float64, dim),
+	}
+	for j := 0; j < dim; j++ {
+		d.Min[j] = math.Inf(1)
+		d.Max[j] = math.Inf(-1)
+	}
+	for i := 0; i < nSamples; i++ {
+		for j := 0; j < dim; j++ {
+			v := inputs.At(i, j)
+			d.Min[j] = math.Min(d.Min[j], v)
+			d.Max[j] = math.Max(d.Max[j], v)
+			d.Mean[j] += v
+		}
+	}
+	for j := range d.Mean {
+		d.Mean[j] /= float64(nSamples)
+	}
+
+	cov := mat64.NewDense(dim, dim, nil)
+	diff := make([]float64, dim)
+	for i := 0; i < nSamples; i++ {
+		for j := range diff {
+			diff[j] = inputs.At(i, j) - d.Mean[j]
+		}
+		for j := 0; j < dim; j++ {
+			row := cov.RawRowView(j)
+			for k := range row {
+				row[k] += diff[j] * diff[k]
+			}
+		}
+	}
+	var maxVar float64
+	for j := 0; j < dim; j++ {
+		row := cov.RawRowView(j)
+		for k := range row {
+			row[k] /= math.Max(float64(nSamples-1), 1)
+		}
+		maxVar = math.Max(maxVar, row[j])
+	}
+	ridge := domainRidge * maxVar
+	if ridge == 0 {
+		ridge = domainRidge
+	}
+	for j := 0; j < dim; j++ {
+		cov.Set(j, j, cov.At(j, j)+ridge)
+	}
+	chol := mat64.Cholesky(cov)
+	if !chol.SPD {
+		return nil, errors.New("covariance of the inputs is not positive definite")
+	}
+	d.Chol = make([][]float64, dim)
+	for j := range d.Chol {
+		d.Chol[j] = append([]float64(nil), chol.L.RawRowView(j)[:j+1]...)
+	}
+
+	dists := make([]float64, nSamples)
+	input := make([]float64, dim)
+	for i := range dists {
+		for j := range input {
+			input[j] = inputs.At(i, j)
+		}
+		dists[i] = d.Distance(input)
+	}
+	sort.Float64s(dists)
+	d.Threshold = stat.Quantile(DomainQuantile, stat.Empirical, dists, nil)
+	return d, nil
+}
+
+// Distance returns the Mahalanobis distance of the input from the training
+// inputs.
+func (d *InputDomain) Distance(input []float64) float64 {
+	// Solve L y = input - mean, so |y| is the distance.
+	y := make([]float64, len(input))
+	var dist float64
+	for i := range y {
+		sum := input[i] - d.Mean[i]
+		for k := 0; k < i; k++ {
+			sum -= d.Chol[i][k] * y[k]
+		}
+		y[i] = sum / d.Chol[i][i]
+		dist += y[i] * y[i]
+	}
+	return math.Sqrt(dist)
+}
+
+// OutOfBounds returns whether any feature of the input is outside the range
+// of the training inputs.
+func (d *InputDomain) OutOfBounds(input []float64) bool {
+	for j, v := range input {
+		if v < d.Min[j] || v > d.Max[j] {
+			return true
+		}
+	}
+	return false
+}
+
+// Extrapolated returns whether the input is outside the training domain.
+func (d *InputDomain) Extrapolated(input []float64) bool {
+	return d.OutOfBounds(input) || d.Distance(input) > d.Threshold
+}
+
+// Save writes the domain as JSON.
+func (d *InputDomain) Save(filename string) error {
+	b, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// saveInputDomain saves the InputDomain of the training inputs to the file.
+func saveInputDomain(features []string, inputs common.RowMatrix, filename string) error {
+	d, err := NewInputDomain(features, inputs)
+	if err != nil {
+		return err
+	}
+	return d.Save(filename)
+}
+
+// DomainFilename returns the file storing the InputDomain of the algorithm
+// trained in savepath.
+func DomainFilename(savepath string) string {
+	return filepath.Join(PredictorDirectory(savepath), "input_domain.json")
+}
+
+// LoadInputDomain reads the InputDomain of the algorithm trained in savepath.
+func LoadInputDomain(savepath string) (*InputDomain, error) {
+	b, err := ioutil.ReadFile(DomainFilename(savepath))
+	if err != nil {
+		return nil, err
+	}
+	d := &InputDomain{}
+	err = json.Unmarshal(b, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ExtrapolationReport counts the points of a testing dataset outside the
+// training domain and compares the errors inside and outside of it.
+type ExtrapolationReport struct {
+	Dataset      string
+	N            int
+	Extrapolated int
+	OutOfBounds  int // Extrapolated points outside the bounds of the training inputs
+	Outputs      []string
+	In           ErrorSummary // Points inside the training domain
+	Out          ErrorSummary // Extrapolated points
+}
+
+// ErrorSummary is the error of the predictions of each output over a set of
+// points. The slices are nil if there are no points.
+type ErrorSummary struct {
+	N       int
+	RMSE    []float64
+	MeanAbs []float64
+}
+
+// add adds the error of a point to the sums.
+func (e *ErrorSummary) add(pred, truth []float64) {
+	if e.RMSE == nil {
+		e.RMSE = make([]float64, len(pred))
+		e.MeanAbs = make([]float64, len(pred))
+	}
+	e.N++
+	for j := range pred {
+		diff := pred[j] - truth[j]
+		e.RMSE[j] += diff * diff
+		e.MeanAbs[j] += math.Abs(diff)
+	}
+}
+
+// finish turns the sums into the means.
+func (e *ErrorSummary) finish() {
+	for j := range e.RMSE {
+		e.RMSE[j] = math.Sqrt(e.RMSE[j] / float64(e.N))
+		e.MeanAbs[j] /= float64(e.N)
+	}
+}
+
+// extrapolationReport classifies the inputs with the domain and sums the
+// errors of the predictions. It also returns which points are extrapolated.
+func extrapolationReport(id string, inputData, outputData, pred common.RowMatrix, domain *InputDomain, outputNames []string) (ExtrapolationReport, []bool) {
+	nSamples, inputDim := inputData.Dims()
+	r := ExtrapolationReport{
+		Dataset: id,
+		N:       nSamples,
+		Outputs: outputNames,
+	}
+	extrapolated := make([]bool, nSamples)
+	input := make([]float64, inputDim)
+	predRow := make([]float64, len(outputNames))
+	truth := make([]float64, len(outputNames))
+	for i := 0; i < nSamples; i++ {
+		inputData.Row(input, i)
+		pred.Row(predRow, i)
+		outputData.Row(truth, i)
+		if !domain.Extrapolated(input) {
+			r.In.add(predRow, truth)
+			continue
+		}
+		extrapolated[i] = true
+		r.Extrapolated++
+		if domain.OutOfBounds(input) {
+			r.OutOfBounds++
+		}
+		r.Out.add(predRow, truth)
+	}
+	r.In.finish()
+	r.Out.finish()
+	return r, extrapolated
+}
+
+// makeExtrapolationReport saves the ExtrapolationReport of the data in path
+// and plots the predictions with the extrapolated points marked, unless the
+// report already exists.
+func makeExtrapolationReport(id string, inputData, outputData common.RowMatrix, sp ScalePredictor, domain *InputDomain, outputNames []string, path string) error {
+	filename := filepath.Join(path, ExtrapolationFilename)
+	_, err := os.Stat(filename)
+	if err == nil {
+		Debugf("extrapolation report in %v already generated", path)
+		return nil
+	}
+
+	pred, err := predictAll(inputData, sp, len(outputNames))
+	if err != nil {
+		return err
+	}
+	report, extrapolated := extrapolationReport(id, inputData, outputData, pred, domain, outputNames)
+	Infof("%v: %v of %v points extrapolated, %v outside the training bounds", id, report.Extrapolated, report.N, report.OutOfBounds)
+
+	pltMul := vg.Length(4.0)
+	for j, name := range outputNames {
+		var in, out plotter.XYs
+		for i, e := range extrapolated {
+			pt := struct{ X, Y float64 }{outputData.At(i, j), pred.At(i, j)}
+			if e {
+				out = append(out, pt)
+			} else {
+				in = append(in, pt)
+			}
+		}
+		plt, err := plot.New()
+		if err != nil {
+			return err
+		}
+		plt.Add(plotter.NewFunction(func(x float64) float64 { return x }))
+		for _, pts := range []struct {
+			xys   plotter.XYs
+			label string
+			color color.Color
+		}{
+			{in, "in distribution", color.Black},
+			{out, "extrapolated", color.RGBA{R: 255, A: 255}},
+		} {
+			if len(pts.xys) == 0 {
+				continue
+			}
+			scatter, err := plotter.NewScatter(pts.xys)
+			if err != nil {
+				return err
+			}
+			scatter.GlyphStyle.Color = pts.color
+			plt.Add(scatter)
+			plt.Legend.Add(pts.label, scatter)
+		}
+		plt.X.Label.Text = "True value of " + name
+		plt.Y.Label.Text = "Predicted value of " + name
+		plt.Title.Text = "Extrapolated predictions of " + name
+
+		err = os.MkdirAll(filepath.Join(path, name), 0700)
+		if err != nil {
+			return err
+		}
+		file := pltName(path, name, "extrap_pred_vs_truth.jpg")
+		err = plt.Save(4*vg.Inch*pltMul, 4*vg.Inch*pltMul, file)
+		if err != nil {
+			return err
+		}
+		plotSaved(file)
+	}
+
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// predictAll returns the predictions of the algorithm at each row of the
+// inputs.
+func predictAll(inputData common.RowMatrix, sp ScalePredictor, nOutputs int) (*mat64.Dense, error) {
+	nSamples, inputDim := inputData.Dims()
+	pred := mat64.NewDense(nSamples, nOutputs, nil)
+	input := make([]float64, inputDim)
+	for i := 0; i < nSamples; i++ {
+		output := pred.RawRowView(i)
+		inputData.Row(input, i)
+
+		_, err := sp.Predict(input, output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pred, nil
+}
@@ -1,6 +1,59 @@
 package ransuq
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrSkipped is the error recorded for a job which was never started because
+// the run was cancelled.
+var ErrSkipped = errors.New("skipped: run cancelled")
+
+// ErrSchedulerStopped is the error of a job which was still queued when its
+// scheduler was stopped.
+var ErrSchedulerStopped = errors.New("scheduler stopped before the job started")
+
+// TimeoutError is the error of a job which ran for longer than its timeout.
+type TimeoutError struct {
+	ID      string
+	Timeout time.Duration
+}
+
+func (t TimeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v", t.ID, t.Timeout)
+}
+
+// isCancelled returns true if the error is from a job which was skipped or
+// stopped because of cancellation.
+func isCancelled(err error) bool {
+	return err == ErrSkipped || err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// SkippedError is the error for a settings case that did not run to completion
+// because the run was cancelled. Skipped holds the IDs of the jobs that were
+// not run. Everything else finished, so running the case again picks up where
+// it left off.
+type SkippedError struct {
+	Skipped []string
+}
+
+func (s SkippedError) Error() string {
+	return "run cancelled, skipped: " + strings.Join(s.Skipped, ", ")
+}
+
+// MissingError is the error of a phase which was not selected to run and has
+// no existing result to reuse.
+type MissingError struct {
+	Phase Phase
+	ID    string
+}
+
+func (m MissingError) Error() string {
+	return fmt.Sprintf("%v not selected to run and no existing result for %v", m.Phase, m.ID)
+}
 
 type ErrorList []error
 
@@ -29,6 +82,7 @@ func (e ErrorList) AllNil() bool {
 type PostprocessError struct {
 	Testing  ErrorList
 	Training ErrorList
+	Stats    error // Error making the StatsReport
 }
 
 func (p PostprocessError) Error() string {
@@ -42,5 +96,8 @@ func (p PostprocessError) Error() string {
 	if p.Testing != nil {
 		str += "testing: " + p.Testing.Error()
 	}
+	if p.Stats != nil {
+		str += "stats: " + p.Stats.Error()
+	}
 	return str
 }
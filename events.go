@@ -0,0 +1,203 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is the type of an Event.
+type EventKind string
+
+const (
+	EventJobQueued         EventKind = "job-queued"         // A Generatable was received by the scheduler
+	EventJobStarted        EventKind = "job-started"        // The scheduler started running a Generatable
+	EventJobFinished       EventKind = "job-finished"       // A Generatable or a job in the graph finished
+	EventJobRetrying       EventKind = "job-retrying"       // A Generatable failed and will be run again after Wait
+	EventCoresFreed        EventKind = "cores-freed"        // The cores used by a Generatable are available again
+	EventTrainingIteration EventKind = "training-iteration" // The trainer evaluated the objective
+	EventPlotSaved         EventKind = "plot-saved"         // A plot was written to File
+	EventInfo              EventKind = "info"               // A message worth showing to the user
+	EventDebug             EventKind = "debug"              // A message about the details of a run
+)
+
+// Event is a record of progress in a run. Only the fields relevant to the
+// kind of event are set.
+type Event struct {
+	Time            time.Time
+	Kind            EventKind
+	Phase           Phase         `json:",omitempty"` // Set for jobs in the graph
+	ID              string        `json:",omitempty"`
+	Seq             uint64        `json:",omitempty"` // Identifies the run of a job in the events of the schedulers
+	Status          Status        `json:",omitempty"`
+	Error           string        `json:",omitempty"`
+	Cores           int           `json:",omitempty"`
+	AvailableCores  int           `json:",omitempty"`
+	Memory          int64         `json:",omitempty"` // Bytes
+	AvailableMemory int64         `json:",omitempty"`
+	Worker          string        `json:",omitempty"` // Set for jobs run on another machine
+	Attempt         int           `json:",omitempty"`
+	Wait            time.Duration `json:",omitempty"`
+	Iteration       int           `json:",omitempty"`
+	Objective       float64       `json:",omitempty"`
+	File            string        `json:",omitempty"`
+	Message         string        `json:",omitempty"`
+}
+
+func (e Event) String() string {
+	var s string
+	switch e.Kind {
+	case EventJobQueued:
+		s = fmt.Sprintf("queued %v (%v cores)", e.ID, e.Cores)
+	case EventJobStarted:
+		if e.Worker != "" {
+			s = fmt.Sprintf("started %v on %v (%v cores)", e.ID, e.Worker, e.Cores)
+			break
+		}
+		s = fmt.Sprintf("started %v (%v cores, %v available)", e.ID, e.Cores, e.AvailableCores)
+	case EventJobFinished:
+		s = "finished "
+		if e.Phase != "" {
+			s += string(e.Phase) + " "
+		}
+		s += fmt.Sprintf("%v: %v", e.ID, e.Status)
+		if e.Worker != "" {
+			s += " on " + e.Worker
+		}
+		if e.Error != "" {
+			s += ": " + e.Error
+		}
+	case EventJobRetrying:
+		s = fmt.Sprintf("attempt %v of %v failed: %v. Retrying in %v", e.Attempt, e.ID, e.Error, e.Wait)
+	case EventCoresFreed:
+		s = fmt.Sprintf("%v freed %v cores (%v available)", e.ID, e.Cores, e.AvailableCores)
+	case EventTrainingIteration:
+		s = fmt.Sprintf("training %v: evaluation %v objective %v", e.ID, e.Iteration, e.Objective)
+	case EventPlotSaved:
+		s = "saved plot " + e.File
+	default:
+		s = e.Message
+	}
+	return e.Time.Format("15:04:05") + " " + s
+}
+
+// An EventSink receives the events of a run. Event is never called
+// concurrently.
+type EventSink interface {
+	Event(Event)
+}
+
+// QuietSink writes the start and end of jobs, failures and messages to the
+// writer.
+type QuietSink struct {
+	W io.Writer
+}
+
+func (q QuietSink) Event(e Event) {
+	switch e.Kind {
+	case EventJobStarted, EventJobRetrying, EventInfo:
+	case EventJobFinished:
+		// The scheduler's report of the end of a Generatable is only shown
+		// on failure, since the job in the graph reports it as well.
+		if e.Phase == "" && e.Status != StatusFailed {
+			return
+		}
+	default:
+		return
+	}
+	fmt.Fprintln(q.W, e)
+}
+
+// VerboseSink writes every event to the writer.
+type VerboseSink struct {
+	W io.Writer
+}
+
+func (v VerboseSink) Event(e Event) {
+	fmt.Fprintln(v.W, e)
+}
+
+// JSONSink writes each event to the writer as a line of JSON.
+type JSONSink struct {
+	enc *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+func (j *JSONSink) Event(e Event) {
+	j.enc.Encode(e)
+}
+
+// MultiSink sends each event to all of the sinks.
+type MultiSink []EventSink
+
+func (m MultiSink) Event(e Event) {
+	for _, s := range m {
+		s.Event(e)
+	}
+}
+
+var (
+	sinkMux sync.Mutex
+	sink    EventSink = QuietSink{W: os.Stdout}
+)
+
+// SetEventSink sets where the events of the package are sent. The default
+// is a QuietSink writing to standard output. A nil sink discards events.
+func SetEventSink(s EventSink) {
+	sinkMux.Lock()
+	sink = s
+	sinkMux.Unlock()
+}
+
+// Emit records the event in DefaultMetrics and sends it to the event sink,
+// setting the time if it is zero.
+func Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	DefaultMetrics.Event(e)
+	sinkMux.Lock()
+	defer sinkMux.Unlock()
+	if sink != nil {
+		sink.Event(e)
+	}
+}
+
+// jobSeq is the Seq of the last job received by a scheduler.
+var jobSeq uint64
+
+// nextJobSeq returns the Seq of a job received by a scheduler. IDs are not
+// unique, since the same dataset is sent by several cases and failed jobs are
+// sent again, so the scheduler events of a job are matched by Seq.
+func nextJobSeq() uint64 {
+	return atomic.AddUint64(&jobSeq, 1)
+}
+
+// emitJob emits an event from a scheduler about the job. If the job was sent
+// by a Graph with Metrics, the event is recorded there as well.
+func emitJob(gen Generatable, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if t, ok := gen.(*trackedGeneratable); ok && t.metrics != nil {
+		t.metrics.Event(e)
+	}
+	Emit(e)
+}
+
+// Infof emits a message which should be shown to the user.
+func Infof(format string, args ...interface{}) {
+	Emit(Event{Kind: EventInfo, Message: fmt.Sprintf(format, args...)})
+}
+
+// Debugf emits a message about the details of a run.
+func Debugf(format string, args ...interface{}) {
+	Emit(Event{Kind: EventDebug, Message: fmt.Sprintf(format, args...)})
+}
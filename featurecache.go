@@ -0,0 +1,285 @@
+package ransuq
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/gonum/matrix/mat64"
+	"github.com/reggo/reggo/common"
+)
+
+// FeatureCache stores the feature matrices loaded from datasets so that the
+// text files they are parsed from are only read once. A matrix is keyed by
+// the ID and load spec of the dataset, the hashes of its source files and the
+// list of features, so it is loaded again when any of them change. Only
+// datasets which are SourceFilers are cached, and not those whose LoadSpec is
+// empty.
+//
+// Each matrix is stored in its own file in Dir, one column after another.
+type FeatureCache struct {
+	Dir string
+}
+
+// DefaultFeatureCache is used when loading the data of datasets. It is nil by
+// default, which disables caching.
+var DefaultFeatureCache *FeatureCache
+
+// featureCacheMagic starts every cache file, followed by the version.
+const (
+	featureCacheMagic   = "RQFC"
+	featureCacheVersion = 1
+)
+
+// featureCacheKey is hashed to name the cache file of a matrix.
+type featureCacheKey struct {
+	Dataset  DatasetFingerprint
+	Features []string
+}
+
+// Load returns the features of the dataset from the cache, or loads the
+// dataset and stores the result. A nil cache always loads the dataset.
+func (c *FeatureCache) Load(dataset Dataset, features []string) (common.RowMatrix, error) {
+	if c == nil {
+		return dataset.Load(features)
+	}
+	if _, ok := dataset.(SourceFiler); !ok {
+		return dataset.Load(features)
+	}
+	filename, ok := c.filename(dataset, features)
+	if !ok {
+		return dataset.Load(features)
+	}
+	data, err := readFeatureCache(filename, features)
+	if err == nil {
+		Debugf("%v: loaded features %v from cache", dataset.ID(), features)
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		Debugf("%v: ignoring feature cache %v: %v", dataset.ID(), filename, err)
+	}
+
+	m, err := dataset.Load(features)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFeatureCache(filename, features, m)
+	if err != nil {
+		// The data are still good even if they could not be cached.
+		Infof("%v: error writing feature cache: %v", dataset.ID(), err)
+	}
+	return m, nil
+}
+
+// rows returns the number of rows of the features of the dataset stored in
+// the cache, reading only the header of the cache file. It returns false if
+// they are not in the cache.
+func (c *FeatureCache) rows(dataset Dataset, features []string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	if _, ok := dataset.(SourceFiler); !ok {
+		return 0, false
+	}
+	filename, ok := c.filename(dataset, features)
+	if !ok {
+		return 0, false
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	header, err := readFeatureCacheHeader(bufio.NewReader(f), features)
+	if err != nil {
+		return 0, false
+	}
+	return int(header.Rows), true
+}
+
+// filename returns the cache file for the features of the dataset. It returns
+// false if a source file cannot be read or the load spec is unknown, so the
+// dataset is not cached.
+func (c *FeatureCache) filename(dataset Dataset, features []string) (string, bool) {
+	fingerprint := datasetFingerprint(dataset)
+	if _, ok := dataset.(LoadSpecer); ok && fingerprint.Spec == "" {
+		return "", false
+	}
+	for _, hash := range fingerprint.Files {
+		if hash == "missing" || hash == "unreadable" {
+			return "", false
+		}
+	}
+	b, err := json.Marshal(featureCacheKey{
+		Dataset:  fingerprint,
+		Features: features,
+	})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(b)
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".features"), true
+}
+
+// featureCacheHeader is the start of a cache file after the magic.
+type featureCacheHeader struct {
+	Version uint32
+	Rows    uint64
+	Cols    uint64
+}
+
+// writeFeatureCache writes the matrix with its feature names. The file is
+// written under another name first so a partial file is never read.
+func writeFeatureCache(filename string, features []string, m common.RowMatrix) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = encodeFeatureCache(w, features, m)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func encodeFeatureCache(w io.Writer, features []string, m common.RowMatrix) error {
+	r, c := m.Dims()
+	_, err := io.WriteString(w, featureCacheMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, featureCacheHeader{
+		Version: featureCacheVersion,
+		Rows:    uint64(r),
+		Cols:    uint64(c),
+	})
+	if err != nil {
+		return err
+	}
+	for _, feature := range features {
+		err = binary.Write(w, binary.LittleEndian, uint32(len(feature)))
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, feature)
+		if err != nil {
+			return err
+		}
+	}
+	var buf [8]byte
+	for j := 0; j < c; j++ {
+		for i := 0; i < r; i++ {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(m.At(i, j)))
+			_, err = w.Write(buf[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readFeatureCache reads a matrix written by writeFeatureCache, checking that
+// it has the features.
+func readFeatureCache(filename string, features []string) (*mat64.Dense, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := readFeatureCacheHeader(r, features)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if header.Rows*header.Cols > uint64(info.Size())/8 {
+		return nil, errors.New("feature cache file is truncated")
+	}
+	rows, cols := int(header.Rows), int(header.Cols)
+	data := make([]float64, rows*cols)
+	var buf [8]byte
+	for j := 0; j < cols; j++ {
+		for i := 0; i < rows; i++ {
+			_, err = io.ReadFull(r, buf[:])
+			if err != nil {
+				return nil, err
+			}
+			data[i*cols+j] = math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+		}
+	}
+	if cols == 0 {
+		return mat64.NewDense(rows, 0, nil), nil
+	}
+	return mat64.NewDense(rows, cols, data), nil
+}
+
+// readFeatureCacheHeader reads the magic, header and feature names at the
+// start of a cache file, checking that they match the features.
+func readFeatureCacheHeader(r io.Reader, features []string) (featureCacheHeader, error) {
+	var header featureCacheHeader
+	magic := make([]byte, len(featureCacheMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return header, err
+	}
+	if string(magic) != featureCacheMagic {
+		return header, errors.New("not a feature cache file")
+	}
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return header, err
+	}
+	if header.Version != featureCacheVersion {
+		return header, errors.New("unknown feature cache version")
+	}
+	if header.Cols != uint64(len(features)) {
+		return header, errors.New("wrong number of features")
+	}
+	for _, feature := range features {
+		var n uint32
+		err = binary.Read(r, binary.LittleEndian, &n)
+		if err != nil {
+			return header, err
+		}
+		if n != uint32(len(feature)) {
+			return header, errors.New("features do not match")
+		}
+		name := make([]byte, n)
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return header, err
+		}
+		if string(name) != feature {
+			return header, errors.New("features do not match")
+		}
+	}
+	return header, nil
+}
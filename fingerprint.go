@@ -0,0 +1,320 @@
+package ransuq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// FingerprintFilename is the name of the file which stores the fingerprint of
+// a trained algorithm or a set of plots in its directory.
+const FingerprintFilename = "fingerprint.json"
+
+// A SourceFiler is a Dataset which can list the files its data are loaded
+// from. The contents of the files are part of the fingerprint, so training is
+// redone when the data change.
+type SourceFiler interface {
+	SourceFiles() []string
+}
+
+// A LoadSpecer is a Dataset whose loaded data depend on settings other than
+// its ID and source files, such as the rule for ignoring data points.
+// LoadSpec should change whenever those settings change. It returns the empty
+// string if the settings cannot be identified, such as a function with no
+// description, and the data are then not stored in a FeatureCache.
+type LoadSpecer interface {
+	LoadSpec() string
+}
+
+// DatasetFingerprint identifies the data loaded from a dataset.
+type DatasetFingerprint struct {
+	ID    string
+	Spec  string            `json:",omitempty"`
+	Files map[string]string `json:",omitempty"` // SHA-256 of each source file
+}
+
+// Fingerprint identifies the inputs used to make a result. The fingerprint of
+// a trained algorithm covers the features, the training data, the weights and
+// the trainer. The fingerprint of plots or a comparison covers the trained
+// algorithm and the data being compared.
+type Fingerprint struct {
+	Training       string               `json:",omitempty"` // Hash of the trained algorithm file
+	InputFeatures  []string             `json:",omitempty"`
+	OutputFeatures []string             `json:",omitempty"`
+	WeightFeatures []string             `json:",omitempty"`
+	Weight         string               `json:",omitempty"` // WeightSpec of the weight function
+	Trainer        []string             `json:",omitempty"`
+	Datasets       []DatasetFingerprint `json:",omitempty"`
+	NonFinite      NonFinitePolicy      `json:",omitempty"` // Policy for non-finite values in the data
+}
+
+// TrainingFingerprint returns the fingerprint of training with the settings.
+// Functions cannot be compared, so the weight function is identified by the
+// WeightSpec of the settings, and only the type and size of the algorithm are
+// included rather than its initial parameters.
+func TrainingFingerprint(set *Settings) *Fingerprint {
+	f := &Fingerprint{
+		InputFeatures:  set.InputFeatures,
+		OutputFeatures: set.OutputFeatures,
+		WeightFeatures: set.WeightFeatures,
+		Trainer:        trainerSpec(set.Trainer),
+		NonFinite:      set.NonFinite,
+	}
+	if set.WeightFunc != nil {
+		f.Weight = set.WeightSpec
+	}
+	for _, dataset := range set.TrainingData {
+		f.Datasets = append(f.Datasets, datasetFingerprint(dataset))
+	}
+	return f
+}
+
+// comparisonFingerprint returns the fingerprint of the output of the trained
+// algorithm of the settings on the datasets.
+func comparisonFingerprint(set *Settings, datasets ...Dataset) *Fingerprint {
+	f := &Fingerprint{
+		Training:  hashFile(PredictorFilename(set.Savepath)),
+		NonFinite: set.NonFinite,
+	}
+	for _, dataset := range datasets {
+		f.Datasets = append(f.Datasets, datasetFingerprint(dataset))
+	}
+	return f
+}
+
+// statsFingerprint returns the fingerprint of the StatsReport of the
+// settings.
+func statsFingerprint(set *Settings) *Fingerprint {
+	f := &Fingerprint{
+		InputFeatures:  set.InputFeatures,
+		OutputFeatures: set.OutputFeatures,
+		NonFinite:      set.NonFinite,
+	}
+	for _, dataset := range set.TrainingData {
+		f.Datasets = append(f.Datasets, datasetFingerprint(dataset))
+	}
+	for _, dataset := range set.TestingData {
+		f.Datasets = append(f.Datasets, datasetFingerprint(dataset))
+	}
+	return f
+}
+
+// Diff returns the first difference between the fingerprints, or the empty
+// string if they are the same.
+func (f *Fingerprint) Diff(old *Fingerprint) string {
+	switch {
+	case f.Training != old.Training:
+		return "trained algorithm changed"
+	case !reflect.DeepEqual(f.InputFeatures, old.InputFeatures):
+		return fmt.Sprintf("input features changed from %v to %v", old.InputFeatures, f.InputFeatures)
+	case !reflect.DeepEqual(f.OutputFeatures, old.OutputFeatures):
+		return fmt.Sprintf("output features changed from %v to %v", old.OutputFeatures, f.OutputFeatures)
+	case !reflect.DeepEqual(f.WeightFeatures, old.WeightFeatures):
+		return fmt.Sprintf("weight features changed from %v to %v", old.WeightFeatures, f.WeightFeatures)
+	case f.Weight != old.Weight:
+		return fmt.Sprintf("weight function changed from %q to %q", old.Weight, f.Weight)
+	case !reflect.DeepEqual(f.Trainer, old.Trainer):
+		return fmt.Sprintf("trainer changed from %v to %v", old.Trainer, f.Trainer)
+	case f.NonFinite != old.NonFinite:
+		return fmt.Sprintf("non-finite policy changed from %v to %v", old.NonFinite, f.NonFinite)
+	case len(f.Datasets) != len(old.Datasets):
+		return fmt.Sprintf("number of datasets changed from %v to %v", len(old.Datasets), len(f.Datasets))
+	}
+	for i, d := range f.Datasets {
+		o := old.Datasets[i]
+		switch {
+		case d.ID != o.ID:
+			return fmt.Sprintf("dataset %v changed from %v to %v", i, o.ID, d.ID)
+		case d.Spec != o.Spec:
+			return fmt.Sprintf("dataset %v load spec changed from %q to %q", d.ID, o.Spec, d.Spec)
+		}
+		for file, hash := range d.Files {
+			if o.Files[file] != hash {
+				return fmt.Sprintf("dataset %v source file %v changed", d.ID, file)
+			}
+		}
+		for file := range o.Files {
+			if _, ok := d.Files[file]; !ok {
+				return fmt.Sprintf("dataset %v no longer uses source file %v", d.ID, file)
+			}
+		}
+	}
+	return ""
+}
+
+// Save writes the fingerprint to FingerprintFilename in the directory.
+func (f *Fingerprint) Save(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, FingerprintFilename))
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadFingerprint reads the fingerprint saved in the directory.
+func LoadFingerprint(dir string) (*Fingerprint, error) {
+	file, err := os.Open(filepath.Join(dir, FingerprintFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f := &Fingerprint{}
+	err = json.NewDecoder(file).Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// noFingerprint is the reason given by Stale for a result with no
+// fingerprint.
+const noFingerprint = "no fingerprint recorded"
+
+// Stale returns why the result saved in dir does not match the fingerprint,
+// or the empty string if it matches.
+func (f *Fingerprint) Stale(dir string) string {
+	old, err := LoadFingerprint(dir)
+	if os.IsNotExist(err) {
+		return noFingerprint
+	}
+	if err != nil {
+		return "error reading fingerprint: " + err.Error()
+	}
+	return f.Diff(old)
+}
+
+// isCurrent returns whether the result in dir matches the fingerprint, and
+// logs the reason if it does not. A result with no fingerprint, such as one
+// made before fingerprints were recorded, cannot be checked and is out of
+// date.
+func isCurrent(dir string, f *Fingerprint) bool {
+	reason := f.Stale(dir)
+	if reason == "" {
+		return true
+	}
+	Infof("%v is out of date: %v", dir, reason)
+	return false
+}
+
+// removeStalePlots deletes the plots in dir if they were made with a different
+// fingerprint so that they are redrawn.
+func removeStalePlots(dir string, f *Fingerprint) error {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if isCurrent(dir, f) {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+func datasetFingerprint(dataset Dataset) DatasetFingerprint {
+	d := DatasetFingerprint{
+		ID: dataset.ID(),
+	}
+	if s, ok := dataset.(LoadSpecer); ok {
+		d.Spec = s.LoadSpec()
+	}
+	if s, ok := dataset.(SourceFiler); ok {
+		d.Files = make(map[string]string)
+		for _, file := range s.SourceFiles() {
+			d.Files[file] = hashFile(file)
+		}
+	}
+	return d
+}
+
+func trainerSpec(t *Trainer) []string {
+	if t == nil {
+		return nil
+	}
+	spec := []string{
+		fmt.Sprintf("%+v", t.TrainSettings),
+		fmt.Sprintf("input scaler %T", t.InputScaler),
+		fmt.Sprintf("output scaler %T", t.OutputScaler),
+		"losser " + valueSpec(t.Losser),
+		"regularizer " + valueSpec(t.Regularizer),
+	}
+	if a := t.Algorithm; a != nil {
+		spec = append(spec, fmt.Sprintf("algorithm %T inputs %v outputs %v features %v parameters %v",
+			a, a.InputDim(), a.OutputDim(), a.NumFeatures(), a.NumParameters()))
+	}
+	return spec
+}
+
+// valueSpec returns the type and the JSON value of v.
+func valueSpec(v interface{}) string {
+	s := fmt.Sprintf("%T", v)
+	b, err := json.Marshal(v)
+	if err == nil {
+		s += " " + string(b)
+	}
+	return s
+}
+
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	fileHashMux sync.Mutex
+	fileHashes  = make(map[string]fileHash)
+)
+
+// hashFile returns the SHA-256 of the file contents. Hashes are reused while
+// the size and modification time of the file are unchanged.
+func hashFile(name string) string {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "missing"
+	}
+	fileHashMux.Lock()
+	h, ok := fileHashes[name]
+	fileHashMux.Unlock()
+	if ok && h.size == info.Size() && h.modTime.Equal(info.ModTime()) {
+		return h.hash
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "unreadable"
+	}
+	defer f.Close()
+	sum := sha256.New()
+	_, err = io.Copy(sum, f)
+	if err != nil {
+		return "unreadable"
+	}
+	h = fileHash{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		hash:    hex.EncodeToString(sum.Sum(nil)),
+	}
+	fileHashMux.Lock()
+	fileHashes[name] = h
+	fileHashMux.Unlock()
+	return h.hash
+}
@@ -49,8 +49,18 @@ const (
 	// Loads the data into dense matrices. May be memory intensive, but should be
 	// faster on analysis methods
 	DenseLoad LoadStyle = iota
+
+	// Loads one dataset at a time and copies it into the result in chunks of
+	// rows, so only one dataset is held in memory besides the result; see
+	// StreamLoadAll. Each dataset is still loaded in full before it is
+	// copied. Slower than DenseLoad, since the datasets are not loaded
+	// concurrently.
+	StreamLoad
 )
 
+// DefaultChunkSize is the number of rows in each chunk read by StreamLoad.
+const DefaultChunkSize = 4096
+
 var UnknownLoadStyle = errors.New("unknown load style")
 
 type LoadError []error
@@ -59,14 +69,48 @@ func (l LoadError) Error() string {
 	var str string
 	for i := range l {
 		if l[i] != nil {
-			str += fmt.Sprintf("error loading ", i, ": ", l[i].Error())
+			str += fmt.Sprintf("error loading %v: %v", i, l[i])
 		}
 	}
 	return str
 }
 
+// A Loader loads datasets with a policy for non-finite values, and records
+// the report of every dataset whose rows were dropped or clamped. The
+// package-level load functions use a new Loader with DefaultNonFinitePolicy.
+// A Loader may be used concurrently.
+type Loader struct {
+	NonFinite NonFinitePolicy
+
+	mux     sync.Mutex
+	reports []NonFiniteReport
+}
+
+// Reports returns the reports of the datasets whose rows were dropped or
+// clamped by the Loader, in the order they were loaded.
+func (l *Loader) Reports() []NonFiniteReport {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return append([]NonFiniteReport(nil), l.reports...)
+}
+
+func defaultLoader() *Loader {
+	return &Loader{NonFinite: DefaultNonFinitePolicy}
+}
+
+// loader returns a Loader with the non-finite policy of the settings.
+func (set *Settings) loader() *Loader {
+	return &Loader{NonFinite: set.NonFinite}
+}
+
 // LoadData returns the data in the dataset.
 func LoadData(dataset Dataset, loadStyle LoadStyle, inputFeatures, outputFeatures, weightFeatures []string) (
+	inputs, outputs, weights common.RowMatrix, err error) {
+	return defaultLoader().LoadData(dataset, loadStyle, inputFeatures, outputFeatures, weightFeatures)
+}
+
+// LoadData returns the data in the dataset.
+func (l *Loader) LoadData(dataset Dataset, loadStyle LoadStyle, inputFeatures, outputFeatures, weightFeatures []string) (
 	inputs, outputs, weights common.RowMatrix, err error) {
 	// This currently uses Dense matrices, but in
 	// the future this could have options added to take better advantage of the Matrix
@@ -78,28 +122,20 @@ func LoadData(dataset Dataset, loadStyle LoadStyle, inputFeatures, outputFeature
 		return
 	case DenseLoad:
 		features, inputInds, outputInds, weightInds := uniqueFeatures(inputFeatures, outputFeatures, weightFeatures)
-		return loadDenseData(dataset, features, inputInds, outputInds, weightInds)
-
+		return l.loadDenseData(dataset, features, inputInds, outputInds, weightInds)
+	case StreamLoad:
+		return l.streamAssemble([]Dataset{dataset}, inputFeatures, outputFeatures, weightFeatures, DefaultChunkSize)
 	}
 }
 
-func loadDenseData(dataset Dataset, features []string, inputInds, outputInds, weightInds []int) (
+func (l *Loader) loadDenseData(dataset Dataset, features []string, inputInds, outputInds, weightInds []int) (
 	inputData, outputData, weightData common.RowMatrix, err error) {
 
-	data, err := dataset.Load(features)
+	data, err := l.loadFeatures(dataset, features)
 	if err != nil {
 		return
 	}
 
-	_, nDim := data.Dims()
-	if nDim != len(features) {
-		err = errors.New("unexpected number of columns")
-	}
-
-	if nDim != len(features) {
-		return
-	}
-
 	// Break out the data into dense forms
 	inputData = denseUnpack(data, inputInds)
 	outputData = denseUnpack(data, outputInds)
@@ -107,6 +143,29 @@ func loadDenseData(dataset Dataset, features []string, inputInds, outputInds, we
 	return inputData, outputData, weightData, nil
 }
 
+// loadFeatures loads the features of the dataset through DefaultFeatureCache,
+// checking the number of columns and applying the non-finite policy.
+func (l *Loader) loadFeatures(dataset Dataset, features []string) (common.RowMatrix, error) {
+	data, err := DefaultFeatureCache.Load(dataset, features)
+	if err != nil {
+		return nil, err
+	}
+	_, nDim := data.Dims()
+	if nDim != len(features) {
+		return nil, errors.New("unexpected number of columns")
+	}
+	data, report, err := checkFinite(dataset.ID(), features, data, l.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+	if report.Rows != 0 {
+		l.mux.Lock()
+		l.reports = append(l.reports, report)
+		l.mux.Unlock()
+	}
+	return data, nil
+}
+
 func denseUnpack(data common.RowMatrix, inds []int) common.RowMatrix {
 	nSamples, _ := data.Dims()
 	newdata := mat64.NewDense(nSamples, len(inds), nil)
@@ -118,26 +177,29 @@ func denseUnpack(data common.RowMatrix, inds []int) common.RowMatrix {
 	return newdata
 }
 
+// DenseLoadAll loads the datasets concurrently and combines them into one
+// matrix of inputs and one of outputs, evaluating the weight function on the
+// weight features of each row. The rows of each dataset are copied straight
+// into the combined matrices.
 func DenseLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
 	inputData, outputData common.RowMatrix, weights []float64, err error) {
-	// TODO: This is really memory intensive at the moment. Need to make this better
-	// (too much copying between dense matrices)
-	// Probably easiest done by not calling denseUnpack and instead coming from the
-	// feature matrix
+	return defaultLoader().DenseLoadAll(datasets, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+}
 
-	inputMats := make([]common.RowMatrix, len(datasets))
-	outputMats := make([]common.RowMatrix, len(datasets))
-	weightMats := make([]common.RowMatrix, len(datasets))
+// DenseLoadAll loads the datasets as in the package-level DenseLoadAll.
+func (l *Loader) DenseLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
+	inputData, outputData common.RowMatrix, weights []float64, err error) {
 
 	features, inputInds, outputInds, weightInds := uniqueFeatures(inputFeatures, outputFeatures, weightFeatures)
 
+	data := make([]common.RowMatrix, len(datasets))
 	errs := make([]error, len(datasets))
 	wg := &sync.WaitGroup{}
 	for i := range datasets {
 		wg.Add(1)
 		go func(i int) {
-			inputMats[i], outputMats[i], weightMats[i], errs[i] = loadDenseData(datasets[i], features, inputInds, outputInds, weightInds)
-			wg.Done()
+			defer wg.Done()
+			data[i], errs[i] = l.loadFeatures(datasets[i], features)
 		}(i)
 	}
 	wg.Wait()
@@ -147,12 +209,11 @@ func DenseLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatu
 		return nil, nil, nil, LoadError(errs)
 	}
 
-	// start ind
 	var totalNSamples int
 	startInds := make([]int, len(datasets))
 	for i := range datasets {
 		startInds[i] = totalNSamples
-		nSamples, _ := inputMats[i].Dims()
+		nSamples, _ := data[i].Dims()
 		totalNSamples += nSamples
 	}
 	inputs := mat64.NewDense(totalNSamples, len(inputFeatures), nil)
@@ -161,45 +222,290 @@ func DenseLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatu
 		weights = make([]float64, totalNSamples)
 	}
 
-	// For each dataset, copy the data into inputs and outputs, and evaluate the
-	// weight function
-
+	// Copy each dataset into its rows of the combined matrices and evaluate
+	// the weight function.
 	for i := range datasets {
 		wg.Add(1)
 		go func(i int) {
-			// Copy the data to the right place
-			mat := inputMats[i]
-			nSamples, nCols := mat.Dims()
-			mat3 := outputMats[i]
-			_, nOutCols := mat3.Dims()
-			startInd := startInds[i]
-			for i := 0; i < nSamples; i++ {
-				for j := 0; j < nCols; j++ {
-					inputs.Set(i+startInd, j, mat.At(i, j))
-				}
-				for j := 0; j < nOutCols; j++ {
-					outputs.Set(i+startInd, j, mat3.At(i, j))
-				}
-			}
-
-			// Evaluate the weight func on all the rows
-			mat2 := weightMats[i]
-			weightData := make([]float64, len(weightFeatures))
-			for i := 0; i < nSamples; i++ {
-				for j := range weightData {
-					weightData[i] = mat2.At(i, j)
-				}
+			defer wg.Done()
+			nSamples, _ := data[i].Dims()
+			start := startInds[i]
+			weightData := make([]float64, len(weightInds))
+			for r := 0; r < nSamples; r++ {
+				unpackRow(inputs, start+r, data[i], r, inputInds)
+				unpackRow(outputs, start+r, data[i], r, outputInds)
 				if weightFunc != nil {
-					weights[i+startInd] = weightFunc(weightData)
+					for j, ind := range weightInds {
+						weightData[j] = data[i].At(r, ind)
+					}
+					weights[start+r] = weightFunc(weightData)
 				}
 			}
-			wg.Done()
+			// The features of the dataset are no longer needed.
+			data[i] = nil
 		}(i)
 	}
 	wg.Wait()
 
 	return inputs, outputs, weights, nil
+}
+
+// StreamLoadAll loads the datasets one at a time and combines them as in
+// DenseLoadAll. At most one dataset is held in memory besides the combined
+// matrices, so the peak memory is the combined matrices plus the features of
+// the largest dataset. DenseLoadAll instead holds the features of every
+// dataset and the combined matrices at once. Each dataset is loaded once. If
+// DefaultFeatureCache holds the features of every dataset, the combined
+// matrices are allocated once from the row counts in the cache, and
+// otherwise they are grown as each dataset is loaded, which briefly holds
+// the old and the new matrices.
+func StreamLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
+	inputData, outputData common.RowMatrix, weights []float64, err error) {
+	return defaultLoader().StreamLoadAll(datasets, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+}
+
+// StreamLoadAll loads the datasets as in the package-level StreamLoadAll.
+func (l *Loader) StreamLoadAll(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
+	inputData, outputData common.RowMatrix, weights []float64, err error) {
+
+	inputs, outputs, weightData, err := l.streamAssemble(datasets, inputFeatures, outputFeatures, weightFeatures, DefaultChunkSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if weightFunc != nil {
+		nSamples, _ := weightData.Dims()
+		weights = make([]float64, nSamples)
+		for i := range weights {
+			weights[i] = weightFunc(weightData.RawRowView(i))
+		}
+	}
+	return inputs, outputs, weights, nil
+}
+
+// streamAssemble reads the chunks of the datasets into dense matrices of
+// inputs, outputs and weight features, loading each dataset once. The
+// matrices are sized from the row counts in DefaultFeatureCache if it has all
+// of the datasets. Otherwise they are grown to fit each dataset when it is
+// loaded. Rows removed by the non-finite policy are cut off the end.
+func (l *Loader) streamAssemble(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, chunkSize int) (
+	inputs, outputs, weights *mat64.Dense, err error) {
+
+	features, _, _, _ := uniqueFeatures(inputFeatures, outputFeatures, weightFeatures)
+	var nSamples int
+	for _, dataset := range datasets {
+		n, ok := DefaultFeatureCache.rows(dataset, features)
+		if !ok {
+			nSamples = 0
+			break
+		}
+		nSamples += n
+	}
+	inputs = newDense(nSamples, len(inputFeatures))
+	outputs = newDense(nSamples, len(outputFeatures))
+	weights = newDense(nSamples, len(weightFeatures))
+
+	var row int
+	it := l.NewChunkIterator(datasets, inputFeatures, outputFeatures, weightFeatures, chunkSize)
+	for it.Next() {
+		c := it.Chunk()
+		if c.Start == 0 && row+rowsOf(it.data) > nSamples {
+			nSamples = row + rowsOf(it.data)
+			inputs = resizeDense(inputs, row, nSamples)
+			outputs = resizeDense(outputs, row, nSamples)
+			weights = resizeDense(weights, row, nSamples)
+		}
+		copyRows(inputs, row, c.Inputs)
+		copyRows(outputs, row, c.Outputs)
+		copyRows(weights, row, c.Weights)
+		row += c.Rows()
+	}
+	if it.Err() != nil {
+		return nil, nil, nil, it.Err()
+	}
+	if row != nSamples {
+		inputs = resizeDense(inputs, row, row)
+		outputs = resizeDense(outputs, row, row)
+		weights = resizeDense(weights, row, row)
+	}
+	return inputs, outputs, weights, nil
+}
+
+// newDense returns a zeroed r×c matrix. A matrix with no columns has no
+// backing data.
+func newDense(r, c int) *mat64.Dense {
+	if c == 0 {
+		return mat64.NewDense(r, 0, nil)
+	}
+	return mat64.NewDense(r, c, make([]float64, r*c))
+}
+
+// resizeDense returns m with r rows, of which the first n are copied from m.
+// A smaller matrix is a view of m.
+func resizeDense(m *mat64.Dense, n, r int) *mat64.Dense {
+	old, c := m.Dims()
+	if c == 0 || r == 0 {
+		return newDense(r, c)
+	}
+	if r <= old {
+		return m.View(0, 0, r, c).(*mat64.Dense)
+	}
+	resized := newDense(r, c)
+	if n > 0 {
+		copyRows(resized, 0, m.View(0, 0, n, c).(*mat64.Dense))
+	}
+	return resized
+}
+
+// copyRows copies the rows of src into dst starting at row start.
+func copyRows(dst *mat64.Dense, start int, src *mat64.Dense) {
+	r, c := src.Dims()
+	if c == 0 {
+		return
+	}
+	for i := 0; i < r; i++ {
+		copy(dst.RawRowView(start+i), src.RawRowView(i))
+	}
+}
+
+// unpackRow sets row i of dst to the columns inds of row r of src.
+func unpackRow(dst *mat64.Dense, i int, src common.RowMatrix, r int, inds []int) {
+	row := dst.RawRowView(i)
+	for j, ind := range inds {
+		row[j] = src.At(r, ind)
+	}
+}
+
+// A Chunk is a block of consecutive rows of one dataset.
+type Chunk struct {
+	Dataset int // Index of the dataset
+	Start   int // Row of the dataset at which the chunk starts
+
+	Inputs  *mat64.Dense
+	Outputs *mat64.Dense
+	Weights *mat64.Dense // The weight features
+}
+
+// Rows returns the number of rows in the chunk.
+func (c Chunk) Rows() int {
+	r, _ := c.Inputs.Dims()
+	return r
+}
 
+// ChunkIterator returns the rows of a list of datasets in chunks. Each dataset
+// is loaded in full when the iterator reaches it and dropped once its last
+// chunk is returned, so only one dataset is held in memory at a time, but the
+// datasets are not read incrementally. A typical use is
+//
+//	it := NewChunkIterator(datasets, inputFeatures, outputFeatures, nil, DefaultChunkSize)
+//	for it.Next() {
+//		c := it.Chunk()
+//		...
+//	}
+//	if it.Err() != nil {
+//		...
+//	}
+type ChunkIterator struct {
+	loader    *Loader
+	datasets  []Dataset
+	features  []string
+	inds      [3][]int // Columns of the inputs, outputs and weights in the features
+	chunkSize int
+
+	dataset int              // Index of the dataset being read
+	data    common.RowMatrix // Features of the dataset being read
+	row     int              // Next row of data to read
+	bufs    [3]*mat64.Dense  // Reused for each chunk
+	chunk   Chunk
+	err     error
+}
+
+// NewChunkIterator returns an iterator over the rows of the datasets with at
+// most chunkSize rows in each chunk.
+func NewChunkIterator(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, chunkSize int) *ChunkIterator {
+	return defaultLoader().NewChunkIterator(datasets, inputFeatures, outputFeatures, weightFeatures, chunkSize)
+}
+
+// NewChunkIterator returns an iterator over the rows of the datasets which
+// loads each dataset with the Loader.
+func (l *Loader) NewChunkIterator(datasets []Dataset, inputFeatures, outputFeatures, weightFeatures []string, chunkSize int) *ChunkIterator {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	features, inputInds, outputInds, weightInds := uniqueFeatures(inputFeatures, outputFeatures, weightFeatures)
+	it := &ChunkIterator{
+		loader:    l,
+		datasets:  datasets,
+		features:  features,
+		inds:      [3][]int{inputInds, outputInds, weightInds},
+		chunkSize: chunkSize,
+		dataset:   -1,
+	}
+	return it
+}
+
+// Next reads the next chunk, which is then returned by Chunk. It returns false
+// at the end of the datasets or if there is an error. The matrices of the
+// chunk are reused by the next call to Next.
+func (it *ChunkIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.data == nil || it.row >= rowsOf(it.data) {
+		it.data = nil
+		it.dataset++
+		if it.dataset >= len(it.datasets) {
+			return false
+		}
+		data, err := it.loader.loadFeatures(it.datasets[it.dataset], it.features)
+		if err != nil {
+			it.err = fmt.Errorf("error loading %v: %v", it.datasets[it.dataset].ID(), err)
+			return false
+		}
+		it.data = data
+		it.row = 0
+	}
+	n := rowsOf(it.data) - it.row
+	if n > it.chunkSize {
+		n = it.chunkSize
+	}
+	var m [3]*mat64.Dense
+	for k, inds := range it.inds {
+		if it.bufs[k] == nil {
+			it.bufs[k] = mat64.NewDense(it.chunkSize, len(inds), make([]float64, it.chunkSize*len(inds)))
+		}
+		if len(inds) == 0 {
+			m[k] = mat64.NewDense(n, 0, nil)
+			continue
+		}
+		m[k] = it.bufs[k].View(0, 0, n, len(inds)).(*mat64.Dense)
+		for i := 0; i < n; i++ {
+			unpackRow(m[k], i, it.data, it.row+i, inds)
+		}
+	}
+	it.chunk = Chunk{
+		Dataset: it.dataset,
+		Start:   it.row,
+		Inputs:  m[0],
+		Outputs: m[1],
+		Weights: m[2],
+	}
+	it.row += n
+	return true
+}
+
+// Chunk returns the chunk read by the last call to Next.
+func (it *ChunkIterator) Chunk() Chunk {
+	return it.chunk
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *ChunkIterator) Err() error {
+	return it.err
+}
+
+func rowsOf(m common.RowMatrix) int {
+	r, _ := m.Dims()
+	return r
 }
 
 // reduceError returns the slice of errors if any of the errors are non-nil
@@ -216,6 +522,13 @@ func reduceError(errs []error) []error {
 // LoadTrainingData returns
 func LoadTrainingData(datasets []Dataset, loadStyle LoadStyle, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
 	inputs, outputs common.RowMatrix, weights []float64, err error) {
+	return defaultLoader().LoadTrainingData(datasets, loadStyle, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+}
+
+// LoadTrainingData loads the datasets as in the package-level
+// LoadTrainingData.
+func (l *Loader) LoadTrainingData(datasets []Dataset, loadStyle LoadStyle, inputFeatures, outputFeatures, weightFeatures []string, weightFunc func([]float64) float64) (
+	inputs, outputs common.RowMatrix, weights []float64, err error) {
 
 	if len(weightFeatures) != 0 && weightFunc == nil {
 		err = errors.New("non-zero weights but nil weightFunc")
@@ -232,6 +545,8 @@ func LoadTrainingData(datasets []Dataset, loadStyle LoadStyle, inputFeatures, ou
 		err = UnknownLoadStyle
 		return
 	case DenseLoad:
-		return DenseLoadAll(datasets, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+		return l.DenseLoadAll(datasets, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+	case StreamLoad:
+		return l.StreamLoadAll(datasets, inputFeatures, outputFeatures, weightFeatures, weightFunc)
 	}
 }
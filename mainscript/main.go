@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/btracey/ransuq"
 	"github.com/btracey/ransuq/mlalg"
@@ -28,12 +34,59 @@ func init() {
 }
 
 func main() {
+	// Run the job and exit if this is a child process started by -subprocess.
+	ransuq.RunSubprocessJob()
+
 	var location string
 	flag.StringVar(&location, "location", "local", "where is the code being run (local, cluster)")
 	var doprofile bool
 	flag.BoolVar(&doprofile, "profile", false, "should the code be profiled")
 	var casefile string
 	flag.StringVar(&casefile, "j", "none", "json file for which case to run")
+	var plan bool
+	flag.BoolVar(&plan, "plan", false, "print the jobs that would be run and exit without running them")
+	var planout string
+	flag.StringVar(&planout, "planout", "", "if set, write the job graph to <planout>.dot and <planout>.json")
+	var events string
+	flag.StringVar(&events, "events", "quiet", "progress shown on the terminal (quiet, verbose, none)")
+	var retries int
+	flag.IntVar(&retries, "retries", 1, "number of times to run a failed job, including the first")
+	var backoff time.Duration
+	flag.DurationVar(&backoff, "retrybackoff", time.Minute, "wait before retrying a failed job, doubled after each attempt")
+	var retrycfl float64
+	flag.Float64Var(&retrycfl, "retrycfl", 0, "if nonzero, multiply the CFL number of a failed SU2 run by this factor before each retry. Overrides the RetryCFLFactor of the config")
+	var phases string
+	flag.StringVar(&phases, "phases", "", "comma-separated phases to run again (generate-data, train, compare, postprocess). Other phases reuse existing results. If empty all phases run as needed")
+	var crossval bool
+	flag.BoolVar(&crossval, "crossval", false, "cross-validate each case over its training datasets instead of running it")
+	var folds int
+	flag.IntVar(&folds, "folds", 0, "number of cross-validation folds. 0 leaves out one dataset at a time")
+	var summary string
+	flag.StringVar(&summary, "summary", "", "file for the table of cases and their outcomes. Defaults to the case file name with _summary.csv")
+	var memory float64
+	flag.Float64Var(&memory, "memory", 0, "GiB of memory the running jobs may use. 0 is no limit")
+	var configfile string
+	flag.StringVar(&configfile, "config", "", "JSON file with the DataRoot, ResultsRoot and SU2Path. If empty, they are found from GOPATH and SU2_RUN")
+	var eventlog string
+	flag.StringVar(&eventlog, "eventlog", "", "if set, write every event to this file as JSON lines")
+	var timeout time.Duration
+	flag.DurationVar(&timeout, "timeout", 0, "longest a local job may run before it fails. 0 is no limit")
+	var batch string
+	flag.StringVar(&batch, "batch", "", "if set, submit the SU2 and data generation jobs to this batch system (slurm, pbs). Training still runs here. The ransuq command must be installed on the nodes")
+	var batchdir string
+	flag.StringVar(&batchdir, "batchdir", "", "directory for the batch job scripts, shared with the nodes. Defaults to batch in the ResultsRoot")
+	var coordinator string
+	flag.StringVar(&coordinator, "coordinator", "", "if set, send the SU2 and data generation jobs to workers connecting to this network:address (for example tcp::7070). Training still runs here")
+	var metrics string
+	flag.StringVar(&metrics, "metrics", "", "if set, serve the scheduler metrics at this address (for example localhost:6060) at /metrics in the Prometheus format and at /debug/vars as expvar")
+	var load string
+	flag.StringVar(&load, "load", "dense", "how the data are loaded (dense, stream). stream loads one dataset at a time to use less memory")
+	var featurecache string
+	flag.StringVar(&featurecache, "featurecache", "", "directory for the cache of loaded data, or none to always parse the data files. Defaults to featurecache in the ResultsRoot")
+	var nonfinite string
+	flag.StringVar(&nonfinite, "nonfinite", "fail", "what to do with NaN and infinite values in the loaded data (fail, drop, clamp). drop removes the rows, clamp replaces infinities with the finite range of the feature and removes rows with NaN")
+	var subprocess bool
+	flag.BoolVar(&subprocess, "subprocess", false, "run each SU2 and data generation job run here in a child process, so a crash only fails that job")
 	flag.Parse()
 
 	if casefile == "none" {
@@ -55,6 +108,73 @@ func main() {
 		defer profile.Start(profile.CPUProfile).Stop()
 	}
 
+	var sinks ransuq.MultiSink
+	switch events {
+	case "quiet":
+		sinks = append(sinks, ransuq.QuietSink{W: os.Stdout})
+	case "verbose":
+		sinks = append(sinks, ransuq.VerboseSink{W: os.Stdout})
+	case "none":
+	default:
+		log.Fatal("unknown events setting")
+	}
+	if eventlog != "" {
+		f, err := os.Create(eventlog)
+		if err != nil {
+			log.Fatal("error creating event log: ", err)
+		}
+		defer f.Close()
+		sinks = append(sinks, ransuq.NewJSONSink(f))
+	}
+	ransuq.SetEventSink(sinks)
+
+	if metrics != "" {
+		l, err := ransuq.ServeMetrics(metrics)
+		if err != nil {
+			log.Fatal("error serving metrics: ", err)
+		}
+		defer l.Close()
+		fmt.Println("Serving metrics at http://" + l.Addr().String() + "/metrics")
+	}
+
+	config, err := getConfig(configfile)
+	if err != nil {
+		log.Fatal("error getting config: ", err)
+	}
+	if retrycfl != 0 {
+		config.RetryCFLFactor = retrycfl
+	}
+
+	switch featurecache {
+	case "none":
+	case "":
+		ransuq.DefaultFeatureCache = &ransuq.FeatureCache{Dir: filepath.Join(config.ResultsRoot, "featurecache")}
+	default:
+		ransuq.DefaultFeatureCache = &ransuq.FeatureCache{Dir: featurecache}
+	}
+
+	var loadStyle ransuq.LoadStyle
+	switch load {
+	case "dense":
+		loadStyle = ransuq.DenseLoad
+	case "stream":
+		loadStyle = ransuq.StreamLoad
+	default:
+		log.Fatal("unknown load style ", load)
+	}
+
+	var nonFinite ransuq.NonFinitePolicy
+	switch nonfinite {
+	case "fail":
+		nonFinite = ransuq.NonFiniteFail
+	case "drop":
+		nonFinite = ransuq.NonFiniteDrop
+	case "clamp":
+		nonFinite = ransuq.NonFiniteClamp
+	default:
+		log.Fatal("unknown non-finite policy ", nonfinite)
+	}
+
 	caller := driver.Serial{} // Run the SU^2 cases in serial
 
 	// Construct all of the datasets
@@ -67,11 +187,12 @@ func main() {
 	}
 
 	settingCases := GetCases(f)
+	f.Close()
 	fmt.Println("The number of runs that will be done is: ", len(settingCases))
 	for i, c := range settingCases {
 
 		fmt.Println("Set testing data", c.TestingData)
-		set, err := settings.GetSettings(
+		set, err := config.GetSettings(
 			c.TrainingData,
 			c.TestingData,
 			c.Features,
@@ -85,32 +206,123 @@ func main() {
 			log.Fatal("error getting settings:", err)
 		}
 		if c.Algorithm == settings.MulNetTwoFifty {
-			os := &mlalg.MulOutputScaler{}
-			is := &mlalg.MulInputScaler{
-				Scaler:          set.Trainer.InputScaler,
-				MulOutputScaler: os,
-			}
-			set.Trainer.InputScaler = is
-			set.Trainer.OutputScaler = os
+			mulScalers(set.Trainer)
 		}
+		set.LoadStyle = loadStyle
+		set.NonFinite = nonFinite
 		if len(set.TrainingData) == 0 {
 			log.Fatal("no training data in set ", i)
 		}
 		sets = append(sets, set)
 	}
 
-	scheduler := ransuq.NewLocalScheduler()
+	selected, err := ransuq.ParsePhases(phases)
+	if err != nil {
+		log.Fatal(err)
+	}
+	local := ransuq.NewLocalScheduler()
+	local.MemoryBudget = int64(memory * (1 << 30))
+	local.Timeout = timeout
+	local.Subprocess = subprocess
+	var scheduler ransuq.Scheduler = local
+	if coordinator != "" && batch != "" {
+		log.Fatal("-coordinator and -batch may not both be set")
+	}
+	if coordinator != "" {
+		parts := strings.SplitN(coordinator, ":", 2)
+		if len(parts) != 2 {
+			log.Fatal("coordinator address must be network:address")
+		}
+		c, err := ransuq.ListenCoordinator(parts[0], parts[1])
+		if err != nil {
+			log.Fatal("error starting coordinator: ", err)
+		}
+		c.Local = local
+		scheduler = c
+	}
+	if batch != "" {
+		if batchdir == "" {
+			batchdir = filepath.Join(config.ResultsRoot, "batch")
+		}
+		var b *ransuq.BatchScheduler
+		switch batch {
+		case "slurm":
+			b = ransuq.NewSlurmScheduler(batchdir)
+		case "pbs":
+			b = ransuq.NewPBSScheduler(batchdir)
+		default:
+			log.Fatal("unknown batch system ", batch)
+		}
+		b.Local = local
+		scheduler = b
+	}
+	pipeline := &ransuq.Pipeline{
+		Scheduler: scheduler,
+		Retry: ransuq.RetryPolicy{
+			MaxAttempts: retries,
+			Backoff:     backoff,
+			Multiplier:  2,
+		},
+		Phases: selected,
+	}
+
+	if plan || planout != "" {
+		p := pipeline.Plan(sets)
+		fmt.Println(p.Summary())
+		if planout != "" {
+			err := writePlan(p, planout)
+			if err != nil {
+				log.Fatal("error writing plan: ", err)
+			}
+		}
+		if plan {
+			return
+		}
+	}
+
+	// Stop launching new jobs on the first interrupt so that the results
+	// directories are left in a state that can be resumed. A second interrupt
+	// exits without waiting for the running jobs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, waiting for running jobs to finish. Send again to exit immediately", sig)
+		cancel()
+		<-sigs
+		log.Fatal("exiting without waiting for running jobs")
+	}()
+
+	if crossval {
+		runCrossValidation(ctx, pipeline, settingCases, sets, folds)
+		return
+	}
+
 	fmt.Println("Begin ransuq.MultiTurb")
-	errs := ransuq.MultiTurb(sets, scheduler)
+	reports, errs := pipeline.Run(ctx, sets)
 	fmt.Println("End ransuq.MultiTurb")
 
+	if summary == "" {
+		summary = strings.TrimSuffix(casefile, filepath.Ext(casefile)) + "_summary.csv"
+	}
+	err = writeSummary(summary, settingCases, reports, errs)
+	if err != nil {
+		fmt.Println("error writing summary:", err)
+	}
+
 	var haserror bool
-	for _, err := range errs {
-		if err != nil {
-			haserror = true
-			fmt.Println("Finished with error")
-			fmt.Println(errs)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		haserror = true
+		if _, ok := err.(ransuq.SkippedError); ok {
+			fmt.Printf("Case %v (%v) not finished: %v\n", i, settingCases[i].Name, err)
+			continue
 		}
+		fmt.Printf("Case %v (%v) finished with error: %v\n", i, settingCases[i].Name, err)
 	}
 	if haserror {
 		return
@@ -120,6 +332,83 @@ func main() {
 
 }
 
+// getConfig loads the config file, or returns the default config if there is
+// no file.
+func getConfig(filename string) (*settings.Config, error) {
+	if filename == "" {
+		return settings.DefaultConfig()
+	}
+	return settings.LoadConfig(filename)
+}
+
+// mulScalers changes the scalers of the trainer for a multiplied network.
+func mulScalers(trainer *ransuq.Trainer) {
+	os := &mlalg.MulOutputScaler{}
+	is := &mlalg.MulInputScaler{
+		Scaler:          trainer.InputScaler,
+		MulOutputScaler: os,
+	}
+	trainer.InputScaler = is
+	trainer.OutputScaler = os
+}
+
+// runCrossValidation cross-validates each case over its training datasets.
+func runCrossValidation(ctx context.Context, pipeline *ransuq.Pipeline, cases []*settingCase, sets []*ransuq.Settings, folds int) {
+	for i, set := range sets {
+		c := cases[i]
+		base := *set
+		base.TrainingData = nil
+		cv := &ransuq.CrossValidation{
+			Base:  &base,
+			Group: set.TrainingData,
+			K:     folds,
+			NewTrainer: func() (*ransuq.Trainer, error) {
+				trainer, err := settings.GetTrainer(c.Convergence, c.Algorithm, len(set.InputFeatures), len(set.OutputFeatures))
+				if err != nil {
+					return nil, err
+				}
+				if c.Algorithm == settings.MulNetTwoFifty {
+					mulScalers(trainer)
+				}
+				return trainer, nil
+			},
+		}
+		result, err := cv.Run(ctx, pipeline)
+		if err != nil {
+			fmt.Printf("Case %v cross-validation error: %v\n", i, err)
+			continue
+		}
+		for j, err := range result.Errs {
+			if err != nil {
+				fmt.Printf("Case %v fold %v finished with error: %v\n", i, j, err)
+			}
+		}
+		for _, s := range result.Summary {
+			fmt.Printf("Case %v %v: RMSE %v ± %v, R2 %v ± %v over %v folds\n",
+				i, s.Output, s.MeanRMSE, s.StdRMSE, s.MeanR2, s.StdR2, s.Folds)
+		}
+	}
+}
+
+// writePlan saves the plan as Graphviz and JSON files.
+func writePlan(p *ransuq.Plan, base string) error {
+	f, err := os.Create(base + ".dot")
+	if err != nil {
+		return err
+	}
+	err = p.WriteDOT(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	f, err = os.Create(base + ".json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.WriteJSON(f)
+}
+
 type settingCase struct {
 	Name         string
 	TrainingData string
@@ -131,14 +420,32 @@ type settingCase struct {
 	ExtraString  []string
 }
 
+// GetCases decodes the cases in a case file and expands any sweeps. Each of
+// TrainingData, TestingData, Algorithm, Weight, Features and Convergence may be
+// a single value or a list, for example
+//
+//	[{"Name": "Nets", "TrainingData": "laval_dns", "TestingData": "none",
+//	  "Algorithm": ["net_2_25", "net_2_50"], "Weight": "none",
+//	  "Features": ["source", "production"], "Convergence": "10kiter",
+//	  "Exclude": [{"Algorithm": "net_2_25", "Features": "production"}]}]
+//
+// runs three cases. See sweepCase for zip groups.
 func GetCases(r io.Reader) []*settingCase {
-	c := make([]*settingCase, 0, 100)
+	sweeps := make([]*sweepCase, 0, 100)
 
 	dec := json.NewDecoder(r)
-	err := dec.Decode(&c)
+	err := dec.Decode(&sweeps)
 	if err != nil {
 		log.Fatal("error decoding cases:", err)
 	}
+	var c []*settingCase
+	for _, sweep := range sweeps {
+		cases, err := sweep.expand()
+		if err != nil {
+			log.Fatal("error expanding cases: ", err)
+		}
+		c = append(c, cases...)
+	}
 	fmt.Println("Done decoding")
 	for i := range c {
 		fmt.Println(c[i])
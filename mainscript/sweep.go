@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btracey/ransuq"
+)
+
+// stringList is a field of a case file which is either a single string or a
+// list of strings to sweep over.
+type stringList []string
+
+func (s *stringList) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*s = stringList{str}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(b, &strs); err != nil {
+		return errors.New("expected a string or a list of strings: " + string(b))
+	}
+	*s = strs
+	return nil
+}
+
+// sweepFields are the fields of a case which may be swept, in the order they
+// are expanded.
+var sweepFields = []string{"TrainingData", "TestingData", "Features", "Weight", "Algorithm", "Convergence"}
+
+// sweepCase is an entry in a case file. Any of the sweep fields may be a list,
+// in which case the entry expands to the cartesian product of the lists. The
+// fields of a Zip group are instead stepped through together, so their lists
+// must be the same length. A case is left out if it matches all of the fields
+// of one of the Exclude entries.
+type sweepCase struct {
+	Name         string
+	TrainingData stringList
+	TestingData  stringList
+	Algorithm    stringList
+	Weight       stringList
+	Features     stringList
+	Convergence  stringList
+	ExtraString  []string
+	Zip          [][]string
+	Exclude      []map[string]string
+}
+
+func (s *sweepCase) field(name string) (*stringList, bool) {
+	switch name {
+	case "TrainingData":
+		return &s.TrainingData, true
+	case "TestingData":
+		return &s.TestingData, true
+	case "Algorithm":
+		return &s.Algorithm, true
+	case "Weight":
+		return &s.Weight, true
+	case "Features":
+		return &s.Features, true
+	case "Convergence":
+		return &s.Convergence, true
+	}
+	return nil, false
+}
+
+func (c *settingCase) set(name, value string) {
+	switch name {
+	case "TrainingData":
+		c.TrainingData = value
+	case "TestingData":
+		c.TestingData = value
+	case "Algorithm":
+		c.Algorithm = value
+	case "Weight":
+		c.Weight = value
+	case "Features":
+		c.Features = value
+	case "Convergence":
+		c.Convergence = value
+	}
+}
+
+func (c *settingCase) get(name string) string {
+	switch name {
+	case "TrainingData":
+		return c.TrainingData
+	case "TestingData":
+		return c.TestingData
+	case "Algorithm":
+		return c.Algorithm
+	case "Weight":
+		return c.Weight
+	case "Features":
+		return c.Features
+	case "Convergence":
+		return c.Convergence
+	}
+	return ""
+}
+
+// sweepDim is a set of fields which vary together.
+type sweepDim struct {
+	fields []string
+	values [][]string // values[i] are the values of the fields for step i
+}
+
+// expand returns the cases of the sweep. If more than one case results, each
+// is named by appending the swept values to the name of the entry.
+func (s *sweepCase) expand() ([]*settingCase, error) {
+	zipped := make(map[string]bool)
+	var dims []sweepDim
+	for _, group := range s.Zip {
+		dim := sweepDim{fields: group}
+		n := -1
+		for _, name := range group {
+			f, ok := s.field(name)
+			if !ok {
+				return nil, fmt.Errorf("%v: unknown zip field %q", s.Name, name)
+			}
+			if zipped[name] {
+				return nil, fmt.Errorf("%v: field %v in more than one zip group", s.Name, name)
+			}
+			zipped[name] = true
+			if n != -1 && len(*f) != n {
+				return nil, fmt.Errorf("%v: zipped fields %v have different lengths", s.Name, group)
+			}
+			n = len(*f)
+		}
+		for i := 0; i < n; i++ {
+			step := make([]string, len(group))
+			for j, name := range group {
+				f, _ := s.field(name)
+				step[j] = (*f)[i]
+			}
+			dim.values = append(dim.values, step)
+		}
+		dims = append(dims, dim)
+	}
+	for _, name := range sweepFields {
+		if zipped[name] {
+			continue
+		}
+		f, _ := s.field(name)
+		dim := sweepDim{fields: []string{name}}
+		for _, v := range *f {
+			dim.values = append(dim.values, []string{v})
+		}
+		dims = append(dims, dim)
+	}
+	for _, dim := range dims {
+		if len(dim.values) == 0 {
+			return nil, fmt.Errorf("%v: no values for %v", s.Name, dim.fields)
+		}
+	}
+	for _, exclude := range s.Exclude {
+		for name := range exclude {
+			if _, ok := s.field(name); !ok {
+				return nil, fmt.Errorf("%v: unknown exclude field %q", s.Name, name)
+			}
+		}
+	}
+
+	// Step through the cartesian product of the dimensions like an odometer.
+	var cases []*settingCase
+	idx := make([]int, len(dims))
+	for {
+		c := &settingCase{
+			Name:        s.Name,
+			ExtraString: s.ExtraString,
+		}
+		var swept []string
+		for i, dim := range dims {
+			for j, name := range dim.fields {
+				c.set(name, dim.values[idx[i]][j])
+			}
+			if len(dim.values) > 1 {
+				swept = append(swept, dim.values[idx[i]]...)
+			}
+		}
+		if !excluded(c, s.Exclude) {
+			if len(swept) != 0 {
+				c.Name = strings.TrimSpace(s.Name + " " + strings.Join(swept, " "))
+			}
+			cases = append(cases, c)
+		}
+
+		i := len(dims) - 1
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < len(dims[i].values) {
+				break
+			}
+			idx[i] = 0
+		}
+		if i < 0 {
+			return cases, nil
+		}
+	}
+}
+
+func excluded(c *settingCase, excludes []map[string]string) bool {
+	for _, exclude := range excludes {
+		match := true
+		for name, value := range exclude {
+			if c.get(name) != value {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSummary writes a table of the cases and the outcome of each run.
+func writeSummary(filename string, cases []*settingCase, reports []*ransuq.RunReport, errs []error) error {
+	records := [][]string{{"name", "training", "testing", "features", "weight", "algorithm", "convergence", "status", "savepath", "error"}}
+	for i, c := range cases {
+		var status ransuq.Status
+		var savepath, errStr string
+		if r := reports[i]; r != nil {
+			status = r.Status
+			savepath = r.Savepath
+		}
+		if errs[i] != nil {
+			errStr = errs[i].Error()
+		}
+		records = append(records, []string{
+			c.Name, c.TrainingData, c.TestingData, c.Features, c.Weight, c.Algorithm, c.Convergence,
+			string(status), savepath, errStr,
+		})
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(f).WriteAll(records)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSweepExpand(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		sweep sweepCase
+		cases []settingCase
+		err   bool
+	}{
+		{
+			name: "single",
+			sweep: sweepCase{
+				Name:         "flatplate",
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim"},
+				Convergence:  stringList{"quick"},
+				ExtraString:  []string{"extra"},
+			},
+			cases: []settingCase{
+				{"flatplate", "fp", "fp", "net", "none", "nondim", "quick", []string{"extra"}},
+			},
+		},
+		{
+			name: "product",
+			sweep: sweepCase{
+				Name:         "sweep",
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net", "tree"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim", "dim"},
+				Convergence:  stringList{"quick"},
+			},
+			cases: []settingCase{
+				{"sweep nondim net", "fp", "fp", "net", "none", "nondim", "quick", nil},
+				{"sweep nondim tree", "fp", "fp", "tree", "none", "nondim", "quick", nil},
+				{"sweep dim net", "fp", "fp", "net", "none", "dim", "quick", nil},
+				{"sweep dim tree", "fp", "fp", "tree", "none", "dim", "quick", nil},
+			},
+		},
+		{
+			name: "zip",
+			sweep: sweepCase{
+				Name:         "zip",
+				TrainingData: stringList{"fp", "naca"},
+				TestingData:  stringList{"fp_test", "naca_test"},
+				Algorithm:    stringList{"net"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim", "dim"},
+				Convergence:  stringList{"quick"},
+				Zip:          [][]string{{"TrainingData", "TestingData"}},
+			},
+			cases: []settingCase{
+				{"zip fp fp_test nondim", "fp", "fp_test", "net", "none", "nondim", "quick", nil},
+				{"zip fp fp_test dim", "fp", "fp_test", "net", "none", "dim", "quick", nil},
+				{"zip naca naca_test nondim", "naca", "naca_test", "net", "none", "nondim", "quick", nil},
+				{"zip naca naca_test dim", "naca", "naca_test", "net", "none", "dim", "quick", nil},
+			},
+		},
+		{
+			name: "exclude",
+			sweep: sweepCase{
+				Name:         "exclude",
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net", "tree"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim", "dim"},
+				Convergence:  stringList{"quick"},
+				Exclude:      []map[string]string{{"Algorithm": "tree", "Features": "dim"}},
+			},
+			cases: []settingCase{
+				{"exclude nondim net", "fp", "fp", "net", "none", "nondim", "quick", nil},
+				{"exclude nondim tree", "fp", "fp", "tree", "none", "nondim", "quick", nil},
+				{"exclude dim net", "fp", "fp", "net", "none", "dim", "quick", nil},
+			},
+		},
+		{
+			name: "no name",
+			sweep: sweepCase{
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net", "tree"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim"},
+				Convergence:  stringList{"quick"},
+			},
+			cases: []settingCase{
+				{"net", "fp", "fp", "net", "none", "nondim", "quick", nil},
+				{"tree", "fp", "fp", "tree", "none", "nondim", "quick", nil},
+			},
+		},
+		{
+			name: "zip lengths",
+			sweep: sweepCase{
+				Name:         "bad",
+				TrainingData: stringList{"fp", "naca"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim"},
+				Convergence:  stringList{"quick"},
+				Zip:          [][]string{{"TrainingData", "TestingData"}},
+			},
+			err: true,
+		},
+		{
+			name: "unknown exclude",
+			sweep: sweepCase{
+				Name:         "bad",
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net"},
+				Weight:       stringList{"none"},
+				Features:     stringList{"nondim"},
+				Convergence:  stringList{"quick"},
+				Exclude:      []map[string]string{{"Optimizer": "lbfgs"}},
+			},
+			err: true,
+		},
+		{
+			name: "missing field",
+			sweep: sweepCase{
+				Name:         "bad",
+				TrainingData: stringList{"fp"},
+				TestingData:  stringList{"fp"},
+				Algorithm:    stringList{"net"},
+				Features:     stringList{"nondim"},
+				Convergence:  stringList{"quick"},
+			},
+			err: true,
+		},
+	} {
+		cases, err := test.sweep.expand()
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		got := make([]settingCase, len(cases))
+		for i, c := range cases {
+			got[i] = *c
+		}
+		if !reflect.DeepEqual(got, test.cases) {
+			t.Errorf("%v: expected %v, found %v", test.name, test.cases, got)
+		}
+	}
+}
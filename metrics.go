@@ -0,0 +1,321 @@
+package ransuq
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SchedulerMetrics records how busy the schedulers are from the job events
+// they emit, so it works with any Scheduler. Every event passed to Emit is
+// recorded in DefaultMetrics, and the events of the jobs of a Graph are also
+// recorded in its Metrics. The jobs are matched by the Seq of the events.
+type SchedulerMetrics struct {
+	mux     sync.Mutex
+	stats   SchedulerStats
+	queued  map[uint64]time.Time // Time each waiting job was queued
+	running map[uint64]runningJob
+}
+
+type runningJob struct {
+	start time.Time
+	cores int
+	local bool
+}
+
+// SchedulerStats is a snapshot of SchedulerMetrics. The counts and totals
+// are since Start, and the gauges are at Time.
+type SchedulerStats struct {
+	Start time.Time
+	Time  time.Time
+
+	Queued    int // Jobs waiting to start
+	Running   int
+	BusyCores int // Cores used by the running jobs on this machine
+	Cores     int // Cores of the LocalScheduler
+
+	Finished map[Status]int
+
+	Waits     int           // Jobs which were queued and then started
+	WaitTotal time.Duration // Time between being queued and started
+	Runs      int           // Jobs which were started and then finished
+	RunTotal  time.Duration
+
+	// BusyCoreSeconds is the integral of BusyCores over time.
+	BusyCoreSeconds float64
+
+	// History has the gauges each time they changed. Once it is full every
+	// other sample is dropped, so it spans the whole run at a coarser
+	// resolution.
+	History []MetricsSample
+}
+
+// MetricsSample is the state of the schedulers at one time.
+type MetricsSample struct {
+	Time      time.Time
+	Queued    int
+	Running   int
+	BusyCores int
+}
+
+// maxMetricsSamples is the length at which the history is thinned.
+const maxMetricsSamples = 1000
+
+// DefaultMetrics records the events of the package.
+var DefaultMetrics = NewSchedulerMetrics()
+
+// publishMetrics publishes DefaultMetrics with expvar the first time the
+// metrics are served.
+var publishMetrics sync.Once
+
+func NewSchedulerMetrics() *SchedulerMetrics {
+	now := time.Now()
+	return &SchedulerMetrics{
+		stats: SchedulerStats{
+			Start:    now,
+			Time:     now,
+			Finished: make(map[Status]int),
+		},
+		queued:  make(map[uint64]time.Time),
+		running: make(map[uint64]runningJob),
+	}
+}
+
+// Event records the event if it is from a scheduler.
+func (m *SchedulerMetrics) Event(e Event) {
+	// Finished events with a phase are from the graph rather than a scheduler.
+	if e.Phase != "" {
+		return
+	}
+	switch e.Kind {
+	case EventJobQueued, EventJobStarted, EventJobFinished, EventCoresFreed:
+	default:
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s := &m.stats
+	m.advance(e.Time)
+	local := e.Worker == ""
+	switch e.Kind {
+	case EventJobQueued:
+		m.queued[e.Seq] = e.Time
+	case EventJobStarted:
+		if t, ok := m.queued[e.Seq]; ok {
+			delete(m.queued, e.Seq)
+			s.Waits++
+			s.WaitTotal += e.Time.Sub(t)
+		}
+		m.running[e.Seq] = runningJob{start: e.Time, cores: e.Cores, local: local}
+		if local {
+			s.BusyCores += e.Cores
+			if e.Cores+e.AvailableCores > s.Cores {
+				s.Cores = e.Cores + e.AvailableCores
+			}
+		}
+	case EventJobFinished:
+		// A job may finish without starting if the scheduler stopped or
+		// the run was cancelled.
+		delete(m.queued, e.Seq)
+		if r, ok := m.running[e.Seq]; ok {
+			delete(m.running, e.Seq)
+			s.Runs++
+			s.RunTotal += e.Time.Sub(r.start)
+			if r.local {
+				s.BusyCores -= r.cores
+			}
+		}
+		s.Finished[e.Status]++
+	case EventCoresFreed:
+		if e.AvailableCores > s.Cores {
+			s.Cores = e.AvailableCores
+		}
+	}
+	s.Queued = len(m.queued)
+	s.Running = len(m.running)
+	m.sample()
+}
+
+// advance adds the busy cores since the last change to BusyCoreSeconds and
+// moves Time to t.
+func (m *SchedulerMetrics) advance(t time.Time) {
+	s := &m.stats
+	if t.After(s.Time) {
+		s.BusyCoreSeconds += float64(s.BusyCores) * t.Sub(s.Time).Seconds()
+		s.Time = t
+	}
+}
+
+func (m *SchedulerMetrics) sample() {
+	s := &m.stats
+	if len(s.History) == maxMetricsSamples {
+		for i := 0; i < maxMetricsSamples/2; i++ {
+			s.History[i] = s.History[2*i+1]
+		}
+		s.History = s.History[:maxMetricsSamples/2]
+	}
+	s.History = append(s.History, MetricsSample{
+		Time:      s.Time,
+		Queued:    s.Queued,
+		Running:   s.Running,
+		BusyCores: s.BusyCores,
+	})
+}
+
+// Stats returns the metrics up to now.
+func (m *SchedulerMetrics) Stats() SchedulerStats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.advance(time.Now())
+	s := m.stats
+	s.Finished = make(map[Status]int, len(m.stats.Finished))
+	for k, v := range m.stats.Finished {
+		s.Finished[k] = v
+	}
+	s.History = append([]MetricsSample(nil), m.stats.History...)
+	return s
+}
+
+// Since returns the counts and totals between the earlier stats and s. The
+// gauges are those of s, and the history is trimmed to the interval.
+func (s SchedulerStats) Since(earlier SchedulerStats) SchedulerStats {
+	d := s
+	d.Start = earlier.Time
+	d.Finished = make(map[Status]int)
+	for k, v := range s.Finished {
+		if n := v - earlier.Finished[k]; n != 0 {
+			d.Finished[k] = n
+		}
+	}
+	d.Waits -= earlier.Waits
+	d.WaitTotal -= earlier.WaitTotal
+	d.Runs -= earlier.Runs
+	d.RunTotal -= earlier.RunTotal
+	d.BusyCoreSeconds -= earlier.BusyCoreSeconds
+	i := sort.Search(len(s.History), func(i int) bool {
+		return !s.History[i].Time.Before(d.Start)
+	})
+	d.History = s.History[i:]
+	return d
+}
+
+// MeanWait is the average time a job waited to start.
+func (s SchedulerStats) MeanWait() time.Duration {
+	if s.Waits == 0 {
+		return 0
+	}
+	return s.WaitTotal / time.Duration(s.Waits)
+}
+
+// MeanRun is the average time a job ran.
+func (s SchedulerStats) MeanRun() time.Duration {
+	if s.Runs == 0 {
+		return 0
+	}
+	return s.RunTotal / time.Duration(s.Runs)
+}
+
+// Utilization is the fraction of the core time of the LocalScheduler between
+// Start and Time that was used by jobs.
+func (s SchedulerStats) Utilization() float64 {
+	elapsed := s.Time.Sub(s.Start).Seconds()
+	if s.Cores == 0 || elapsed <= 0 {
+		return 0
+	}
+	return s.BusyCoreSeconds / (float64(s.Cores) * elapsed)
+}
+
+// MaxQueued is the most jobs waiting at once in the history.
+func (s SchedulerStats) MaxQueued() int {
+	var max int
+	for _, h := range s.History {
+		if h.Queued > max {
+			max = h.Queued
+		}
+	}
+	return max
+}
+
+func (s SchedulerStats) String() string {
+	var finished int
+	for _, n := range s.Finished {
+		finished += n
+	}
+	return fmt.Sprintf("%v jobs finished (%v failed) in %v. Mean wait %v, mean run %v, at most %v queued, %.1f%% of %v cores used",
+		finished, s.Finished[StatusFailed], s.Time.Sub(s.Start).Round(time.Second),
+		s.MeanWait().Round(time.Second), s.MeanRun().Round(time.Second), s.MaxQueued(),
+		100*s.Utilization(), s.Cores)
+}
+
+// WritePrometheus writes the stats in the Prometheus text format.
+func (s SchedulerStats) WritePrometheus(w io.Writer) error {
+	var err error
+	metric := func(name, kind, help string, values ...string) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+		for _, v := range values {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "%v%v\n", name, v)
+			}
+		}
+	}
+	value := func(v interface{}) string {
+		return fmt.Sprintf(" %v", v)
+	}
+	metric("ransuq_jobs_queued", "gauge", "Jobs waiting to start.", value(s.Queued))
+	metric("ransuq_jobs_running", "gauge", "Jobs running.", value(s.Running))
+	metric("ransuq_cores_busy", "gauge", "Cores used by the running jobs on this machine.", value(s.BusyCores))
+	metric("ransuq_cores", "gauge", "Cores of the local scheduler.", value(s.Cores))
+
+	statuses := make([]string, 0, len(s.Finished))
+	for status := range s.Finished {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	var finished []string
+	for _, status := range statuses {
+		finished = append(finished, fmt.Sprintf("{status=%q} %v", status, s.Finished[Status(status)]))
+	}
+	metric("ransuq_jobs_finished_total", "counter", "Jobs finished by status.", finished...)
+
+	metric("ransuq_job_wait_seconds", "summary", "Time between a job being queued and started.",
+		"_sum"+value(s.WaitTotal.Seconds()), "_count"+value(s.Waits))
+	metric("ransuq_job_run_seconds", "summary", "Time between a job being started and finished.",
+		"_sum"+value(s.RunTotal.Seconds()), "_count"+value(s.Runs))
+	metric("ransuq_busy_core_seconds_total", "counter", "Core time used by jobs on this machine.", value(s.BusyCoreSeconds))
+	return err
+}
+
+// ServeHTTP writes the current stats in the Prometheus text format.
+func (m *SchedulerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Stats().WritePrometheus(w)
+}
+
+// ServeMetrics serves DefaultMetrics at /metrics in the Prometheus text
+// format and at /debug/vars with expvar, until the listener is closed. The
+// address should usually be local, such as "localhost:6060". The first call
+// publishes DefaultMetrics as the expvar variable "ransuq".
+func ServeMetrics(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	publishMetrics.Do(func() {
+		expvar.Publish("ransuq", expvar.Func(func() interface{} {
+			return DefaultMetrics.Stats()
+		}))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(l, mux)
+	return l, nil
+}
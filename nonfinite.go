@@ -0,0 +1,255 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonum/matrix/mat64"
+	"github.com/reggo/reggo/common"
+)
+
+// NonFinitePolicy is what is done with NaN and infinite values in the loaded
+// data.
+type NonFinitePolicy int
+
+const (
+	// The load fails with a NonFiniteError
+	NonFiniteFail NonFinitePolicy = iota
+
+	// Rows with a non-finite value are removed
+	NonFiniteDrop
+
+	// There is no value to replace NaN with, so rows with NaN are removed.
+	// Infinite values are replaced by the largest or smallest finite value of
+	// the feature in the remaining rows. The load fails if a feature with
+	// infinite values has no finite values there.
+	NonFiniteClamp
+)
+
+func (p NonFinitePolicy) String() string {
+	switch p {
+	case NonFiniteFail:
+		return "fail"
+	case NonFiniteDrop:
+		return "drop"
+	case NonFiniteClamp:
+		return "clamp"
+	}
+	return fmt.Sprintf("NonFinitePolicy(%d)", int(p))
+}
+
+// DefaultNonFinitePolicy is the policy of the package-level load functions,
+// such as LoadData and DenseLoadAll. A Loader or the NonFinite field of
+// Settings sets the policy of a single load or case.
+var DefaultNonFinitePolicy = NonFiniteFail
+
+// maxNonFiniteSamples is the number of rows listed for each feature in a
+// NonFiniteReport.
+const maxNonFiniteSamples = 5
+
+// NonFiniteReport lists the non-finite values found in a dataset.
+type NonFiniteReport struct {
+	Dataset  string
+	Rows     int // Rows with at least one non-finite value
+	Features []NonFiniteCount
+}
+
+// NonFiniteCount is the number of non-finite values of one feature.
+type NonFiniteCount struct {
+	Feature string
+	NaN     int
+	PosInf  int
+	NegInf  int
+	Samples []int // The first rows with a non-finite value
+}
+
+func (r NonFiniteReport) String() string {
+	strs := make([]string, len(r.Features))
+	for i, f := range r.Features {
+		var counts []string
+		for _, c := range []struct {
+			n    int
+			kind string
+		}{{f.NaN, "NaN"}, {f.PosInf, "+Inf"}, {f.NegInf, "-Inf"}} {
+			if c.n != 0 {
+				counts = append(counts, fmt.Sprintf("%v %v", c.n, c.kind))
+			}
+		}
+		strs[i] = fmt.Sprintf("%v: %v (rows %v)", f.Feature, strings.Join(counts, ", "), f.Samples)
+	}
+	return fmt.Sprintf("%v: %v rows with non-finite values. %v", r.Dataset, r.Rows, strings.Join(strs, "; "))
+}
+
+// NonFiniteFilename returns the file storing the NonFiniteReports of the
+// training data of the algorithm trained in savepath. The file only exists if
+// rows of the training data were dropped or clamped.
+func NonFiniteFilename(savepath string) string {
+	return filepath.Join(PredictorDirectory(savepath), "nonfinite.json")
+}
+
+// saveNonFinite writes the reports to the file, or removes the file if there
+// are no reports.
+func saveNonFinite(reports []NonFiniteReport, filename string) error {
+	if len(reports) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.MarshalIndent(reports, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// LoadNonFinite reads the NonFiniteReports of the training data of the
+// algorithm trained in savepath. There are none if no rows were dropped or
+// clamped.
+func LoadNonFinite(savepath string) ([]NonFiniteReport, error) {
+	b, err := ioutil.ReadFile(NonFiniteFilename(savepath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reports []NonFiniteReport
+	err = json.Unmarshal(b, &reports)
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// NonFiniteError is the error of loading a dataset with non-finite values
+// under NonFiniteFail.
+type NonFiniteError struct {
+	NonFiniteReport
+}
+
+func (n NonFiniteError) Error() string {
+	return n.NonFiniteReport.String()
+}
+
+// checkFinite applies the policy to the data loaded from the dataset and
+// returns the report of the non-finite values. The data are returned
+// unchanged, with an empty report, if they are all finite.
+func checkFinite(id string, features []string, data common.RowMatrix, policy NonFinitePolicy) (common.RowMatrix, NonFiniteReport, error) {
+	nRows, nCols := data.Dims()
+	report := NonFiniteReport{Dataset: id}
+	counts := make([]NonFiniteCount, nCols)
+	bad := make([]bool, nRows)
+	hasNaN := make([]bool, nRows)
+	for i := 0; i < nRows; i++ {
+		for j := 0; j < nCols; j++ {
+			v := data.At(i, j)
+			c := &counts[j]
+			switch {
+			case math.IsNaN(v):
+				c.NaN++
+				hasNaN[i] = true
+			case math.IsInf(v, 1):
+				c.PosInf++
+			case math.IsInf(v, -1):
+				c.NegInf++
+			default:
+				continue
+			}
+			if len(c.Samples) < maxNonFiniteSamples {
+				c.Samples = append(c.Samples, i)
+			}
+			bad[i] = true
+		}
+		if bad[i] {
+			report.Rows++
+		}
+	}
+	if report.Rows == 0 {
+		return data, report, nil
+	}
+	for j, c := range counts {
+		if c.NaN+c.PosInf+c.NegInf != 0 {
+			c.Feature = features[j]
+			report.Features = append(report.Features, c)
+		}
+	}
+
+	var drop []bool
+	switch policy {
+	default:
+		return nil, report, fmt.Errorf("unknown non-finite policy %v", policy)
+	case NonFiniteFail:
+		return nil, report, NonFiniteError{report}
+	case NonFiniteDrop:
+		Infof("dropping rows. %v", report)
+		drop = bad
+	case NonFiniteClamp:
+		Infof("clamping infinite values and dropping rows with NaN. %v", report)
+		drop = hasNaN
+	}
+
+	// Columns with infinite values are clamped to their finite range over the
+	// rows which are kept. A column with no finite values has no range to
+	// clamp to.
+	lo := make([]float64, nCols)
+	hi := make([]float64, nCols)
+	if policy == NonFiniteClamp {
+		clamped := make([]bool, nCols)
+		for j := range lo {
+			lo[j], hi[j] = math.Inf(1), math.Inf(-1)
+		}
+		for i := 0; i < nRows; i++ {
+			if drop[i] {
+				continue
+			}
+			for j := 0; j < nCols; j++ {
+				v := data.At(i, j)
+				if math.IsInf(v, 0) {
+					clamped[j] = true
+					continue
+				}
+				lo[j] = math.Min(lo[j], v)
+				hi[j] = math.Max(hi[j], v)
+			}
+		}
+		for j := range clamped {
+			if clamped[j] && lo[j] > hi[j] {
+				return nil, report, fmt.Errorf("%v: cannot clamp feature %v, it has no finite values", id, features[j])
+			}
+		}
+	}
+
+	var n int
+	for i := range drop {
+		if !drop[i] {
+			n++
+		}
+	}
+	clean := mat64.NewDense(n, nCols, nil)
+	var r int
+	for i := 0; i < nRows; i++ {
+		if drop[i] {
+			continue
+		}
+		row := clean.RawRowView(r)
+		for j := range row {
+			v := data.At(i, j)
+			switch {
+			case math.IsInf(v, 1):
+				v = hi[j]
+			case math.IsInf(v, -1):
+				v = lo[j]
+			}
+			row[j] = v
+		}
+		r++
+	}
+	return clean, report, nil
+}
@@ -0,0 +1,160 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// StatusPending is the status of a planned job which still needs to be run.
+const StatusPending Status = "pending"
+
+// PlanNode is one job in the plan for running a set of cases.
+type PlanNode struct {
+	Phase  Phase
+	ID     string
+	Status Status   // StatusPending or StatusCached
+	Deps   []string `json:",omitempty"` // Keys of the jobs this job depends on
+	Cases  []int    // Indices of the cases which need this job
+}
+
+// Key returns the unique identifier of the node in the plan.
+func (n *PlanNode) Key() string {
+	return string(n.Phase) + ":" + n.ID
+}
+
+// Plan is the graph of jobs needed to run a set of cases. It is constructed
+// without running anything.
+type Plan struct {
+	Nodes []*PlanNode
+}
+
+// PlanSummary counts the pending and cached jobs of each phase.
+type PlanSummary struct {
+	PendingData        int
+	CachedData         int
+	PendingTraining    int
+	CachedTraining     int
+	PendingComparisons int
+	CachedComparisons  int
+	Postprocess        int
+}
+
+func (s PlanSummary) String() string {
+	return fmt.Sprintf("data generation: %v pending, %v cached\n"+
+		"training: %v pending, %v cached\n"+
+		"comparisons: %v pending, %v cached\n"+
+		"postprocess: %v",
+		s.PendingData, s.CachedData,
+		s.PendingTraining, s.CachedTraining,
+		s.PendingComparisons, s.CachedComparisons,
+		s.Postprocess)
+}
+
+// NewPlan builds the graph of jobs that MultiTurb would run for the cases
+// without running any of them. A job is cached if its Cached function says its
+// work is already done. Nothing is written while planning.
+func NewPlan(runs []*Settings) *Plan {
+	p := &Pipeline{}
+	return p.Plan(runs)
+}
+
+// Plan builds the graph of jobs that the pipeline would run for the cases, as
+// in NewPlan.
+func (pipe *Pipeline) Plan(runs []*Settings) *Plan {
+	graph, cases := buildGraph(runs, newPhaseSelection(pipe.Phases))
+	p := &Plan{}
+	nodes := make(map[*Job]*PlanNode)
+	for _, job := range graph.Jobs() {
+		node := &PlanNode{
+			Phase:  job.Phase,
+			ID:     job.ID,
+			Status: StatusPending,
+		}
+		if job.Cached != nil && job.Cached() {
+			node.Status = StatusCached
+		}
+		for _, dep := range job.Deps {
+			node.Deps = append(node.Deps, dep.Key())
+		}
+		nodes[job] = node
+		p.Nodes = append(p.Nodes, node)
+	}
+	for i, c := range cases {
+		for _, job := range c.jobs {
+			nodes[job].Cases = append(nodes[job].Cases, i)
+		}
+	}
+	return p
+}
+
+// Summary counts the jobs in the plan.
+func (p *Plan) Summary() PlanSummary {
+	var s PlanSummary
+	for _, node := range p.Nodes {
+		pending := node.Status == StatusPending
+		switch node.Phase {
+		case PhaseGenerate:
+			if pending {
+				s.PendingData++
+			} else {
+				s.CachedData++
+			}
+		case PhaseTrain:
+			if pending {
+				s.PendingTraining++
+			} else {
+				s.CachedTraining++
+			}
+		case PhaseCompare:
+			if pending {
+				s.PendingComparisons++
+			} else {
+				s.CachedComparisons++
+			}
+		case PhasePostprocess:
+			s.Postprocess++
+		}
+	}
+	return s
+}
+
+// WriteJSON writes the plan as JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// WriteDOT writes the plan as a Graphviz digraph. Pending jobs are filled.
+func (p *Plan) WriteDOT(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "digraph ransuq {\n\trankdir=LR;")
+	if err != nil {
+		return err
+	}
+	for _, node := range p.Nodes {
+		color := "lightgrey"
+		if node.Status == StatusPending {
+			color = "lightblue"
+		}
+		label := string(node.Phase) + "\n" + filepath.Base(node.ID)
+		_, err = fmt.Fprintf(w, "\t%q [label=%q, shape=box, style=filled, fillcolor=%v];\n", node.Key(), label, color)
+		if err != nil {
+			return err
+		}
+	}
+	for _, node := range p.Nodes {
+		for _, dep := range node.Deps {
+			_, err = fmt.Fprintf(w, "\t%q -> %q;\n", dep, node.Key())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
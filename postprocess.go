@@ -1,7 +1,6 @@
 package ransuq
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -11,7 +10,6 @@ import (
 	"github.com/gonum/plot/vg"
 	"github.com/gonum/plot/vg/draw"
 
-	"github.com/gonum/matrix/mat64"
 	"github.com/reggo/reggo/common"
 
 	"github.com/btracey/myplot"
@@ -21,6 +19,10 @@ func pltName(path, subpath, name string) string {
 	return filepath.Join(path, subpath, name)
 }
 
+func plotSaved(file string) {
+	Emit(Event{Kind: EventPlotSaved, File: file})
+}
+
 // path is the path to where the files should be stored
 func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor, inputNames []string, outputNames []string, path string) error {
 	nSamples, inputDim := inputData.Dims()
@@ -66,27 +68,20 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 		}
 	}
 	if allMade {
-		fmt.Println("Postprocessing plots generated")
+		Debugf("postprocessing plots in %v already generated", path)
 		// Note, this skips the 2-D inputs if somehow it was aborted halfway through
 		return nil
 	}
 
 	// Find the predictions at the data
-	pred := mat64.NewDense(nSamples, nOutputs, nil)
-	input := make([]float64, inputDim)
-	for i := 0; i < nSamples; i++ {
-		output := pred.RawRowView(i)
-		inputData.Row(input, i)
-
-		_, err := sp.Predict(input, output)
-		if err != nil {
-			return err
-		}
+	pred, err := predictAll(inputData, sp, nOutputs)
+	if err != nil {
+		return err
 	}
 
 	pltMul := vg.Length(4.0)
 
-	err := os.MkdirAll(path, 0700)
+	err = os.MkdirAll(path, 0700)
 	if err != nil {
 		return err
 	}
@@ -110,6 +105,7 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 		if err != nil {
 			return err
 		}
+		plotSaved(filepath.Join(path, name))
 	}
 
 	// Histograms of output data
@@ -131,6 +127,7 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 		if err != nil {
 			return err
 		}
+		plotSaved(filepath.Join(path, name))
 	}
 
 	// Now, make the plots comparing the predictions
@@ -173,32 +170,22 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 		plt.Title.Text = "Prediction vs. Truth for " + name
 
 		err = plt.Save(4*vg.Inch*pltMul, 4*vg.Inch*pltMul, direct)
-		fmt.Println("filename", direct)
-		fmt.Println(err)
 		if err != nil {
-			fmt.Println("returning")
 			return err
 		}
-		fmt.Println("saved 2 plot")
+		plotSaved(direct)
 
 		errPlt, err := plot.New()
 		if err != nil {
-			fmt.Println("er plt nil: ")
-			fmt.Println("err plt: ", err)
 			return err
 		}
-		fmt.Println("gen err plt")
 
 		errScatter, err := plotter.NewScatter(errPts)
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("created err scatt")
-
 		errPlt.Add(errScatter)
-
-		fmt.Println("added err scatt")
 		//plt.Title.Text = title
 		plt.X.Label.Text = "True value of " + name
 		plt.Y.Label.Text = "Difference in predicted value of " + name
@@ -208,10 +195,9 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 
 		err = errPlt.Save(4*vg.Inch*pltMul, 4*vg.Inch*pltMul, indirect)
 		if err != nil {
-			fmt.Println("Error saving errPLts")
 			return err
 		}
-		fmt.Println("saved error plot")
+		plotSaved(indirect)
 
 		if inputDim == 2 {
 			// Make a contour plot if the data is 2-D
@@ -261,6 +247,7 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 			if err != nil {
 				return err
 			}
+			plotSaved(contourErr)
 
 			scatFun.GlyphStyle.Radius = 0.01 * pltMul * vg.Centimeter
 			scatFun.GlyphStyle.Shape = draw.CircleGlyph{}
@@ -269,17 +256,41 @@ func makeComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor,
 			if err != nil {
 				return err
 			}
+			plotSaved(contourFun)
 
 		}
 	}
 	return nil
 }
 
-func postprocess(sp ScalePredictor, settings *Settings) error {
+// makeFingerprintedComparisons makes the comparison plots in path, first
+// removing any plots made with a different fingerprint. If redo is true, the
+// existing plots are always removed.
+func makeFingerprintedComparisons(inputData, outputData common.RowMatrix, sp ScalePredictor, settings *Settings, path string, fingerprint *Fingerprint, redo bool) error {
+	var err error
+	if redo {
+		err = os.RemoveAll(path)
+	} else {
+		err = removeStalePlots(path, fingerprint)
+	}
+	if err != nil {
+		return err
+	}
+	err = makeComparisons(inputData, outputData, sp, settings.InputFeatures, settings.OutputFeatures, path)
+	if err != nil {
+		return err
+	}
+	return fingerprint.Save(path)
+}
+
+// postprocess plots the predictions of the trained algorithm on the training
+// and testing data. If redo is true, existing plots are made again.
+func postprocess(sp ScalePredictor, settings *Settings, redo bool) error {
 
 	wg := &sync.WaitGroup{}
 
 	trainingErr := make(ErrorList, len(settings.TrainingData))
+	loader := settings.loader()
 
 	basepath := filepath.Join(settings.Savepath, "postprocess")
 
@@ -287,16 +298,15 @@ func postprocess(sp ScalePredictor, settings *Settings) error {
 	for i := 0; i < len(settings.TrainingData); i++ {
 		wg.Add(1)
 		go func(i int) {
-			fmt.Println("Starting training postprocess ", i)
 			defer wg.Done()
-			inputs, outputs, _, err := LoadData(settings.TrainingData[i], DenseLoad, settings.InputFeatures, settings.OutputFeatures, nil)
+			inputs, outputs, _, err := loader.LoadData(settings.TrainingData[i], settings.LoadStyle, settings.InputFeatures, settings.OutputFeatures, nil)
 			if err != nil {
 				trainingErr[i] = err
 				return
 			}
 			savepath := filepath.Join(basepath, settings.TrainingData[i].ID())
-			trainingErr[i] = makeComparisons(inputs, outputs, sp, settings.InputFeatures, settings.OutputFeatures, savepath)
-			fmt.Println("training err ", trainingErr[i])
+			trainingErr[i] = makeFingerprintedComparisons(inputs, outputs, sp, settings, savepath,
+				comparisonFingerprint(settings, settings.TrainingData[i]), redo)
 		}(i)
 	}
 
@@ -306,35 +316,49 @@ func postprocess(sp ScalePredictor, settings *Settings) error {
 
 	testingErr := make(ErrorList, len(settings.TestingData))
 
+	// Algorithms trained before the domain was recorded have no extrapolation
+	// reports.
+	domain, err := LoadInputDomain(settings.Savepath)
+	if err != nil {
+		Infof("not reporting extrapolation: %v", err)
+		domain = nil
+	}
+
 	// Plot the testing comparisons
 	for i := 0; i < len(settings.TestingData); i++ {
 		wg.Add(1)
 		go func(i int) {
-			fmt.Println("Starting testing postprocess ", i)
 			defer wg.Done()
-			inputs, outputs, _, err := LoadData(settings.TestingData[i], DenseLoad, settings.InputFeatures, settings.OutputFeatures, nil)
+			inputs, outputs, _, err := loader.LoadData(settings.TestingData[i], settings.LoadStyle, settings.InputFeatures, settings.OutputFeatures, nil)
 			if err != nil {
 				testingErr[i] = err
-				fmt.Println("testing error loading: ", err)
 				return
 			}
 			savepath := filepath.Join(basepath, settings.TestingData[i].ID())
-			testingErr[i] = makeComparisons(inputs, outputs, sp, settings.InputFeatures, settings.OutputFeatures, savepath)
-			if testingErr[i] != nil {
-				fmt.Println("testing postprocess error: ", i, err)
+			testingErr[i] = makeFingerprintedComparisons(inputs, outputs, sp, settings, savepath,
+				comparisonFingerprint(settings, settings.TestingData[i]), redo)
+			if testingErr[i] != nil || domain == nil {
+				return
 			}
+			testingErr[i] = makeExtrapolationReport(settings.TestingData[i].ID(), inputs, outputs, sp, domain,
+				settings.OutputFeatures, savepath)
 		}(i)
 	}
 	wg.Wait()
 
+	// Summarize the distributions of the data and the shift from training to
+	// testing.
+	statsErr := saveStats(settings, filepath.Join(basepath, "stats"), redo)
+
 	noTestErr := trainingErr.AllNil()
 	noTrainErr := testingErr.AllNil()
 
-	if noTestErr && noTrainErr {
+	if noTestErr && noTrainErr && statsErr == nil {
 		return nil
 	}
 	return PostprocessError{
 		Training: trainingErr,
 		Testing:  testingErr,
+		Stats:    statsErr,
 	}
 }
@@ -29,15 +29,6 @@ func init() {
 }
 */
 
-var gopath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		panic("gopath not set")
-	}
-}
-
 func main() {
 	//rand.Seed(time.Now().UnixNano())     // Set the random number seed
 	runtime.GOMAXPROCS(runtime.NumCPU()) // Set the number of processors to use
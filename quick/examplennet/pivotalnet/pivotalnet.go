@@ -11,6 +11,7 @@ import (
 
 	"github.com/btracey/numcsv"
 	"github.com/btracey/opt/multivariate"
+	"github.com/btracey/ransuq/settings"
 	"github.com/gonum/blas/dbw"
 	"github.com/gonum/blas/goblas"
 	"github.com/gonum/matrix/mat64"
@@ -26,21 +27,16 @@ func init() {
 	dbw.Register(goblas.Blas{})
 }
 
-var gopath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		panic("gopath not set")
-	}
-}
-
 func main() {
 	rand.Seed(time.Now().UnixNano())     // Set the random number seed
 	runtime.GOMAXPROCS(runtime.NumCPU()) // Set the number of processors to use
 
 	//filename := "exp4_training_800k.txt"
-	filename := filepath.Join(gopath, "data", "ransuq", "HiFi", "exp4.txt")
+	config, err := settings.DefaultConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	filename := filepath.Join(config.DataRoot, "HiFi", "exp4.txt")
 
 	// Open the data file
 	f, err := os.Open(filename)
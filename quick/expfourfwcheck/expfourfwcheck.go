@@ -12,20 +12,16 @@ import (
 
 	"github.com/btracey/numcsv"
 	"github.com/btracey/ransuq/internal/util"
+	"github.com/btracey/ransuq/settings"
 	"github.com/btracey/turbulence/sa"
 )
 
-var gopath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		panic("gopath not set")
-	}
-}
-
 func main() {
-	filename := filepath.Join(gopath, "data", "ransuq", "HiFi", "exp4_mod.txt")
+	config, err := settings.DefaultConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	filename := filepath.Join(config.DataRoot, "HiFi", "exp4_mod.txt")
 	f, err := os.Open(filename)
 	if err != nil {
 		log.Fatal(err)
@@ -17,19 +17,8 @@ import (
 	"github.com/gonum/matrix/mat64"
 )
 
-var (
-	gopath   string
-	basepath string
-)
-
 func init() {
 	mat64.Register(goblas.Blas{})
-
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		log.Fatal("no gopath")
-	}
-	basepath = filepath.Join(gopath, "results", "ransuq", "sanondim")
 }
 
 var inputFeatures = []string{
@@ -64,6 +53,11 @@ var (
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU() - 2)
+	config, err := settings.DefaultConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	basepath := filepath.Join(config.ResultsRoot, "sanondim")
 	// Set this up for a loop of datasets. Need to fix plotting places.
 
 	datasetStrs := []string{
@@ -77,7 +71,7 @@ func main() {
 		//wg.Done()
 		// Load data
 
-		datasets, err := settings.GetDatasets(setname, driver.Serial{})
+		datasets, err := config.GetDatasets(setname, driver.Serial{})
 		if err != nil {
 			log.Fatal(err)
 		}
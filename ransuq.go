@@ -1,15 +1,15 @@
 package ransuq
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
-	"sync"
+	"runtime/debug"
+	"time"
 )
 
 type GenerationError struct {
@@ -47,390 +47,429 @@ type GenerateFinished struct {
 	Err error
 }
 
-type DatasetFinished struct {
-	Dataset
-	Err error
-}
-
 type GeneratableIO struct {
 	In  chan Generatable
 	Out chan GenerateFinished
 }
 
-type DatasetRunner struct {
-	compute chan Generatable
-	done    chan GenerateFinished
-
-	norun chan Dataset // For datasets that don't need to be run off externally
+// trackedGeneratable wraps a Generatable so that it is not run if the context
+// has been cancelled by the time the scheduler gets to it. It records when the
+// Generatable ran, and turns a panic during the run into an error.
+type trackedGeneratable struct {
+	Generatable
+	ctx     context.Context
+	metrics *SchedulerMetrics // Records the scheduler events of the Generatable if not nil
+	start   time.Time
+	end     time.Time
 }
 
-func NewDatasetRunner(compute chan Generatable, done chan GenerateFinished) *DatasetRunner {
-	return &DatasetRunner{
-		compute: compute,
-		done:    done,
-		norun:   make(chan Dataset),
-	}
+func newTracked(g Generatable, ctx context.Context) *trackedGeneratable {
+	return &trackedGeneratable{Generatable: g, ctx: ctx}
 }
 
-// Send sends the dataset out to be computed. Blocks until the send can happen
-func (d *DatasetRunner) Compute(dataset Dataset) {
-	// First, check if the data is actually a generatable
-	generatable, ok := dataset.(Generatable)
-	if !ok {
-		id := dataset.ID()
-		// Data was not a generatable. Record that that was so, and send it
-		// as completed
-		log.Printf("%v is not a generatable. Sending completion notice.", id)
-		d.norun <- dataset
-		return
-	}
-	// It is a generatable, but it may be have already been generated. If so,
-	// mark it as completed
-	if generatable.Generated() {
-		id := dataset.ID()
-		log.Printf("%v has already been generated. Sending completion notice", id)
-		d.norun <- dataset
-		return
-	}
-
-	// Otherwise, send it to be generated
-	log.Printf("%v not computed, sending to be generated", dataset.ID())
-
-	d.compute <- generatable
+func (t *trackedGeneratable) Run() error {
+	return t.RunContext(t.ctx)
 }
 
-// Done returns a dataset that is completed. Blocks until a dataset has been completed
-func (d *DatasetRunner) Done() DatasetFinished {
-	select {
-	case data := <-d.norun:
-		log.Printf("%v received without being generated", data.ID())
-		return DatasetFinished{
-			Dataset: data,
-			Err:     nil,
+// RunContext runs the Generatable with a context derived from the one it was
+// tracked with, such as one with a timeout.
+func (t *trackedGeneratable) RunContext(ctx context.Context) error {
+	return t.runWith(ctx, func(ctx context.Context) error {
+		if r, ok := t.Generatable.(ContextRunner); ok {
+			return r.RunContext(ctx)
 		}
-	case run := <-d.done:
-		log.Printf("%v finished generating", run.Generatable.(Dataset).ID())
-		return DatasetFinished{
-			Dataset: run.Generatable.(Dataset),
-			Err:     run.Err,
+		return t.Generatable.Run()
+	})
+}
+
+// runWith records the times of calling run in place of the Generatable, such
+// as to run it in another process.
+func (t *trackedGeneratable) runWith(ctx context.Context, run func(context.Context) error) (err error) {
+	if ctx.Err() != nil {
+		return ErrSkipped
+	}
+	t.start = time.Now()
+	defer func() {
+		t.end = time.Now()
+		if r := recover(); r != nil {
+			err = PanicError{Value: r, Stack: debug.Stack()}
 		}
+	}()
+	return run(ctx)
+}
+
+// unwrapGeneratable returns the Generatable that was wrapped before being sent
+// to the scheduler, and the times it started and stopped running. The times
+// are zero if it did not run.
+func unwrapGeneratable(g Generatable) (gen Generatable, start, end time.Time) {
+	if t, ok := g.(*trackedGeneratable); ok {
+		return t.Generatable, t.start, t.end
 	}
+	return g, time.Time{}, time.Time{}
 }
 
-// MultiTurb runs a list of cases
+// MultiTurb runs a list of cases. It returns a report of what was run and the
+// error for each case. The report is also saved in the Savepath of the case.
 // TODO: Needs to be some form of cluster calls
-func MultiTurb(runs []*Settings, scheduler Scheduler) []error {
+func MultiTurb(runs []*Settings, scheduler Scheduler) ([]*RunReport, []error) {
+	return MultiTurbContext(context.Background(), runs, scheduler)
+}
+
+// MultiTurbContext runs a list of cases until they are finished or the context
+// is cancelled. Once the context is cancelled no new Generatables are sent to
+// the scheduler. Jobs which are already running finish, unless they implement
+// ContextRunner in which case they are told to stop. MultiTurbContext does not
+// return until all running jobs have returned. The error for a case that did
+// not finish is a SkippedError listing the jobs that were not run, or an
+// ErrorList ending with the SkippedError if other jobs of the case failed.
+func MultiTurbContext(ctx context.Context, runs []*Settings, scheduler Scheduler) ([]*RunReport, []error) {
+	p := &Pipeline{Scheduler: scheduler}
+	return p.Run(ctx, runs)
+}
+
+// Pipeline runs settings cases on a scheduler. The zero value of each option
+// gives the behavior of MultiTurb.
+type Pipeline struct {
+	Scheduler Scheduler
+	Retry     RetryPolicy // How failed Generatables are run again
+
+	// Phases, if not empty, are the phases to run. The selected phases are
+	// run again even if their results exist, and the other phases reuse
+	// existing results, failing with a MissingError if there are none. If
+	// Phases is empty every phase is run, reusing results that are up to date.
+	Phases []Phase
+}
+
+// Run runs the cases as in MultiTurbContext using the options of the pipeline.
+func (p *Pipeline) Run(ctx context.Context, runs []*Settings) ([]*RunReport, []error) {
+	scheduler := p.Scheduler
 	scheduler.Launch()
 
-	physicalDataCompute := make(chan Generatable)
-	physicalDataDone := make(chan GenerateFinished)
-
-	scheduler.AddChannel(GeneratableIO{In: physicalDataCompute, Out: physicalDataDone})
-
-	fmt.Println("runs = ", runs)
-	// Get the unique data
-	idToIdx, uniqueDatasets, isTraining, learners := uniqueDatasets(runs)
-	_ = idToIdx
-	_ = isTraining
-	fmt.Println("learners =", learners)
-	fmt.Println("uniquedata =", uniqueDatasets)
-	fmt.Println("istraining=", isTraining)
-
-	// Compute all of the physical data
-	datasetRunner := NewDatasetRunner(physicalDataCompute, physicalDataDone)
-
-	fmt.Println("unique datasets", uniqueDatasets)
-	for _, datataset := range uniqueDatasets {
-		go func(dataset Dataset) {
-			datasetRunner.Compute(dataset)
-		}(datataset)
+	graph, cases := buildGraph(runs, newPhaseSelection(p.Phases))
+	graph.Retry = p.Retry
+	graph.Metrics = NewSchedulerMetrics()
+	graph.Run(ctx, scheduler)
+	Infof("scheduler: %v", graph.Metrics.Stats())
+
+	errs := make([]error, len(runs))
+	reports := make([]*RunReport, len(runs))
+	for i, c := range cases {
+		errs[i] = c.err()
+		reports[i] = c.report(errs[i])
+		err := reports[i].Save()
+		if err != nil {
+			Infof("error saving report for case %v: %v", i, err)
+		}
 	}
+	return reports, errs
+}
 
-	mlChan := make(chan *mlRunData)
-	allDoneChan := make(chan *learner)
-	// Launch goroutine to read in training data as they come in and
-	go func() {
-		mlStarted := make([]bool, len(learners))
-
-		stillRunning := make(map[int]struct{})
-		for i := range learners {
-			stillRunning[i] = struct{}{}
+// caseJobs are the jobs in the graph needed by one settings case.
+type caseJobs struct {
+	*Settings
+	start time.Time
+	jobs  []*Job
+}
+
+// err returns the error for the case. It is an ErrorList of the jobs that
+// failed, not counting those which failed because a dependency failed. If any
+// of the jobs were skipped, a SkippedError is added to the list, or returned
+// alone if no job failed.
+func (c *caseJobs) err() error {
+	var skipped []string
+	var errs ErrorList
+	for _, job := range c.jobs {
+		switch job.Result.Status {
+		case StatusSkipped:
+			skipped = append(skipped, job.ID)
+		case StatusFailed:
+			if _, ok := job.Result.Err.(DependencyError); ok {
+				continue
+			}
+			errs = append(errs, JobError{Phase: job.Phase, ID: job.ID, Err: job.Result.Err})
 		}
-		fmt.Println("Still Running = ", stillRunning)
-
-		for i := 0; i < len(uniqueDatasets); i++ {
-			run := datasetRunner.Done()
-			fmt.Println("Still Running", stillRunning)
-			for idx := range stillRunning {
-				learners[idx].RegisterCompletion(run)
-
-				if !mlStarted[idx] && learners[idx].AllTrainDone() {
-					log.Printf("Settings case %v sent to training", idx)
-					mlChan <- &mlRunData{Settings: learners[idx].Settings, trainErr: learners[idx].trainErrs, learningErr: nil}
-					mlStarted[idx] = true
-				}
-				if learners[idx].AllTrainDone() && learners[idx].AllTestDone() {
-					log.Printf("Settings case %v all data generated\n", idx)
-					fmt.Printf("learner case %v: %v\n", idx, learners[idx])
-					allDoneChan <- learners[idx]
-					delete(stillRunning, idx)
+	}
+	if len(skipped) != 0 {
+		if len(errs) == 0 {
+			return SkippedError{Skipped: skipped}
+		}
+		errs = append(errs, SkippedError{Skipped: skipped})
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *caseJobs) report(err error) *RunReport {
+	r := newRunReport(c.Settings)
+	r.Start = c.start
+	for _, job := range c.jobs {
+		r.add(job.report())
+	}
+	nonFinite, loadErr := LoadNonFinite(c.Savepath)
+	if loadErr != nil {
+		Infof("%v: not reporting non-finite values: %v", c.Savepath, loadErr)
+	}
+	r.NonFinite = nonFinite
+	r.finish(err)
+	return r
+}
+
+// buildGraph constructs the jobs needed to run the cases. Datasets used by
+// several cases are only generated once. For each case, training depends on the
+// training data, each comparison depends on the training and its testing
+// dataset, and the postprocessing depends on the training and all of the data.
+func buildGraph(runs []*Settings, sel phaseSelection) (*Graph, []*caseJobs) {
+	graph := NewGraph()
+	cases := make([]*caseJobs, len(runs))
+	now := time.Now()
+	for i, set := range runs {
+		c := &caseJobs{Settings: set, start: now}
+		cases[i] = c
+
+		// Add the dataset jobs, only listing each dataset once for the case.
+		datasetJob := func(dataset Dataset) *Job {
+			job := graph.Add(newDatasetJob(dataset, sel))
+			for _, j := range c.jobs {
+				if j == job {
+					return job
 				}
 			}
+			c.jobs = append(c.jobs, job)
+			return job
 		}
-		if len(stillRunning) != 0 {
-			panic("Cases still running after data generated")
+		trainData := make([]*Job, len(set.TrainingData))
+		for j, dataset := range set.TrainingData {
+			trainData[j] = datasetJob(dataset)
+		}
+		testData := make([]*Job, len(set.TestingData))
+		for j, dataset := range set.TestingData {
+			testData[j] = datasetJob(dataset)
 		}
-		close(mlChan)
-		fmt.Println("Launching goroutine returned\n")
-		// close(allDoneChan) // Don't need to close, will be garbage collected
-		return
-	}()
-
-	//trainingCompleteChan := make(chan mlRunData)
-
-	//doneTraining := make(chan bool)
-	//doneGenTesting := make(chan bool)
 
-	mlRunner := newMlRunner(scheduler)
+		train := graph.Add(newTrainingJob(set, trainData, sel))
+		c.jobs = append(c.jobs, train)
 
-	// Channel for returning ML results. This could be done better.
-	mlDone := make(chan *mlRunData)
+		for j, dataset := range set.TestingData {
+			comp, ok := dataset.(Comparable)
+			if !ok {
+				continue
+			}
+			job := graph.Add(newComparisonJob(set, dataset, comp, train, testData[j], sel))
+			c.jobs = append(c.jobs, job)
+		}
 
-	//mlCtr := &mlRunningCounter{}
+		deps := append([]*Job{train}, trainData...)
+		deps = append(deps, testData...)
+		post := graph.Add(newPostprocessJob(set, deps, sel))
+		c.jobs = append(c.jobs, post)
+	}
+	return graph, cases
+}
 
-	// Read the ml runs that are coming in, and launch the training code
-	go func() {
-		for ml := range mlChan {
-			// See if there are any training errors. If there are, skip the compute
-			// process.
-			var sent bool
-			for _, err := range ml.trainErr {
+// newDatasetJob returns a job which generates the dataset if it is a
+// Generatable that has not yet been generated.
+func newDatasetJob(dataset Dataset, sel phaseSelection) *Job {
+	gen, isGen := dataset.(Generatable)
+	return &Job{
+		Phase: PhaseGenerate,
+		ID:    dataset.ID(),
+		Run: func(submit SubmitFunc) ([]string, error) {
+			if !isGen {
+				return artifactsOf(dataset), nil
+			}
+			switch {
+			case sel.redo(PhaseGenerate) || (sel.selected(PhaseGenerate) && !gen.Generated()):
+				err := submit(gen)
 				if err != nil {
-					ml.learningErr = errors.New("error training")
-					mlDone <- ml
-					sent = true
-					break
+					return nil, err
 				}
+			case !sel.selected(PhaseGenerate) && !gen.Generated():
+				return nil, MissingError{Phase: PhaseGenerate, ID: dataset.ID()}
 			}
-			if sent {
-				continue
+			return artifactsOf(dataset), nil
+		},
+		Cached: func() bool {
+			return !isGen || (!sel.redo(PhaseGenerate) && gen.Generated())
+		},
+	}
+}
+
+// newTrainingJob returns a job which trains the algorithm unless it has been
+// trained already.
+func newTrainingJob(set *Settings, trainData []*Job, sel phaseSelection) *Job {
+	ml := &mlRunData{Settings: set}
+	return &Job{
+		Phase: PhaseTrain,
+		ID:    ml.ID(),
+		Deps:  trainData,
+		Run: func(submit SubmitFunc) ([]string, error) {
+			switch {
+			case sel.redo(PhaseTrain) || (sel.selected(PhaseTrain) && !ml.Generated()):
+				err := submit(ml)
+				if err != nil {
+					return nil, err
+				}
+			case !sel.selected(PhaseTrain):
+				if !ml.trained() {
+					return nil, MissingError{Phase: PhaseTrain, ID: ml.ID()}
+				}
+				if !ml.Generated() {
+					Infof("%v: reusing the trained algorithm since training is not selected", ml.ID())
+				}
 			}
-
-			go func(ml *mlRunData) {
-				mlRunner.Compute(ml)
-				// Might not be the same one, but this at least guarantees that
-				// the same number are sent and received.
-				// TODO: This should be better with channel close. Need to improve
-				// the scheduler
-				// The way to do this is to have a "NewJobAllocator" or something
-				// which returns a send only channel (for running jobs) and a
-				// read-only channel for reading the results back in. Then, it's easy
-				// to count the jobs right. The only trick is dealing with close, but
-				// this is probably up to the user to ensure they aren't all closed before
-				// they are sent and received ( like a normal single channel would)
-			}(ml)
-
-			// ... and this shows why we have a bad approach right now
-			go func() {
-				mlDone <- mlRunner.Done()
-			}()
-		}
-		fmt.Println("ml run chan returned \n")
-	}()
-
-	// Channel for communicating everything is done
-	finished := make(chan struct{})
-
-	go func() {
-		var sent int
-		mlDoneMap := make(map[string]*mlRunData)
-		testDoneMap := make(map[string]*learner)
-		for {
-			var newID string
-			select {
-			case mlRun := <-mlDone:
-				newID = mlRun.ID()
-				// Add the ID to the mlDoneMap
-				mlDoneMap[newID] = mlRun
-
-			case testDone := <-allDoneChan:
-				// Add the ID to the testDoneMap
-				fmt.Println("testDone = ", testDone)
-				fakeMlRun := &mlRunData{Settings: testDone.Settings}
-				newID = fakeMlRun.ID()
-				testDoneMap[newID] = testDone
+			return ml.Artifacts(), nil
+		},
+		Cached: func() bool {
+			return !sel.redo(PhaseTrain) && ml.Generated()
+		},
+	}
+}
+
+// newComparisonJob returns a job which runs the comparison of the trained
+// algorithm on the testing dataset and then post-processes the comparison.
+func newComparisonJob(set *Settings, testData Dataset, comp Comparable, train, testDataJob *Job, sel phaseSelection) *Job {
+	outLoc := filepath.Join(set.Savepath, "comparison")
+	fpDir := filepath.Join(outLoc, testData.ID())
+	ml := &mlRunData{Settings: set}
+	return &Job{
+		Phase: PhaseCompare,
+		ID:    fpDir,
+		Deps:  []*Job{train, testDataJob},
+		Run: func(submit SubmitFunc) ([]string, error) {
+			gen, err := comp.Comparison(PredictorFilename(set.Savepath), outLoc, set.FeatureSet)
+			if err != nil {
+				return nil, err
 			}
-
-			// See if the new returned case is in both maps, and if it is, launch
-			// the post-processing step
-
-			mlRun, mlOk := mlDoneMap[newID]
-			testDone, testOk := testDoneMap[newID]
-
-			if mlOk && testOk {
-				sent++
-				go func(mlRun *mlRunData, testDone *learner, finished chan struct{}) {
-					runPostprocessing(scheduler, mlRun, testDone, finished)
-				}(mlRun, testDone, finished)
-				delete(mlDoneMap, newID)
-				delete(testDoneMap, newID)
-				if sent == len(runs) {
-					fmt.Println("Postprocessing routine returned\n")
-					return
+			fingerprint := comparisonFingerprint(set, testData)
+			switch {
+			case sel.redo(PhaseCompare) || (sel.selected(PhaseCompare) && (!gen.Generated() || !isCurrent(fpDir, fingerprint))):
+				err = submit(gen)
+				if err != nil {
+					return nil, err
 				}
+				err = fingerprint.Save(fpDir)
+				if err != nil {
+					return nil, err
+				}
+			case !sel.selected(PhaseCompare) && !gen.Generated():
+				return nil, MissingError{Phase: PhaseCompare, ID: gen.ID()}
 			}
-
-		}
-	}()
-
-	// Read back that all of the postprocessing has finished
-	for i := 0; i < len(runs); i++ {
-		<-finished
-		fmt.Println("Main routine read from finished. i = ", i)
-	}
-
-	// Lastly, collect the errors.
-	errors := make([]error, len(runs))
-
-	for i := 0; i < len(runs); i++ {
-		errors[i] = learners[i].ReportError()
+			// The comparison plots are made again when only postprocessing
+			// is selected.
+			p, ok := gen.(PostProcessor)
+			if ok && (sel.selected(PhaseCompare) || sel.selected(PhasePostprocess)) {
+				err = p.PostProcess()
+				if err != nil {
+					return nil, err
+				}
+			}
+			return artifactsOf(gen), nil
+		},
+		Cached: func() bool {
+			if sel.redo(PhaseCompare) || !ml.Generated() {
+				return false
+			}
+			gen, err := comp.Comparison(PredictorFilename(set.Savepath), outLoc, set.FeatureSet)
+			if err != nil || !gen.Generated() {
+				return false
+			}
+			return isCurrent(fpDir, comparisonFingerprint(set, testData))
+		},
+	}
+}
+
+// newPostprocessJob returns a job which plots the predictions of the trained
+// algorithm on the training and testing data.
+func newPostprocessJob(set *Settings, deps []*Job, sel phaseSelection) *Job {
+	post := &postprocessRun{Settings: set, redo: sel.redo(PhasePostprocess)}
+	return &Job{
+		Phase: PhasePostprocess,
+		ID:    set.Savepath,
+		Deps:  deps,
+		Run: func(submit SubmitFunc) ([]string, error) {
+			if !sel.selected(PhasePostprocess) {
+				return nil, nil
+			}
+			err := submit(post)
+			if err != nil {
+				return nil, err
+			}
+			return []string{post.ID()}, nil
+		},
 	}
-	return errors
 }
 
-func runPostprocessing(scheduler Scheduler, mlRun *mlRunData, testDone *learner, finished chan struct{}) {
-	// To do post processing, we need to:
-	// 		launch all of the comparison jobs (if any)
-	//		Run all of the post-processing data
-	// These can be done concurrently. Use a waitgroup to synchronize finishing
-
-	// First, check if there was an error, if so, can't do any of the post-processing
-	if mlRun.learningErr != nil {
-		testDone.learningErr = mlRun.learningErr
-		finished <- struct{}{}
-		return
-	}
-
-	wg := sync.WaitGroup{}
-
-	// Launch all of the comparison jobs
-	wg.Add(1)
-	go func() {
-		// Create read and reply channels and add them to the scheduler
-		g := GeneratableIO{make(chan Generatable), make(chan GenerateFinished)}
-		scheduler.AddChannel(g)
+// postprocessRun is the Generatable for the postprocessing of a case.
+type postprocessRun struct {
+	*Settings
+	redo bool // Make plots which already exist again
+}
 
-		var skipped int
-		for _, test := range mlRun.Settings.TestingData {
-			// See if the test data is comparable
-			comp, ok := test.(Comparable)
+func (p *postprocessRun) ID() string {
+	return filepath.Join(p.Settings.Savepath, "postprocess")
+}
 
-			if !ok {
-				fmt.Println("Case skipped")
-				skipped++
-				continue
-			}
+// Generated returns false. The postprocessing checks which plots need to be
+// made when it runs.
+func (p *postprocessRun) Generated() bool {
+	return false
+}
 
-			// If it is, set it up and send it
-			outLoc := filepath.Join(testDone.Settings.Savepath, "comparison")
-			algFile := PredictorFilename(testDone.Settings.Savepath)
+func (p *postprocessRun) NumCores() int {
+	return 1
+}
 
-			gen, err := comp.Comparison(algFile, outLoc, testDone.Settings.FeatureSet)
-			if err != nil {
-				go func() { g.Out <- GenerateFinished{gen, err} }()
-				continue
-			}
+func (p *postprocessRun) Run() error {
+	scalePredictor, err := LoadScalePredictor(p.Settings.Savepath)
+	if err != nil {
+		return err
+	}
+	return postprocess(scalePredictor, p.Settings, p.redo)
+}
 
-			// See if it's aleady been run
-			if gen.Generated() {
-				go func() { g.Out <- GenerateFinished{gen, nil} }()
-				continue
-			}
-			log.Println("Sending case to comparison: ", gen.ID())
-			// This will be read in below in the loop over data
-			go func() { g.In <- gen }()
-		}
-		fmt.Println("skipped =", skipped)
-
-		postprocessWg := &sync.WaitGroup{}
-		for i := skipped; i < len(mlRun.Settings.TestingData); i++ {
-			// TODO: Fix this so that the order isn't messed up
-			gf := <-g.Out
-			log.Println("Case read from comparison: ", gf.ID())
-			if gf.Err != nil {
-				testDone.comparisonErrs[i] = gf.Err
-				continue
-			}
-			postprocessWg.Add(1)
-			go func(i int) {
-				// Right here is where the extra postprocessing stuff needs to be added
-
-				// Need to load in the extra data
-				// make comparison plots
-
-				//loader, ok := gf.Generatable.()
-
-				//savepath := mlRun.Savepath
-
-				p, ok := gf.Generatable.(PostProcessor)
-				if ok {
-					fmt.Println("Launching postprocess: " + gf.ID())
-					err := p.PostProcess()
-					fmt.Println("Done postprocessing")
-					if err != nil {
-						fmt.Println("gen postprocess err", i, err)
-						testDone.comparisonErrs[i] = err
-					}
-				} else {
-					fmt.Println(i, " is not a postprocessor")
+// uniqueDatasets returns the datasets in the runs with each ID listed once.
+func uniqueDatasets(runs []*Settings) []Dataset {
+	m := make(map[string]struct{})
+	var unique []Dataset
+	for _, set := range runs {
+		for _, datasets := range [][]Dataset{set.TrainingData, set.TestingData} {
+			for _, dataset := range datasets {
+				if _, ok := m[dataset.ID()]; ok {
+					continue
 				}
-				fmt.Println("Done generatable ", i)
-				postprocessWg.Done()
-			}(i)
-		}
-		fmt.Println("Waiting for postprocess to be done")
-		postprocessWg.Wait()
-		fmt.Println("Postprocess is done")
-		wg.Done()
-		fmt.Println("Past call to done 1")
-	}()
-
-	// Second thing to do is to run the normal post-processing stuff
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		fmt.Println("Starting training data post processing")
-		scalePredictor, err := LoadScalePredictor(testDone.Settings.Savepath)
-		if err != nil {
-			testDone.postprocessErr = err
-			runtime.GC()
-			return
+				m[dataset.ID()] = struct{}{}
+				unique = append(unique, dataset)
+			}
 		}
-		postErr := postprocess(scalePredictor, testDone.Settings)
-		testDone.postprocessErr = postErr
-	}()
-	fmt.Println("Main postprocess routine reached call to wait")
-	wg.Wait()
-	fmt.Println("Main postprocess routine finished call to wait")
-	finished <- struct{}{}
-	fmt.Println("postprocess routine sent signal to finished")
+	}
+	return unique
 }
 
+// mlRunData is the Generatable for training the algorithm of a settings case.
 type mlRunData struct {
 	*Settings
-	trainErr    []error
-	learningErr error
+}
+
+// trained returns whether a trained algorithm exists, whether or not it is
+// out of date.
+func (m *mlRunData) trained() bool {
+	_, err := os.Stat(PredictorFilename(m.Settings.Savepath))
+	return err == nil
 }
 
 func (m *mlRunData) Generated() bool {
 	// Checks if the machine learning has already been run
 	algFile := PredictorFilename(m.Settings.Savepath)
 
-	_, err := os.Open(algFile)
+	_, err := os.Stat(algFile)
 	if err != nil {
-		fmt.Println("Algfile is: ", algFile, " err is ", err.Error())
+		Debugf("%v not trained: %v", algFile, err)
+		return false
 	}
-	return err == nil // If we can open the alg file it's because it has been generated
+	// The algorithm must also have been trained with the current settings and data
+	return isCurrent(PredictorDirectory(m.Settings.Savepath), TrainingFingerprint(m.Settings))
 }
 
 func (m *mlRunData) ID() string {
@@ -438,12 +477,43 @@ func (m *mlRunData) ID() string {
 	return PredictorFilename(m.Settings.Savepath)
 }
 
+// Artifacts returns the files produced by training.
+func (m *mlRunData) Artifacts() []string {
+	return TrainingArtifacts(m.Settings.Savepath)
+}
+
 func (m *mlRunData) NumCores() int {
 	return runtime.GOMAXPROCS(0) - 1 // -1 so that we can also start postprocess routines at the same time
 }
 
+// MemoryEstimate returns twice the size of the source files of the training
+// data. The loaded data are smaller than their text files, but the trainer
+// holds scaled copies as well. Datasets which are not SourceFilers are not
+// counted.
+func (m *mlRunData) MemoryEstimate() int64 {
+	var size int64
+	for _, dataset := range m.Settings.TrainingData {
+		s, ok := dataset.(SourceFiler)
+		if !ok {
+			continue
+		}
+		for _, file := range s.SourceFiles() {
+			info, err := os.Stat(file)
+			if err == nil {
+				size += info.Size()
+			}
+		}
+	}
+	return 2 * size
+}
+
 func (m *mlRunData) Run() error {
+	return m.RunContext(context.Background())
+}
 
+// RunContext trains the algorithm. The run stops before training if the context
+// is cancelled while the data are loading.
+func (m *mlRunData) RunContext(ctx context.Context) error {
 	algsavepath := PredictorDirectory(m.Settings.Savepath)
 	algFile := PredictorFilename(m.Settings.Savepath)
 	err := os.MkdirAll(algsavepath, 0700)
@@ -452,24 +522,28 @@ func (m *mlRunData) Run() error {
 	}
 
 	settings := m.Settings
+	fingerprint := TrainingFingerprint(settings)
 
-	fmt.Println("Settings.TrainingData is:")
 	for _, dat := range settings.TrainingData {
-		fmt.Println(dat.ID())
+		Debugf("%v: training data %v", m.ID(), dat.ID())
 	}
 	// Load all of the training data
-	inputs, outputs, weights, loadErrs := LoadTrainingData(settings.TrainingData, DenseLoad,
+	loader := settings.loader()
+	inputs, outputs, weights, loadErrs := loader.LoadTrainingData(settings.TrainingData, settings.LoadStyle,
 		settings.InputFeatures, settings.OutputFeatures, settings.WeightFeatures, settings.WeightFunc)
 
 	if loadErrs != nil {
 		return loadErrs
 	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
 	nRow, nCol := inputs.Dims()
-	fmt.Println("Calling train with ", nRow, " rows and ", nCol, " columns")
+	Debugf("%v: training with %v rows and %v columns", m.ID(), nRow, nCol)
 
 	trainer := settings.Trainer
-	sp, result, err := trainer.Train(inputs, outputs, weights)
+	sp, result, err := trainer.train(m.ID(), inputs, outputs, weights)
 	if err != nil {
 		return err
 	}
@@ -479,236 +553,43 @@ func (m *mlRunData) Run() error {
 	if err != nil {
 		return errors.New("error saving predictor: " + err.Error())
 	}
-
-	// Make a plot of pred vs. truth and err. vs. truth over the training data
-	path := filepath.Join(m.Settings.Savepath, "postprocess", "trainingData")
-	ptrSP := sp.(*ScalePredictor)
-	// TODO: Fix this. It is really ugly.
-	makeComparisons(inputs, outputs, *ptrSP, settings.InputFeatures, settings.OutputFeatures, path)
-	return nil
-}
-
-type mlRun struct {
-	Idx        int
-	TraningErr []error
-}
-
-type genComplete struct {
-	Idx int
-	ID  string
-	err error
-}
-
-type mlRunnerStruct struct {
-	computeChan chan Generatable
-	doneChan    chan GenerateFinished
-}
-
-// Generates a new mlrunner and adds it to the scheduler
-func newMlRunner(scheduler Scheduler) *mlRunnerStruct {
-	cc := make(chan Generatable)
-	dc := make(chan GenerateFinished)
-
-	scheduler.AddChannel(GeneratableIO{In: cc, Out: dc})
-	return &mlRunnerStruct{
-		computeChan: cc,
-		doneChan:    dc,
-	}
-}
-func (m *mlRunnerStruct) Close() {
-	close(m.computeChan)
-}
-
-func (m *mlRunnerStruct) Compute(ml *mlRunData) {
-	log.Print("ml " + ml.ID() + "received for generating")
-	errStr := ""
-	for i, err := range ml.trainErr {
-		if err != nil {
-			if errStr == "" {
-				errStr = "Error training"
-			}
-			errStr += " case " + strconv.Itoa(i) + "err: " + err.Error()
-		}
-	}
-	if errStr != "" {
-		log.Print("ml " + ml.ID() + "had training generation error")
-		// There was an error training, so send it as done
-		ml.learningErr = errors.New(errStr)
-		m.doneChan <- GenerateFinished{Generatable: ml, Err: nil}
-		return
-	}
-	if ml.Generated() {
-		log.Print("ml " + ml.ID() + "has already been generated")
-		m.doneChan <- GenerateFinished{Generatable: ml, Err: nil}
-		return
-	}
-	log.Print("ml " + ml.ID() + "sent to compute")
-	m.computeChan <- ml
-}
-
-func (m *mlRunnerStruct) Done() *mlRunData {
-	data := <-m.doneChan
-	err := data.Err
-
-	ml := data.Generatable.(*mlRunData)
-	ml.learningErr = err
-	return ml
-}
-
-type datasetRunner struct {
-	Set        Dataset
-	Idx        int
-	RunErr     error
-	LoadErr    error
-	IsTraining bool
-}
-
-// learner controls
-type learner struct {
-	*Settings
-	trainRunning map[string]int // to local index
-	trainIdx     []int          // map from local index to unique index
-	trainErrs    []error
-
-	testIdx     []int
-	testRunning map[string]int
-	testErrs    []error
-
-	learningErr    error
-	comparisonErrs []error
-	postprocessErr error
-}
-
-func (l *learner) ReportError() error {
-	var str string
-	var isTrainingError bool
-	for _, err := range l.trainErrs {
-		if err != nil {
-			if isTrainingError == false {
-				str += "error training: "
-			}
-			str += err.Error()
-			isTrainingError = true
-		}
-	}
-	if isTrainingError {
-		str += " "
-	}
-	var isTestingError bool
-	for _, err := range l.testErrs {
-		if err != nil {
-			if isTestingError {
-				str += "error testing: "
-			}
-			str += err.Error()
-			isTestingError = true
-		}
-	}
-	if isTrainingError || isTestingError {
-		return errors.New(str)
-	}
-
-	if l.learningErr != nil {
-		return l.learningErr
-	}
-
-	isPostprocessError := l.postprocessErr != nil
-	if isPostprocessError {
-		str += "Postprocessing error: " + l.postprocessErr.Error() + " "
-	}
-
-	var isCompError bool
-	for _, err := range l.comparisonErrs {
-		if err != nil {
-			if isCompError == false {
-				str += "error comparing: "
-			}
-			str += err.Error()
-			isCompError = true
-		}
-	}
-
-	if isPostprocessError || isCompError {
-		return errors.New(str)
+	// Record the training inputs so postprocessing can find extrapolated
+	// points. The predictor is still good without them, so training does not
+	// fail, and any domain of an earlier training is removed.
+	err = saveInputDomain(settings.InputFeatures, inputs, DomainFilename(m.Settings.Savepath))
+	if err != nil {
+		Infof("%v: not recording the input domain: %v", m.ID(), err)
+		os.Remove(DomainFilename(m.Settings.Savepath))
 	}
-
-	return nil
-}
-
-// RegisterCompletion logs in the learner that that dataset has finished running
-func (l *learner) RegisterCompletion(run DatasetFinished) {
-	idx, ok := l.trainRunning[run.ID()]
-	if ok {
-		l.trainErrs[idx] = run.Err
-		delete(l.trainRunning, run.ID())
+	err = saveNonFinite(loader.Reports(), NonFiniteFilename(m.Settings.Savepath))
+	if err != nil {
+		return errors.New("error saving non-finite report: " + err.Error())
 	}
-
-	idx, ok = l.testRunning[run.ID()]
-	if ok {
-		l.testErrs[idx] = run.Err
-		delete(l.testRunning, run.ID())
+	err = fingerprint.Save(algsavepath)
+	if err != nil {
+		return errors.New("error saving fingerprint: " + err.Error())
 	}
-}
 
-func (l *learner) AllTrainDone() bool {
-	return len(l.trainRunning) == 0
-}
-
-func (l *learner) AllTestDone() bool {
-	return len(l.testRunning) == 0
-}
-
-func uniqueDatasets(runs []*Settings) (m map[string]int, uniqueData []Dataset, isTraining map[string]bool, learners []*learner) {
-	m = make(map[string]int)
-	isTraining = make(map[string]bool)
-	uniqueData = make([]Dataset, 0)
-	learners = make([]*learner, len(runs))
-	for i := range learners {
-		learners[i] = &learner{}
+	// Make a plot of pred vs. truth and err. vs. truth over the training data.
+	// Any existing plots are from a previous training.
+	path := filepath.Join(m.Settings.Savepath, "postprocess", "trainingData")
+	plotFingerprint := comparisonFingerprint(settings, settings.TrainingData...)
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
 	}
-	fmt.Println("learners =", learners)
-	fmt.Println("setting training ", runs[0].TrainingData)
-	var uniqueIdx int
-	for i, setting := range runs {
-		learners[i].Settings = setting
-		learners[i].trainRunning = make(map[string]int)
-		learners[i].trainIdx = make([]int, len(setting.TrainingData))
-		learners[i].trainErrs = make([]error, len(setting.TrainingData))
-		for j, dataset := range setting.TrainingData {
-			idx, ok := m[dataset.ID()]
-			if !ok {
-				// Dataset doesn't exist yet, add it to the map
-				uniqueIdx++
-				m[dataset.ID()] = uniqueIdx
-				uniqueData = append(uniqueData, dataset)
-				idx = uniqueIdx
-			}
-			learners[i].trainIdx[j] = idx
-			learners[i].trainRunning[dataset.ID()] = j
-			isTraining[dataset.ID()] = true
-		}
-		learners[i].testRunning = make(map[string]int)
-		learners[i].testIdx = make([]int, len(setting.TestingData))
-		learners[i].testErrs = make([]error, len(setting.TestingData))
-		learners[i].comparisonErrs = make([]error, len(setting.TestingData))
-		for j, dataset := range setting.TestingData {
-			idx, ok := m[dataset.ID()]
-			if !ok {
-				uniqueIdx++
-				m[dataset.ID()] = uniqueIdx
-				uniqueData = append(uniqueData, dataset)
-				idx = uniqueIdx
-			}
-			learners[i].testIdx[j] = idx
-			learners[i].testRunning[dataset.ID()] = j
-		}
+	ptrSP := sp.(*ScalePredictor)
+	// TODO: Fix this. It is really ugly.
+	err = makeComparisons(inputs, outputs, *ptrSP, settings.InputFeatures, settings.OutputFeatures, path)
+	if err != nil {
+		Infof("error plotting training data: %v", err)
+		return nil
 	}
-	return
+	return plotFingerprint.Save(path)
 }
 
 //
 func savePredictor(sp Predictor, result TrainResults, filename, resultfilename string) error {
-	fmt.Println("save file name = ", filename)
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -739,6 +620,20 @@ func savePredictor(sp Predictor, result TrainResults, filename, resultfilename s
 	return nil
 }
 
+// TrainingArtifacts returns the files produced by training the algorithm saved
+// in savepath. The fingerprint is included so that a predictor trained
+// elsewhere is still checked against the settings.
+func TrainingArtifacts(savepath string) []string {
+	return []string{
+		PredictorFilename(savepath),
+		filepath.Join(PredictorDirectory(savepath), "train_result.json"),
+		filepath.Join(PredictorDirectory(savepath), FingerprintFilename),
+		DomainFilename(savepath),
+		NonFiniteFilename(savepath),
+		filepath.Join(savepath, "postprocess", "trainingData"),
+	}
+}
+
 func PredictorDirectory(savepath string) string {
 	return filepath.Join(savepath, "algorithm")
 }
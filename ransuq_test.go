@@ -1,9 +1,21 @@
 package ransuq_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -64,9 +76,10 @@ func TestMulti(t *testing.T) {
 		"net_2_50",
 		settings.StandardTraining,
 		driver.Serial{true},
+		[]string{settings.NoExtraStrings},
 	)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
 	}
 
 	var sets []*Settings
@@ -83,7 +96,7 @@ func TestMulti(t *testing.T) {
 			driver.Serial{true},
 		)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		sets = append(sets, set)
 	*/
@@ -116,7 +129,7 @@ func TestMulti(t *testing.T) {
 				driver.Serial{true},
 			)
 			if err != nil {
-				t.Errorf(err.Error())
+				t.Error(err)
 			}
 			sets = append(sets, set)
 
@@ -127,7 +140,7 @@ func TestMulti(t *testing.T) {
 		}
 	*/
 
-	errs := MultiTurb(sets, NewLocalScheduler())
+	_, errs := MultiTurb(sets, NewLocalScheduler())
 	for i, err := range errs {
 		if err != nil {
 			t.Errorf("learner %v: %v", i, err)
@@ -140,3 +153,2310 @@ func TestMulti(t *testing.T) {
 		}
 	*/
 }
+
+func TestMultiCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	set := &Settings{
+		FeatureSet: "Test1",
+		TrainingData: []Dataset{
+			&GeneratableDataset{"cancel_str1", 1},
+			&GeneratableDataset{"cancel_str2", 1},
+		},
+		InputFeatures:  []string{"feat1", "feat2"},
+		OutputFeatures: []string{"outfeat_1"},
+		Savepath:       dir,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reports, errs := MultiTurbContext(ctx, []*Settings{set}, NewLocalScheduler())
+	skip, ok := errs[0].(SkippedError)
+	if !ok {
+		t.Fatalf("expected SkippedError, found %v", errs[0])
+	}
+	// Both datasets, the training and the postprocessing are skipped.
+	if len(skip.Skipped) != 4 {
+		t.Errorf("expected every job skipped, found %v", skip.Skipped)
+	}
+	if reports[0].Status != StatusSkipped {
+		t.Errorf("report status: expected %v, found %v", StatusSkipped, reports[0].Status)
+	}
+	saved, err := LoadRunReport(dir)
+	if err != nil {
+		t.Fatalf("error loading report: %v", err)
+	}
+	if len(saved.Phases) != len(reports[0].Phases) {
+		t.Errorf("saved report has %v phases, expected %v", len(saved.Phases), len(reports[0].Phases))
+	}
+}
+
+// cancellingGeneratable fails and cancels the run.
+type cancellingGeneratable struct {
+	GeneratableDataset
+	cancel func()
+}
+
+func (c *cancellingGeneratable) Run() error {
+	c.cancel()
+	return errors.New("failed and cancelled")
+}
+
+func TestFailedAndSkipped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The jobs run one at a time, so whichever dataset runs first fails and
+	// the other is skipped.
+	set := &Settings{
+		TrainingData: []Dataset{
+			&cancellingGeneratable{GeneratableDataset{"cancel_first", 1}, cancel},
+			&cancellingGeneratable{GeneratableDataset{"cancel_second", 1}, cancel},
+		},
+		InputFeatures:  []string{"feat1"},
+		OutputFeatures: []string{"outfeat_1"},
+		Savepath:       dir,
+	}
+	scheduler := NewDeterministicScheduler(1)
+	defer scheduler.Quit()
+	reports, errs := MultiTurbContext(ctx, []*Settings{set}, scheduler)
+	list, ok := errs[0].(ErrorList)
+	if !ok || len(list) != 2 {
+		t.Fatalf("expected the failure and the skipped jobs, found %v", errs[0])
+	}
+	if jobErr, ok := list[0].(JobError); !ok || jobErr.Err.Error() != "failed and cancelled" {
+		t.Errorf("expected the failure of the dataset, found %v", list[0])
+	}
+	if _, ok := list[1].(SkippedError); !ok {
+		t.Errorf("expected a SkippedError, found %v", list[1])
+	}
+	if reports[0].Status != StatusFailed {
+		t.Errorf("report status: expected %v, found %v", StatusFailed, reports[0].Status)
+	}
+}
+
+type failingGeneratable struct {
+	GeneratableDataset
+}
+
+func (f *failingGeneratable) Run() error {
+	return errors.New("failed")
+}
+
+func TestGraphFailure(t *testing.T) {
+	graph := NewGraph()
+	fail := graph.Add(&Job{
+		Phase: PhaseGenerate,
+		ID:    "fail",
+		Run: func(submit SubmitFunc) ([]string, error) {
+			return nil, submit(&failingGeneratable{GeneratableDataset{"fail", 1}})
+		},
+	})
+	cached := graph.Add(&Job{
+		Phase: PhaseGenerate,
+		ID:    "cached",
+		Run: func(submit SubmitFunc) ([]string, error) {
+			return []string{"cached"}, nil
+		},
+	})
+	var ran bool
+	downstream := graph.Add(&Job{
+		Phase: PhaseTrain,
+		ID:    "downstream",
+		Deps:  []*Job{fail, cached},
+		Run: func(submit SubmitFunc) ([]string, error) {
+			ran = true
+			return nil, nil
+		},
+	})
+	panics := graph.Add(&Job{
+		Phase: PhaseTrain,
+		ID:    "panics",
+		Deps:  []*Job{cached},
+		Run: func(submit SubmitFunc) ([]string, error) {
+			panic("oops")
+		},
+	})
+
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+	graph.Run(context.Background(), scheduler)
+
+	if fail.Result.Status != StatusFailed {
+		t.Errorf("fail: expected %v, found %v", StatusFailed, fail.Result.Status)
+	}
+	if cached.Result.Status != StatusCached {
+		t.Errorf("cached: expected %v, found %v", StatusCached, cached.Result.Status)
+	}
+	if ran {
+		t.Errorf("downstream job run after its dependency failed")
+	}
+	if _, ok := downstream.Result.Err.(DependencyError); !ok {
+		t.Errorf("downstream: expected DependencyError, found %v", downstream.Result.Err)
+	}
+	if _, ok := panics.Result.Err.(PanicError); !ok {
+		t.Errorf("panics: expected PanicError, found %v", panics.Result.Err)
+	}
+}
+
+type fileDataset struct {
+	GeneratableDataset
+	File string
+}
+
+func (f *fileDataset) SourceFiles() []string {
+	return []string{f.File}
+}
+
+func TestFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data.csv")
+	err = ioutil.WriteFile(file, []byte("1,2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &Settings{
+		TrainingData:   []Dataset{&fileDataset{GeneratableDataset{"data", 1}, file}},
+		InputFeatures:  []string{"feat1"},
+		OutputFeatures: []string{"outfeat_1"},
+	}
+	err = TrainingFingerprint(set).Save(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := TrainingFingerprint(set).Stale(dir); reason != "" {
+		t.Errorf("unchanged settings are stale: %v", reason)
+	}
+
+	set.InputFeatures = []string{"feat1", "feat2"}
+	if reason := TrainingFingerprint(set).Stale(dir); reason == "" {
+		t.Errorf("changed features not detected")
+	}
+	set.InputFeatures = []string{"feat1"}
+
+	err = ioutil.WriteFile(file, []byte("1,2\n3,4\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := TrainingFingerprint(set).Stale(dir); reason == "" {
+		t.Errorf("changed source file not detected")
+	}
+
+	set.WeightFunc = func([]float64) float64 { return 1 }
+	set.WeightSpec = "inverse"
+	if reason := TrainingFingerprint(set).Stale(dir); reason == "" {
+		t.Errorf("changed weight function not detected")
+	}
+
+	// An algorithm trained before fingerprints were recorded is out of date.
+	// It is reused when training is not selected, but its fingerprint is not
+	// recorded.
+	legacy := &Settings{
+		TrainingData:   []Dataset{&tableDataset{"legacy", map[string][]float64{"feat1": {1, 2}, "outfeat_1": {3, 4}}}},
+		InputFeatures:  []string{"feat1"},
+		OutputFeatures: []string{"outfeat_1"},
+		Savepath:       filepath.Join(dir, "legacy"),
+	}
+	err = os.MkdirAll(PredictorDirectory(legacy.Savepath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(PredictorFilename(legacy.Savepath), []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := NewPlan([]*Settings{legacy}).Summary(); summary.PendingTraining != 1 {
+		t.Errorf("legacy training cached: %+v", summary)
+	}
+	p := &Pipeline{
+		Scheduler: NewLocalScheduler(),
+		Phases:    []Phase{PhaseGenerate},
+	}
+	_, errs := p.Run(context.Background(), []*Settings{legacy})
+	if errs[0] != nil {
+		t.Fatalf("error running legacy settings: %v", errs[0])
+	}
+	if reason := TrainingFingerprint(legacy).Stale(PredictorDirectory(legacy.Savepath)); reason != "no fingerprint recorded" {
+		t.Errorf("expected no fingerprint for the legacy training, found %q", reason)
+	}
+}
+
+type recordSink struct {
+	mux    sync.Mutex
+	events []Event
+}
+
+func (r *recordSink) Event(e Event) {
+	r.mux.Lock()
+	r.events = append(r.events, e)
+	r.mux.Unlock()
+}
+
+// recorded returns the events received so far.
+func (r *recordSink) recorded() []Event {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestEvents(t *testing.T) {
+	rec := &recordSink{}
+	SetEventSink(rec)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	graph := NewGraph()
+	graph.Add(&Job{
+		Phase: PhaseGenerate,
+		ID:    "events",
+		Run: func(submit SubmitFunc) ([]string, error) {
+			return nil, submit(&GeneratableDataset{"events", 1})
+		},
+	})
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+	graph.Run(context.Background(), scheduler)
+
+	// The cores are freed after the job is sent back, so the event may come
+	// after the graph finishes.
+	kinds := make(map[EventKind]bool)
+	for start := time.Now(); !kinds[EventCoresFreed] && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		for _, e := range rec.recorded() {
+			kinds[e.Kind] = true
+		}
+	}
+	for _, e := range rec.recorded() {
+		if e.Kind == EventJobFinished && e.Phase == PhaseGenerate && e.Status != StatusSucceeded {
+			t.Errorf("job finished with status %v", e.Status)
+		}
+	}
+	for _, kind := range []EventKind{EventJobQueued, EventJobStarted, EventJobFinished, EventCoresFreed} {
+		if !kinds[kind] {
+			t.Errorf("no %v event", kind)
+		}
+	}
+}
+
+type flakyGeneratable struct {
+	GeneratableDataset
+	failures int
+	prepared int
+}
+
+func (f *flakyGeneratable) Run() error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("diverged")
+	}
+	return nil
+}
+
+func (f *flakyGeneratable) PrepareRetry(attempt int, err error) error {
+	f.prepared++
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		failures    int
+		maxAttempts int
+		status      Status
+		attempts    int
+	}{
+		{failures: 2, maxAttempts: 3, status: StatusSucceeded, attempts: 3},
+		{failures: 3, maxAttempts: 2, status: StatusFailed, attempts: 2},
+		{failures: 0, maxAttempts: 2, status: StatusSucceeded, attempts: 1},
+	} {
+		gen := &flakyGeneratable{GeneratableDataset: GeneratableDataset{"flaky", 1}, failures: test.failures}
+		graph := NewGraph()
+		graph.Retry = RetryPolicy{MaxAttempts: test.maxAttempts, Backoff: time.Millisecond, Multiplier: 2}
+		graph.Metrics = NewSchedulerMetrics()
+		job := graph.Add(&Job{
+			Phase: PhaseGenerate,
+			ID:    "flaky",
+			Run: func(submit SubmitFunc) ([]string, error) {
+				return nil, submit(gen)
+			},
+		})
+		scheduler := NewLocalScheduler()
+		scheduler.Launch()
+		graph.Run(context.Background(), scheduler)
+
+		if job.Result.Status != test.status {
+			t.Errorf("%v failures: expected %v, found %v", test.failures, test.status, job.Result.Status)
+		}
+		if len(job.Result.Attempts) != test.attempts {
+			t.Errorf("%v failures: expected %v attempts, found %v", test.failures, test.attempts, len(job.Result.Attempts))
+		}
+		if gen.prepared != test.attempts-1 {
+			t.Errorf("%v failures: PrepareRetry called %v times", test.failures, gen.prepared)
+		}
+		if runs := graph.Metrics.Stats().Runs; runs != test.attempts {
+			t.Errorf("%v failures: expected %v runs in the metrics of the graph, found %v", test.failures, test.attempts, runs)
+		}
+	}
+}
+
+func TestPhaseSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	set := &Settings{
+		FeatureSet:     "Test1",
+		TrainingData:   []Dataset{&GeneratableDataset{"phase_str1", 1}},
+		InputFeatures:  []string{"feat1", "feat2"},
+		OutputFeatures: []string{"outfeat_1"},
+		Savepath:       dir,
+	}
+	// The data were never generated, so postprocessing alone cannot run.
+	p := &Pipeline{
+		Scheduler: NewLocalScheduler(),
+		Phases:    []Phase{PhasePostprocess},
+	}
+	reports, errs := p.Run(context.Background(), []*Settings{set})
+	list, ok := errs[0].(ErrorList)
+	if !ok || len(list) != 1 {
+		t.Fatalf("expected one error, found %v", errs[0])
+	}
+	jobErr, ok := list[0].(JobError)
+	if !ok {
+		t.Fatalf("expected JobError, found %v", list[0])
+	}
+	if _, ok := jobErr.Err.(MissingError); !ok || jobErr.Phase != PhaseGenerate {
+		t.Errorf("expected MissingError generating data, found %v", jobErr)
+	}
+	for _, phase := range reports[0].Phases {
+		if len(phase.Attempts) != 0 {
+			t.Errorf("%v %v was run", phase.Phase, phase.ID)
+		}
+	}
+
+	if _, err := ParsePhases("train, postprocess"); err != nil {
+		t.Errorf("error parsing phases: %v", err)
+	}
+	if _, err := ParsePhases("train,plot"); err == nil {
+		t.Errorf("no error for unknown phase")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shared := &GeneratableDataset{"plan_shared", 1}
+	fixed := &tableDataset{"plan_fixed", map[string][]float64{"feat1": {1}}}
+	sets := []*Settings{
+		{
+			TrainingData: []Dataset{shared, &GeneratableDataset{"plan_other", 1}},
+			TestingData:  []Dataset{fixed},
+			Savepath:     filepath.Join(dir, "first"),
+		},
+		{
+			TrainingData: []Dataset{shared},
+			Savepath:     filepath.Join(dir, "second"),
+		},
+	}
+	plan := NewPlan(sets)
+
+	want := PlanSummary{
+		PendingData:     2,
+		CachedData:      1,
+		PendingTraining: 2,
+		Postprocess:     2,
+	}
+	if plan.Summary() != want {
+		t.Errorf("expected summary %v, found %v", want, plan.Summary())
+	}
+	for _, node := range plan.Nodes {
+		if node.ID == shared.ID() && fmt.Sprint(node.Cases) != "[0 1]" {
+			t.Errorf("expected the shared dataset in both cases, found %v", node.Cases)
+		}
+	}
+
+	// Planning does not write anything.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("planning created %v", files[0].Name())
+	}
+
+	var dot bytes.Buffer
+	err = plan.WriteDOT(&dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	train := string(PhaseTrain) + ":" + PredictorFilename(sets[1].Savepath)
+	for _, str := range []string{
+		"digraph ransuq {",
+		fmt.Sprintf("%q -> %q;", string(PhaseGenerate)+":plan_shared", train),
+		fmt.Sprintf("%q [label=%q, shape=box, style=filled, fillcolor=lightgrey];", string(PhaseGenerate)+":plan_fixed", string(PhaseGenerate)+"\nplan_fixed"),
+	} {
+		if !strings.Contains(dot.String(), str) {
+			t.Errorf("DOT output does not contain %v:\n%v", str, dot.String())
+		}
+	}
+
+	var js bytes.Buffer
+	err = plan.WriteJSON(&js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read Plan
+	err = json.Unmarshal(js.Bytes(), &read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Summary() != want || len(read.Nodes) != len(plan.Nodes) {
+		t.Errorf("JSON plan does not match: %v", js.String())
+	}
+}
+
+func TestCrossValidationFolds(t *testing.T) {
+	fixed := &GeneratableDataset{"fixed", 1}
+	var group []Dataset
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		group = append(group, &GeneratableDataset{s, 1})
+	}
+	var trainers int
+	cv := &CrossValidation{
+		Base: &Settings{
+			TrainingData: []Dataset{fixed},
+			Savepath:     "base",
+		},
+		Group: group,
+		K:     2,
+		NewTrainer: func() (*Trainer, error) {
+			trainers++
+			return &Trainer{}, nil
+		},
+	}
+	folds, err := cv.Folds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folds) != 2 || trainers != 2 {
+		t.Fatalf("expected 2 folds with their own trainers, found %v folds and %v trainers", len(folds), trainers)
+	}
+	heldOut := make(map[string]int)
+	for _, fold := range folds {
+		set := fold.Settings
+		if set.TrainingData[0] != fixed {
+			t.Errorf("fold %v does not train on the fixed data", fold.Index)
+		}
+		if len(set.TrainingData)+len(fold.HeldOut) != len(group)+1 {
+			t.Errorf("fold %v has %v training and %v held out datasets", fold.Index, len(set.TrainingData), len(fold.HeldOut))
+		}
+		for _, d := range fold.HeldOut {
+			heldOut[d.ID()]++
+		}
+		if set.Savepath == cv.Base.Savepath {
+			t.Errorf("fold %v saves in the base savepath", fold.Index)
+		}
+	}
+	for _, d := range group {
+		if heldOut[d.ID()] != 1 {
+			t.Errorf("dataset %v held out %v times", d.ID(), heldOut[d.ID()])
+		}
+	}
+	cv.K = 6
+	if _, err := cv.Folds(); err == nil {
+		t.Errorf("no error for more folds than datasets")
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	root, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	failed := filepath.Join(root, "laval", "source", "none", "net_2_50", "10kiter")
+	r := &RunReport{Savepath: failed, Status: StatusFailed, Error: "training diverged"}
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	trained := filepath.Join(root, "laval", "production", "none", "net_2_25", "10kiter")
+	if err := os.MkdirAll(PredictorDirectory(trained), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(PredictorFilename(trained), []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(PredictorDirectory(trained), "train_result.json"), []byte(`{"OptObj": 0.5}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := ScanCatalog(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 2 {
+		t.Fatalf("expected 2 entries, found %v", len(catalog.Entries))
+	}
+	found := catalog.Find(CatalogFilter{Algorithm: "net_2_*", Features: "production"})
+	if len(found) != 1 {
+		t.Fatalf("expected 1 match, found %v", len(found))
+	}
+	e := found[0]
+	if e.Savepath != trained || e.Training != "laval" || e.Convergence != "10kiter" || !e.Trained {
+		t.Errorf("wrong entry %+v", e)
+	}
+	if e.Result == nil || e.Result.OptObj != 0.5 {
+		t.Errorf("training result not loaded")
+	}
+	found = catalog.Find(CatalogFilter{Status: string(StatusFailed)})
+	if len(found) != 1 || found[0].Savepath != failed || found[0].Error != "training diverged" {
+		t.Errorf("failed run not found")
+	}
+}
+
+// blockingGeneratable runs until it is released.
+type blockingGeneratable struct {
+	GeneratableDataset
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlocking(id string, cores int) *blockingGeneratable {
+	return &blockingGeneratable{
+		GeneratableDataset: GeneratableDataset{id, cores},
+		started:            make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+}
+
+func (b *blockingGeneratable) Run() error {
+	close(b.started)
+	<-b.release
+	return nil
+}
+
+// queueSink sends the ID of each job queued by the scheduler.
+type queueSink chan string
+
+func (q queueSink) Event(e Event) {
+	if e.Kind == EventJobQueued {
+		q <- e.ID
+	}
+}
+
+func waitFor(t *testing.T, c <-chan struct{}, what string) {
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %v", what)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queued := make(queueSink, 10)
+	SetEventSink(queued)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	for _, maxBypass := range []int{1, DefaultMaxBypass} {
+		scheduler := NewLocalScheduler()
+		scheduler.MaxBypass = maxBypass
+		scheduler.Launch()
+		submit := func(gen Generatable) {
+			io := GeneratableIO{In: make(chan Generatable, 1), Out: make(chan GenerateFinished, 1)}
+			scheduler.AddChannel(io)
+			io.In <- gen
+			close(io.In)
+			if id := <-queued; id != gen.ID() {
+				t.Fatalf("expected %v to be queued, found %v", gen.ID(), id)
+			}
+		}
+
+		running := newBlocking("running", 3)
+		large := newBlocking("large", 4)
+		small1 := newBlocking("small1", 1)
+		small2 := newBlocking("small2", 1)
+		submit(running)
+		waitFor(t, running.started, "first job")
+		submit(large)
+		submit(small1)
+		waitFor(t, small1.started, "small job to backfill")
+		submit(small2)
+		close(small1.release)
+
+		if maxBypass == 1 {
+			// The large job has been passed over once, so the core freed by
+			// the small job is reserved for it.
+			close(running.release)
+			waitFor(t, large.started, "large job")
+			select {
+			case <-small2.started:
+				t.Errorf("small job started while cores were reserved")
+			default:
+			}
+			close(large.release)
+			waitFor(t, small2.started, "second small job")
+			close(small2.release)
+		} else {
+			waitFor(t, small2.started, "second small job to backfill")
+			close(running.release)
+			close(small2.release)
+			waitFor(t, large.started, "large job")
+			close(large.release)
+		}
+		scheduler.Quit()
+	}
+}
+
+type priorityGeneratable struct {
+	*blockingGeneratable
+	priority int
+}
+
+func (p priorityGeneratable) Priority() int {
+	return p.priority
+}
+
+func TestPriority(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queued := make(queueSink, 10)
+	SetEventSink(queued)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+	defer scheduler.Quit()
+	running := newBlocking("running", 4)
+	low := newBlocking("low", 4)
+	high := priorityGeneratable{newBlocking("high", 4), 1}
+	for _, gen := range []Generatable{running, low, high} {
+		io := GeneratableIO{In: make(chan Generatable, 1), Out: make(chan GenerateFinished, 1)}
+		scheduler.AddChannel(io)
+		io.In <- gen
+		close(io.In)
+		<-queued
+	}
+	waitFor(t, running.started, "first job")
+	close(running.release)
+	waitFor(t, high.started, "high priority job")
+	select {
+	case <-low.started:
+		t.Errorf("low priority job started first")
+	default:
+	}
+	close(high.release)
+	waitFor(t, low.started, "low priority job")
+	close(low.release)
+}
+
+func TestReservationPriority(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queued := make(queueSink, 10)
+	SetEventSink(queued)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	scheduler := NewLocalScheduler()
+	scheduler.MaxBypass = 1
+	scheduler.Launch()
+	defer scheduler.Quit()
+	submit := func(gen Generatable) {
+		io := GeneratableIO{In: make(chan Generatable, 1), Out: make(chan GenerateFinished, 1)}
+		scheduler.AddChannel(io)
+		io.In <- gen
+		close(io.In)
+		<-queued
+	}
+
+	running := newBlocking("running", 3)
+	large := newBlocking("large", 4)
+	high1 := priorityGeneratable{newBlocking("high1", 1), 1}
+	high2 := priorityGeneratable{newBlocking("high2", 1), 1}
+	submit(running)
+	waitFor(t, running.started, "first job")
+	submit(large)
+	submit(high1)
+	waitFor(t, high1.started, "first high priority job")
+
+	// The large job has been passed over once, so a higher priority job
+	// queued ahead of it does not take the freed core.
+	submit(high2)
+	close(high1.release)
+	close(running.release)
+	waitFor(t, large.started, "large job")
+	select {
+	case <-high2.started:
+		t.Errorf("high priority job started while cores were reserved")
+	default:
+	}
+	close(large.release)
+	waitFor(t, high2.started, "second high priority job")
+	close(high2.release)
+}
+
+type memoryGeneratable struct {
+	*blockingGeneratable
+	memory int64
+}
+
+func (m memoryGeneratable) MemoryEstimate() int64 {
+	return m.memory
+}
+
+func TestMemoryBudget(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	queued := make(queueSink, 10)
+	SetEventSink(queued)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	scheduler := NewLocalScheduler()
+	scheduler.MemoryBudget = 100
+	scheduler.Launch()
+	defer scheduler.Quit()
+	first := memoryGeneratable{newBlocking("first", 1), 60}
+	second := memoryGeneratable{newBlocking("second", 1), 60}
+	small := memoryGeneratable{newBlocking("small", 1), 30}
+	for _, gen := range []Generatable{first, second, small} {
+		io := GeneratableIO{In: make(chan Generatable, 1), Out: make(chan GenerateFinished, 1)}
+		scheduler.AddChannel(io)
+		io.In <- gen
+		close(io.In)
+		<-queued
+	}
+	waitFor(t, first.started, "first job")
+	waitFor(t, small.started, "small job")
+	select {
+	case <-second.started:
+		t.Errorf("job started beyond the memory budget")
+	default:
+	}
+	close(first.release)
+	waitFor(t, second.started, "second job")
+	close(second.release)
+	close(small.release)
+}
+
+type timeoutGeneratable struct {
+	*blockingGeneratable
+	timeout time.Duration
+}
+
+func (t timeoutGeneratable) Timeout() time.Duration {
+	return t.timeout
+}
+
+func TestTimeout(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	scheduler := NewLocalScheduler()
+	scheduler.Timeout = time.Hour
+	scheduler.Launch()
+	defer scheduler.Quit()
+
+	// A job which cannot be stopped fails when it times out, but keeps its
+	// cores until it returns.
+	hung := timeoutGeneratable{newBlocking("hung", 1), 20 * time.Millisecond}
+	next := newBlocking("next", 1)
+	close(next.release)
+	io := GeneratableIO{In: make(chan Generatable, 2), Out: make(chan GenerateFinished, 2)}
+	scheduler.AddChannel(io)
+	io.In <- hung
+	io.In <- next
+	close(io.In)
+
+	fin := <-io.Out
+	if _, ok := fin.Err.(TimeoutError); fin.ID() != "hung" || !ok {
+		t.Errorf("expected a TimeoutError for hung, found %v: %v", fin.ID(), fin.Err)
+	}
+	select {
+	case <-next.started:
+		t.Errorf("job started on the cores of an abandoned job")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(hung.release)
+	fin = <-io.Out
+	if fin.ID() != "next" || fin.Err != nil {
+		t.Errorf("job after the timeout did not run: %v: %v", fin.ID(), fin.Err)
+	}
+
+	// A ContextRunner is stopped, and the next job starts once it returns.
+	stopped := stoppableGeneratable{GeneratableDataset{"stopped", 1}, 20 * time.Millisecond}
+	after := &flakyGeneratable{GeneratableDataset: GeneratableDataset{"after", 1}}
+	io = GeneratableIO{In: make(chan Generatable, 2), Out: make(chan GenerateFinished, 2)}
+	scheduler.AddChannel(io)
+	io.In <- stopped
+	io.In <- after
+	close(io.In)
+	errs := make(map[string]error)
+	for fin := range io.Out {
+		errs[fin.ID()] = fin.Err
+	}
+	if _, ok := errs["stopped"].(TimeoutError); !ok {
+		t.Errorf("expected a TimeoutError, found %v", errs["stopped"])
+	}
+	if err, ok := errs["after"]; !ok || err != nil {
+		t.Errorf("job after the stopped job did not run: %v", err)
+	}
+}
+
+// stoppableGeneratable runs until its context is cancelled.
+type stoppableGeneratable struct {
+	GeneratableDataset
+	timeout time.Duration
+}
+
+func (s stoppableGeneratable) Run() error {
+	return s.RunContext(context.Background())
+}
+
+func (s stoppableGeneratable) RunContext(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s stoppableGeneratable) Timeout() time.Duration {
+	return s.timeout
+}
+
+func TestShutdown(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+
+	first := newBlocking("first", 1)
+	second := newBlocking("second", 1)
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished, 2)}
+	scheduler.AddChannel(io)
+	io.In <- first
+	io.In <- second
+	waitFor(t, first.started, "first job")
+
+	// The input channel is never closed. Shutdown still runs the queued job
+	// and closes the output channel.
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- scheduler.Shutdown(context.Background())
+	}()
+	close(first.release)
+	waitFor(t, second.started, "queued job")
+	close(second.release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	var n int
+	for fin := range io.Out {
+		if fin.Err != nil {
+			t.Errorf("%v: unexpected error %v", fin.ID(), fin.Err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 finished jobs, found %v", n)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+
+	running := newBlocking("running", 1)
+	queued := newBlocking("queued", 1)
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished, 2)}
+	scheduler.AddChannel(io)
+	io.In <- running
+	io.In <- queued
+	waitFor(t, running.started, "running job")
+	scheduler.Quit()
+	scheduler.Quit()
+	close(io.In)
+	close(running.release)
+
+	errs := make(map[string]error)
+	for fin := range io.Out {
+		errs[fin.ID()] = fin.Err
+	}
+	if err, ok := errs["running"]; !ok || err != nil {
+		t.Errorf("running job: expected no error, found %v", err)
+	}
+	if errs["queued"] != ErrSchedulerStopped {
+		t.Errorf("queued job: expected ErrSchedulerStopped, found %v", errs["queued"])
+	}
+}
+
+func TestDeterministicScheduler(t *testing.T) {
+	run := func(seed int64) (*DeterministicScheduler, map[string]*Job) {
+		scheduler := NewDeterministicScheduler(seed)
+		scheduler.Faults = map[string]Fault{
+			"fail":  {Err: errors.New("injected")},
+			"panic": {Panic: "injected"},
+			"flaky": {Err: errors.New("injected"), Times: 1},
+			"slow":  {Delay: 10 * time.Millisecond},
+		}
+		scheduler.Launch()
+		defer scheduler.Quit()
+
+		graph := NewGraph()
+		graph.Retry = RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, Multiplier: 2}
+		jobs := make(map[string]*Job)
+		add := func(id string, deps ...*Job) *Job {
+			jobs[id] = graph.Add(&Job{
+				Phase: PhaseGenerate,
+				ID:    id,
+				Deps:  deps,
+				Run: func(submit SubmitFunc) ([]string, error) {
+					return nil, submit(&flakyGeneratable{GeneratableDataset: GeneratableDataset{id, 1}})
+				},
+			})
+			return jobs[id]
+		}
+		for _, id := range []string{"a", "b", "c", "fail", "flaky", "slow"} {
+			add(id)
+		}
+		add("after-panic", add("panic"))
+		add("after-a", jobs["a"])
+		graph.Run(context.Background(), scheduler)
+		return scheduler, jobs
+	}
+
+	first, jobs := run(1)
+	for id, status := range map[string]Status{
+		"a": StatusSucceeded, "slow": StatusSucceeded, "after-a": StatusSucceeded,
+		"fail": StatusFailed, "panic": StatusFailed, "after-panic": StatusFailed,
+		"flaky": StatusSucceeded,
+	} {
+		if jobs[id].Result.Status != status {
+			t.Errorf("%v: expected %v, found %v (%v)", id, status, jobs[id].Result.Status, jobs[id].Result.Err)
+		}
+	}
+	if _, ok := jobs["panic"].Result.Err.(PanicError); !ok {
+		t.Errorf("panic: expected a PanicError, found %v", jobs["panic"].Result.Err)
+	}
+	if _, ok := jobs["after-panic"].Result.Err.(DependencyError); !ok {
+		t.Errorf("after-panic: expected a DependencyError, found %v", jobs["after-panic"].Result.Err)
+	}
+	if len(jobs["flaky"].Result.Attempts) != 2 {
+		t.Errorf("flaky: expected 2 attempts, found %v", len(jobs["flaky"].Result.Attempts))
+	}
+
+	second, _ := run(1)
+	order := fmt.Sprint(first.Order())
+	if fmt.Sprint(second.Order()) != order {
+		t.Errorf("same seed gave orders %v and %v", order, second.Order())
+	}
+	var differs bool
+	for seed := int64(2); seed < 10 && !differs; seed++ {
+		other, _ := run(seed)
+		differs = fmt.Sprint(other.Order()) != order
+	}
+	if !differs {
+		t.Errorf("every seed gave order %v", order)
+	}
+}
+
+// TestDeterministicFaults runs settings through the pipeline with faults
+// injected into the dataset and training jobs.
+func TestDeterministicFaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newSettings := func(name string, data ...string) *Settings {
+		set := &Settings{
+			InputFeatures:  []string{"feat1"},
+			OutputFeatures: []string{"outfeat_1"},
+			Savepath:       filepath.Join(dir, name),
+		}
+		for _, id := range data {
+			set.TrainingData = append(set.TrainingData, &flakyGeneratable{GeneratableDataset: GeneratableDataset{id, 1}})
+		}
+		return set
+	}
+	failData := newSettings("fail_data", "fault_ok", "fault_err")
+	panicData := newSettings("panic_data", "fault_panic")
+	failTrain := newSettings("fail_train", "fault_ok", "fault_flaky")
+	panicTrain := newSettings("panic_train", "fault_ok")
+	sets := []*Settings{failData, panicData, failTrain, panicTrain}
+
+	injected := errors.New("injected")
+	isPanic := func(err error) bool {
+		_, ok := err.(PanicError)
+		return ok
+	}
+	// The failure expected for each of the settings.
+	expected := []struct {
+		phase   Phase
+		id      string
+		wantErr func(error) bool
+	}{
+		{PhaseGenerate, "fault_err", func(err error) bool { return err == injected }},
+		{PhaseGenerate, "fault_panic", isPanic},
+		{PhaseTrain, PredictorFilename(failTrain.Savepath), func(err error) bool { return err == injected }},
+		{PhaseTrain, PredictorFilename(panicTrain.Savepath), isPanic},
+	}
+
+	scheduler := NewDeterministicScheduler(1)
+	scheduler.Faults = map[string]Fault{
+		"fault_err":                            {Err: injected},
+		"fault_panic":                          {Panic: "injected"},
+		"fault_flaky":                          {Err: injected, Times: 1},
+		PredictorFilename(failTrain.Savepath):  {Err: injected},
+		PredictorFilename(panicTrain.Savepath): {Panic: "injected"},
+	}
+	defer scheduler.Quit()
+	p := &Pipeline{
+		Scheduler: scheduler,
+		Retry:     RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond},
+	}
+	reports, errs := p.Run(context.Background(), sets)
+
+	for i, want := range expected {
+		list, ok := errs[i].(ErrorList)
+		if !ok {
+			t.Errorf("case %v: expected an ErrorList, found %v", i, errs[i])
+			continue
+		}
+		var found bool
+		for _, err := range list {
+			jobErr, ok := err.(JobError)
+			if ok && jobErr.Phase == want.phase && jobErr.ID == want.id && want.wantErr(jobErr.Err) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("case %v: expected the fault of %v %v, found %v", i, want.phase, want.id, list)
+		}
+		if reports[i].Status != StatusFailed {
+			t.Errorf("case %v: expected status %v, found %v", i, StatusFailed, reports[i].Status)
+		}
+	}
+
+	// The flaky dataset succeeds when it is retried, so the training of its
+	// case runs and fails on both attempts. The dataset shared between cases
+	// is only run once.
+	var checked int
+	for _, phase := range reports[2].Phases {
+		switch {
+		case phase.Phase == PhaseGenerate && phase.ID == "fault_flaky":
+			checked++
+			if phase.Status != StatusSucceeded || len(phase.Attempts) != 2 {
+				t.Errorf("flaky dataset: expected success on the second attempt, found %v with %v attempts", phase.Status, len(phase.Attempts))
+			}
+		case phase.Phase == PhaseTrain:
+			checked++
+			if phase.Status != StatusFailed || len(phase.Attempts) != 2 {
+				t.Errorf("failing training: expected failure after 2 attempts, found %v with %v attempts", phase.Status, len(phase.Attempts))
+			}
+		}
+	}
+	if checked != 2 {
+		t.Errorf("expected reports of the flaky dataset and the training, found %v", reports[2].Phases)
+	}
+	var okRuns int
+	for _, id := range scheduler.Order() {
+		if id == "fault_ok" {
+			okRuns++
+		}
+	}
+	if okRuns != 1 {
+		t.Errorf("shared dataset run %v times", okRuns)
+	}
+
+	// Calling Quit before Launch does not panic, and AddChannel launches the
+	// scheduler.
+	NewDeterministicScheduler(1).Quit()
+	lazy := NewDeterministicScheduler(1)
+	defer lazy.Quit()
+	jobErrs := runJobs(t, lazy, []Generatable{&flakyGeneratable{GeneratableDataset: GeneratableDataset{"lazy", 1}}})
+	if err := jobErrs["lazy"]; err != nil {
+		t.Errorf("job on an unlaunched scheduler: %v", err)
+	}
+}
+
+// tableDataset is a dataset with the given columns.
+type tableDataset struct {
+	id      string
+	columns map[string][]float64
+}
+
+func (d *tableDataset) ID() string {
+	return d.id
+}
+
+func (d *tableDataset) Load(fields []string) (common.RowMatrix, error) {
+	n := len(d.columns[fields[0]])
+	m := mat64.NewDense(n, len(fields), nil)
+	for j, field := range fields {
+		col, ok := d.columns[field]
+		if !ok {
+			return nil, errors.New("no field " + field)
+		}
+		for i, v := range col {
+			m.Set(i, j, v)
+		}
+	}
+	return m, nil
+}
+
+func TestLoadStyles(t *testing.T) {
+	datasets := []Dataset{
+		&tableDataset{"first", map[string][]float64{"a": {1, 2, 3}, "b": {4, 5, 6}, "c": {7, 8, 9}}},
+		&tableDataset{"second", map[string][]float64{"a": {10}, "b": {11}, "c": {12}}},
+	}
+	inputFeatures := []string{"a", "b"}
+	outputFeatures := []string{"c", "a"}
+	weightFeatures := []string{"b"}
+	weightFunc := func(x []float64) float64 { return 2 * x[0] }
+
+	wantInputs := [][]float64{{1, 4}, {2, 5}, {3, 6}, {10, 11}}
+	wantOutputs := [][]float64{{7, 1}, {8, 2}, {9, 3}, {12, 10}}
+	wantWeights := []float64{8, 10, 12, 22}
+
+	for _, style := range []LoadStyle{DenseLoad, StreamLoad} {
+		inputs, outputs, weights, err := LoadTrainingData(datasets, style, inputFeatures, outputFeatures, weightFeatures, weightFunc)
+		if err != nil {
+			t.Fatalf("style %v: %v", style, err)
+		}
+		for i := range wantInputs {
+			for j, v := range wantInputs[i] {
+				if inputs.At(i, j) != v {
+					t.Errorf("style %v: input %v, %v: expected %v, found %v", style, i, j, v, inputs.At(i, j))
+				}
+			}
+			for j, v := range wantOutputs[i] {
+				if outputs.At(i, j) != v {
+					t.Errorf("style %v: output %v, %v: expected %v, found %v", style, i, j, v, outputs.At(i, j))
+				}
+			}
+			if weights[i] != wantWeights[i] {
+				t.Errorf("style %v: weight %v: expected %v, found %v", style, i, wantWeights[i], weights[i])
+			}
+		}
+		if r, _ := inputs.Dims(); r != len(wantInputs) {
+			t.Errorf("style %v: expected %v rows, found %v", style, len(wantInputs), r)
+		}
+	}
+
+	// Each dataset is loaded once.
+	counted := &sourceDataset{tableDataset: *datasets[0].(*tableDataset)}
+	_, _, _, err := LoadTrainingData([]Dataset{counted, datasets[1]}, StreamLoad, inputFeatures, outputFeatures, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counted.loads != 1 {
+		t.Errorf("expected the dataset to be loaded once, found %v loads", counted.loads)
+	}
+
+	// The chunks do not cross datasets.
+	it := NewChunkIterator(datasets, inputFeatures, outputFeatures, nil, 2)
+	var found [][3]int
+	for it.Next() {
+		c := it.Chunk()
+		found = append(found, [3]int{c.Dataset, c.Start, c.Rows()})
+		if c.Outputs.At(0, 1) != c.Inputs.At(0, 0) {
+			t.Errorf("chunk %v: output a does not match input a", c)
+		}
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if want := [][3]int{{0, 0, 2}, {0, 2, 1}, {1, 0, 1}}; fmt.Sprint(found) != fmt.Sprint(want) {
+		t.Errorf("expected chunks %v, found %v", want, found)
+	}
+
+	it = NewChunkIterator(append(datasets, &tableDataset{"missing", map[string][]float64{"a": {1}}}), inputFeatures, outputFeatures, nil, 2)
+	for it.Next() {
+	}
+	if it.Err() == nil || !strings.Contains(it.Err().Error(), "missing") {
+		t.Errorf("expected an error loading the missing dataset, found %v", it.Err())
+	}
+}
+
+// sourceDataset is a tableDataset loaded from a source file, which counts its
+// loads.
+type sourceDataset struct {
+	tableDataset
+	source string
+	loads  int
+}
+
+func (d *sourceDataset) SourceFiles() []string {
+	return []string{d.source}
+}
+
+func (d *sourceDataset) Load(fields []string) (common.RowMatrix, error) {
+	d.loads++
+	return d.tableDataset.Load(fields)
+}
+
+// specDataset is a sourceDataset with a load spec.
+type specDataset struct {
+	sourceDataset
+	spec string
+}
+
+func (d *specDataset) LoadSpec() string {
+	return d.spec
+}
+
+func TestFeatureCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "source.csv")
+	err = ioutil.WriteFile(source, []byte("original"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *FeatureCache) { DefaultFeatureCache = c }(DefaultFeatureCache)
+	cache := &FeatureCache{Dir: filepath.Join(dir, "cache")}
+	DefaultFeatureCache = cache
+
+	dataset := &sourceDataset{
+		tableDataset: tableDataset{"cached", map[string][]float64{"a": {1, 2, 3}, "b": {4, 5, 6}}},
+		source:       source,
+	}
+	load := func(loads int) {
+		inputs, outputs, _, err := LoadData(dataset, DenseLoad, []string{"a"}, []string{"b"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dataset.loads != loads {
+			t.Errorf("expected %v loads of the dataset, found %v", loads, dataset.loads)
+		}
+		for i := 0; i < 3; i++ {
+			if inputs.At(i, 0) != float64(i+1) || outputs.At(i, 0) != float64(i+4) {
+				t.Errorf("row %v: found %v, %v", i, inputs.At(i, 0), outputs.At(i, 0))
+			}
+		}
+	}
+	load(1)
+	load(1)
+
+	// The row count of cached features is read from the cache.
+	inputs, _, _, err := LoadData(dataset, StreamLoad, []string{"a"}, []string{"b"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := inputs.Dims(); r != 3 || dataset.loads != 1 {
+		t.Errorf("expected 3 rows from the cache, found %v rows and %v loads", r, dataset.loads)
+	}
+
+	// Different features are cached separately.
+	_, err = cache.Load(dataset, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataset.loads != 2 {
+		t.Errorf("expected the dataset to be loaded for new features")
+	}
+
+	// A change to the source file invalidates the cache.
+	err = ioutil.WriteFile(source, []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load(3)
+	load(3)
+
+	// A damaged cache file is ignored and written again.
+	files, err := filepath.Glob(filepath.Join(cache.Dir, "*.features"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		err = ioutil.WriteFile(file, []byte("RQFC"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	load(4)
+	load(4)
+
+	// A dataset with an unknown load spec, such as an ignore function with no
+	// spec, is loaded every time.
+	unknown := &specDataset{sourceDataset: sourceDataset{
+		tableDataset: tableDataset{"unknown", map[string][]float64{"a": {1}}},
+		source:       source,
+	}}
+	for loads := 1; loads <= 2; loads++ {
+		_, err = cache.Load(unknown, []string{"a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unknown.loads != loads {
+			t.Errorf("expected %v loads of the dataset with no spec, found %v", loads, unknown.loads)
+		}
+	}
+	unknown.spec = "known"
+	for i := 0; i < 2; i++ {
+		_, err = cache.Load(unknown, []string{"a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unknown.loads != 3 {
+		t.Errorf("expected the dataset with a spec to be cached, found %v loads", unknown.loads)
+	}
+}
+
+func TestNonFinite(t *testing.T) {
+	datasets := []Dataset{
+		&tableDataset{"finite", map[string][]float64{"a": {1, 2}, "b": {3, 4}}},
+		&tableDataset{"nonfinite", map[string][]float64{
+			"a": {1, math.Inf(1), 3, math.NaN(), 5},
+			"b": {6, 7, math.Inf(-1), 9, math.Inf(1)},
+		}},
+	}
+
+	// The package-level functions fail by default.
+	_, _, _, err := DenseLoadAll(datasets, []string{"a"}, []string{"b"}, nil, nil)
+	loadErr, ok := err.(LoadError)
+	if !ok || loadErr[0] != nil {
+		t.Fatalf("expected an error loading the second dataset, found %v", err)
+	}
+	nonFinite, ok := loadErr[1].(NonFiniteError)
+	if !ok {
+		t.Fatalf("expected a NonFiniteError, found %v", loadErr[1])
+	}
+	want := NonFiniteReport{
+		Dataset: "nonfinite",
+		Rows:    4,
+		Features: []NonFiniteCount{
+			{Feature: "a", NaN: 1, PosInf: 1, Samples: []int{1, 3}},
+			{Feature: "b", PosInf: 1, NegInf: 1, Samples: []int{2, 4}},
+		},
+	}
+	if fmt.Sprint(nonFinite.NonFiniteReport) != fmt.Sprint(want) {
+		t.Errorf("expected report %v, found %v", want, nonFinite.NonFiniteReport)
+	}
+
+	for _, test := range []struct {
+		policy  NonFinitePolicy
+		inputs  []float64
+		outputs []float64
+	}{
+		{NonFiniteDrop, []float64{1, 2, 1}, []float64{3, 4, 6}},
+		// The 9 of b is in the row dropped for its NaN, so +Inf is clamped
+		// to 7.
+		{NonFiniteClamp, []float64{1, 2, 1, 5, 3, 5}, []float64{3, 4, 6, 7, 6, 7}},
+	} {
+		for _, style := range []LoadStyle{DenseLoad, StreamLoad} {
+			loader := &Loader{NonFinite: test.policy}
+			inputs, outputs, _, err := loader.LoadTrainingData(datasets, style, []string{"a"}, []string{"b"}, nil, nil)
+			if err != nil {
+				t.Fatalf("policy %v: %v", test.policy, err)
+			}
+			reports := loader.Reports()
+			if len(reports) != 1 || fmt.Sprint(reports[0]) != fmt.Sprint(want) {
+				t.Errorf("policy %v: expected reports [%v], found %v", test.policy, want, reports)
+			}
+			if r, _ := inputs.Dims(); r != len(test.inputs) {
+				t.Fatalf("policy %v: expected %v rows, found %v", test.policy, len(test.inputs), r)
+			}
+			for i := range test.inputs {
+				if inputs.At(i, 0) != test.inputs[i] || outputs.At(i, 0) != test.outputs[i] {
+					t.Errorf("policy %v: row %v: expected %v, %v, found %v, %v", test.policy, i,
+						test.inputs[i], test.outputs[i], inputs.At(i, 0), outputs.At(i, 0))
+				}
+			}
+		}
+	}
+
+	// A feature with no finite values cannot be clamped.
+	loader := &Loader{NonFinite: NonFiniteClamp}
+	infinite := &tableDataset{"infinite", map[string][]float64{"a": {1, 2}, "b": {math.Inf(1), math.Inf(-1)}}}
+	_, _, _, err = loader.DenseLoadAll([]Dataset{infinite}, []string{"a"}, []string{"b"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "no finite values") {
+		t.Errorf("expected an error clamping a feature with no finite values, found %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	set := &Settings{
+		TrainingData: []Dataset{
+			&tableDataset{"train1", map[string][]float64{"a": {4, 3, 2, 1}, "b": {0, 0, 0, 0}}},
+			&tableDataset{"train2", map[string][]float64{"a": {5, 6, 7, 8}, "b": {0, 0, 0, 0}}},
+		},
+		TestingData: []Dataset{
+			&tableDataset{"same", map[string][]float64{"a": {8, 7, 6, 5, 4, 3, 2, 1}, "b": {0, 0, 0, 0, 0, 0, 0, 0}}},
+			&tableDataset{"half", map[string][]float64{"a": {5, 6, 7, 8, 9, 10, 11, 12}, "b": {0, 0, 0, 0, 0, 0, 0, 0}}},
+			&tableDataset{"apart", map[string][]float64{"a": {20, 30}, "b": {0, 0}}},
+		},
+		InputFeatures:  []string{"a"},
+		OutputFeatures: []string{"b"},
+	}
+	report, err := ComputeStats(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	union := report.TrainingUnion.Features[0]
+	if union.Feature != "a" || union.N != 8 || union.Min != 1 || union.Max != 8 || union.Mean != 4.5 {
+		t.Errorf("unexpected training stats %v", union)
+	}
+	if len(union.Quantiles) != len(StatsQuantiles) || union.Quantiles[3] != 4 {
+		t.Errorf("unexpected training quantiles %v", union.Quantiles)
+	}
+	if first := report.Training[0].Features[0]; first.Max != 4 {
+		t.Errorf("unexpected stats of the first training dataset %v", first)
+	}
+
+	want := []FeatureShift{{"a", 0, 1}, {"a", 0.5, 3.0 / 7}, {"a", 1, 0}}
+	for i, shift := range report.Shift {
+		if shift.Dataset != set.TestingData[i].ID() {
+			t.Errorf("shift %v: expected dataset %v, found %v", i, set.TestingData[i].ID(), shift.Dataset)
+		}
+		if got := shift.Features[0]; math.Abs(got.KS-want[i].KS) > 1e-14 || math.Abs(got.Overlap-want[i].Overlap) > 1e-14 {
+			t.Errorf("%v: expected shift %v, found %v", shift.Dataset, want[i], got)
+		}
+		if b := shift.Features[1]; b.KS != 0 || b.Overlap != 1 {
+			t.Errorf("%v: expected no shift in b, found %v", shift.Dataset, b)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, StatsFilename)
+	err = report.Save(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved StatsReport
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(saved) != fmt.Sprint(*report) {
+		t.Errorf("saved report does not match")
+	}
+}
+
+func TestInputDomain(t *testing.T) {
+	// The training inputs lie close to the line y = x.
+	inputs := mat64.NewDense(20, 2, nil)
+	for i := 0; i < 20; i++ {
+		inputs.Set(i, 0, float64(i))
+		inputs.Set(i, 1, float64(i)+0.1*float64(i%2*2-1))
+	}
+	domain, err := NewInputDomain([]string{"x", "y"}, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.Min[0] != 0 || domain.Max[0] != 19 || domain.Min[1] != -0.1 || domain.Max[1] != 19.1 {
+		t.Errorf("unexpected bounds %v, %v", domain.Min, domain.Max)
+	}
+	var extrapolated int
+	for i := 0; i < 20; i++ {
+		if domain.Extrapolated(inputs.RawRowView(i)) {
+			extrapolated++
+		}
+	}
+	if extrapolated > 1 {
+		t.Errorf("expected at most one training point to be extrapolated, found %v", extrapolated)
+	}
+
+	for _, test := range []struct {
+		input        []float64
+		outOfBounds  bool
+		extrapolated bool
+	}{
+		{[]float64{10, 10}, false, false},
+		{[]float64{8, 12}, false, true}, // Within the bounds but far from the line
+		{[]float64{25, 25}, true, true},
+	} {
+		if domain.OutOfBounds(test.input) != test.outOfBounds {
+			t.Errorf("%v: expected out of bounds %v", test.input, test.outOfBounds)
+		}
+		if domain.Extrapolated(test.input) != test.extrapolated {
+			t.Errorf("%v: expected extrapolated %v, distance %v, threshold %v", test.input, test.extrapolated,
+				domain.Distance(test.input), domain.Threshold)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(PredictorDirectory(dir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = domain.Save(DomainFilename(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadInputDomain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Distance([]float64{8, 12}) != domain.Distance([]float64{8, 12}) || loaded.Threshold != domain.Threshold {
+		t.Errorf("loaded domain does not match")
+	}
+}
+
+func TestSchedulerMetrics(t *testing.T) {
+	m := NewSchedulerMetrics()
+	// The events are in the future so that the time since the metrics were
+	// created does not add to the busy time.
+	base := time.Now().Add(time.Hour)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+	// Both jobs have the same ID, as if two cases sent the same dataset, so
+	// they are told apart by Seq.
+	m.Event(Event{Time: at(0), Kind: EventJobQueued, ID: "a", Seq: 1, Cores: 2})
+	m.Event(Event{Time: at(0), Kind: EventJobQueued, ID: "a", Seq: 2, Cores: 1})
+	m.Event(Event{Time: at(1), Kind: EventJobStarted, ID: "a", Seq: 1, Cores: 2, AvailableCores: 2})
+	m.Event(Event{Time: at(3), Kind: EventJobStarted, ID: "a", Seq: 2, Cores: 1, AvailableCores: 1})
+	mid := m.Stats()
+	m.Event(Event{Time: at(5), Kind: EventJobFinished, ID: "a", Seq: 1, Status: StatusSucceeded})
+	m.Event(Event{Time: at(5), Kind: EventJobFinished, Phase: PhaseTrain, ID: "a", Status: StatusSucceeded})
+	m.Event(Event{Time: at(6), Kind: EventJobFinished, ID: "a", Seq: 2, Status: StatusFailed})
+	stats := m.Stats()
+
+	if stats.Queued != 0 || stats.Running != 0 || stats.BusyCores != 0 {
+		t.Errorf("expected no jobs left, found %v queued, %v running and %v busy cores", stats.Queued, stats.Running, stats.BusyCores)
+	}
+	if stats.Cores != 4 {
+		t.Errorf("cores: expected 4, found %v", stats.Cores)
+	}
+	if stats.Finished[StatusSucceeded] != 1 || stats.Finished[StatusFailed] != 1 {
+		t.Errorf("finished: expected one success and one failure, found %v", stats.Finished)
+	}
+	if stats.MeanWait() != 2*time.Second || stats.MeanRun() != 3500*time.Millisecond {
+		t.Errorf("expected mean wait 2s and run 3.5s, found %v and %v", stats.MeanWait(), stats.MeanRun())
+	}
+	if stats.BusyCoreSeconds != 11 {
+		t.Errorf("busy core seconds: expected 11, found %v", stats.BusyCoreSeconds)
+	}
+	if stats.MaxQueued() != 2 {
+		t.Errorf("max queued: expected 2, found %v", stats.MaxQueued())
+	}
+
+	since := stats.Since(mid)
+	if since.Waits != 0 || since.Runs != 2 || since.RunTotal != 7*time.Second || since.BusyCoreSeconds != 7 {
+		t.Errorf("since: expected 0 waits, 2 runs over 7s and 7 busy core seconds, found %v, %v over %v and %v",
+			since.Waits, since.Runs, since.RunTotal, since.BusyCoreSeconds)
+	}
+	if u := since.Utilization(); u != 7.0/12 {
+		t.Errorf("since: expected utilization %v, found %v", 7.0/12, u)
+	}
+
+	var b strings.Builder
+	err := stats.WritePrometheus(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"ransuq_cores 4",
+		`ransuq_jobs_finished_total{status="failed"} 1`,
+		"ransuq_job_wait_seconds_sum 4",
+		"ransuq_job_run_seconds_count 2",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("prometheus output missing %q:\n%v", line, b.String())
+		}
+	}
+}
+
+// remoteWrite is a job which writes Content to Path, relative to the working
+// directory. A file written by a worker process in another directory is only
+// seen by the coordinator if it is sent back.
+type remoteWrite struct {
+	Path    string
+	Content string
+	Fail    bool
+	Exit    bool // Exit the process without a result
+	Panic   bool
+
+	// Escape is also written, and is listed as an artifact only where the
+	// job is rebuilt, as if a worker sent back a file it was not asked for.
+	Escape  string
+	rebuilt bool
+}
+
+const remoteWriteKind = "test-write"
+
+func init() {
+	RegisterJobKind(remoteWriteKind, func(spec []byte) (Generatable, error) {
+		w := &remoteWrite{rebuilt: true}
+		return w, json.Unmarshal(spec, w)
+	})
+}
+
+func (w *remoteWrite) ID() string {
+	return w.Path
+}
+
+func (w *remoteWrite) Generated() bool {
+	return false
+}
+
+func (w *remoteWrite) NumCores() int {
+	return 1
+}
+
+func (w *remoteWrite) Run() error {
+	if w.Fail {
+		return errors.New("remote failure")
+	}
+	if w.Exit {
+		os.Exit(3)
+	}
+	if w.Panic {
+		panic("remote panic")
+	}
+	if w.Escape != "" {
+		err := ioutil.WriteFile(w.Escape, []byte(w.Content), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(w.Path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.Path, []byte(w.Content), 0600)
+}
+
+func (w *remoteWrite) Artifacts() []string {
+	if w.rebuilt && w.Escape != "" {
+		return []string{w.Path, w.Escape}
+	}
+	return []string{w.Path}
+}
+
+func (w *remoteWrite) JobSpec() (string, []byte, error) {
+	b, err := json.Marshal(w)
+	return remoteWriteKind, b, err
+}
+
+// remoteTrain is a job which saves a predictor and its fingerprint in
+// Savepath, as training on a worker would, and sends back the
+// TrainingArtifacts.
+type remoteTrain struct {
+	Savepath string
+}
+
+const remoteTrainKind = "test-train"
+
+func init() {
+	RegisterJobKind(remoteTrainKind, func(spec []byte) (Generatable, error) {
+		r := &remoteTrain{}
+		return r, json.Unmarshal(spec, r)
+	})
+}
+
+func (r *remoteTrain) ID() string {
+	return PredictorFilename(r.Savepath)
+}
+
+func (r *remoteTrain) Generated() bool {
+	return false
+}
+
+func (r *remoteTrain) NumCores() int {
+	return 1
+}
+
+func (r *remoteTrain) Run() error {
+	err := os.MkdirAll(PredictorDirectory(r.Savepath), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(PredictorFilename(r.Savepath), []byte("{}"), 0600)
+	if err != nil {
+		return err
+	}
+	f := &Fingerprint{InputFeatures: []string{"feat1"}}
+	return f.Save(PredictorDirectory(r.Savepath))
+}
+
+func (r *remoteTrain) Artifacts() []string {
+	return TrainingArtifacts(r.Savepath)
+}
+
+func (r *remoteTrain) JobSpec() (string, []byte, error) {
+	b, err := json.Marshal(r)
+	return remoteTrainKind, b, err
+}
+
+// remoteBlock is a job which runs until remoteBlockRelease is closed. Jobs
+// needing Requires only run on workers with that capability.
+type remoteBlock struct {
+	Name     string
+	Requires string
+}
+
+const remoteBlockKind = "test-block"
+
+var remoteBlockRelease chan struct{}
+
+func init() {
+	RegisterJobKind(remoteBlockKind, func(spec []byte) (Generatable, error) {
+		b := &remoteBlock{}
+		return b, json.Unmarshal(spec, b)
+	})
+}
+
+func (b *remoteBlock) ID() string {
+	return b.Name
+}
+
+func (b *remoteBlock) Generated() bool {
+	return false
+}
+
+func (b *remoteBlock) NumCores() int {
+	return 1
+}
+
+func (b *remoteBlock) Run() error {
+	<-remoteBlockRelease
+	return nil
+}
+
+func (b *remoteBlock) JobSpec() (string, []byte, error) {
+	j, err := json.Marshal(b)
+	return remoteBlockKind, j, err
+}
+
+func (b *remoteBlock) Requirements() []string {
+	if b.Requires == "" {
+		return nil
+	}
+	return []string{b.Requires}
+}
+
+func TestCoordinatorQuit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec := &recordSink{}
+	SetEventSink(rec)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+	remoteBlockRelease = make(chan struct{})
+
+	coordinator, err := ListenCoordinator("unix", filepath.Join(dir, "coordinator.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinator.PollInterval = 10 * time.Millisecond
+	coordinator.Launch()
+	w := &Worker{Name: "worker", Cores: 2}
+	workerErr := make(chan error)
+	go func() {
+		workerErr <- w.Run("unix", coordinator.Addr().String())
+	}()
+	for start := time.Now(); len(coordinator.Workers()) != 1; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the worker to connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first job runs on the worker and the second needs a capability the
+	// worker does not have, so it stays queued.
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished)}
+	coordinator.AddChannel(io)
+	io.In <- &remoteBlock{Name: "running"}
+	io.In <- &remoteBlock{Name: "unservable", Requires: "gpu"}
+	var started, reported bool
+	for start := time.Now(); !started || !reported; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the job to start and the unservable job to be reported")
+		}
+		for _, e := range rec.recorded() {
+			started = started || (e.Kind == EventJobStarted && e.ID == "running" && e.Worker == "worker")
+			reported = reported || (e.Kind == EventInfo && strings.Contains(e.Message, "unservable needs"))
+		}
+	}
+
+	coordinator.Quit()
+	io.In <- &remoteBlock{Name: "late"}
+	close(io.In)
+	errs := make(map[string]error)
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case fin, ok := <-io.Out:
+			if !ok {
+				done = true
+				break
+			}
+			errs[fin.ID()] = fin.Err
+		case <-timeout:
+			t.Fatal("timed out waiting for the jobs to fail")
+		}
+	}
+	for _, id := range []string{"running", "unservable", "late"} {
+		if err, ok := errs[id]; !ok || err != ErrSchedulerStopped {
+			t.Errorf("%v: expected ErrSchedulerStopped, found %v", id, err)
+		}
+	}
+
+	close(remoteBlockRelease)
+	if err := <-workerErr; err != nil {
+		t.Errorf("worker: %v", err)
+	}
+}
+
+// TestHelperWorker is run as a worker process by TestCoordinator.
+func TestHelperWorker(t *testing.T) {
+	address := os.Getenv("RANSUQ_TEST_COORDINATOR")
+	if address == "" {
+		return
+	}
+	w := &Worker{Name: os.Getenv("RANSUQ_TEST_WORKER"), Cores: 2}
+	err := w.Run("unix", address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "worker:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestCoordinator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	coordinator, err := ListenCoordinator("unix", filepath.Join(dir, "coordinator.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinator.Local = NewLocalScheduler()
+	coordinator.PollInterval = 100 * time.Millisecond
+	coordinator.Launch()
+
+	var workers []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("worker%v", i)
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperWorker$")
+		cmd.Dir = filepath.Join(dir, name)
+		cmd.Env = append(os.Environ(), "RANSUQ_TEST_COORDINATOR="+coordinator.Addr().String(), "RANSUQ_TEST_WORKER="+name)
+		cmd.Stderr = os.Stderr
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, cmd)
+	}
+	// Wait for both workers so that neither connects after the coordinator
+	// has quit.
+	for start := time.Now(); len(coordinator.Workers()) != len(workers); {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the workers to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var jobs []Generatable
+	for i := 0; i < 6; i++ {
+		jobs = append(jobs, &remoteWrite{Path: fmt.Sprintf("out/job%v.txt", i), Content: fmt.Sprint(i)})
+	}
+	jobs = append(jobs, &remoteWrite{Path: "out/failed.txt", Fail: true})
+	jobs = append(jobs, &remoteWrite{Path: "out/escape.txt", Escape: "escaped.txt"})
+	train := &remoteTrain{Savepath: "trained"}
+	jobs = append(jobs, train)
+	jobs = append(jobs, &flakyGeneratable{GeneratableDataset: GeneratableDataset{"local", 1}})
+
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished)}
+	coordinator.AddChannel(io)
+	go func() {
+		for _, job := range jobs {
+			io.In <- job
+		}
+		close(io.In)
+	}()
+	errs := make(map[string]error)
+	timeout := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case fin, ok := <-io.Out:
+			if !ok {
+				done = true
+				break
+			}
+			errs[fin.ID()] = fin.Err
+		case <-timeout:
+			t.Fatal("timed out waiting for the jobs")
+		}
+	}
+
+	if len(errs) != len(jobs) {
+		t.Errorf("expected %v finished jobs, found %v", len(jobs), len(errs))
+	}
+	for i := 0; i < 6; i++ {
+		path := fmt.Sprintf("out/job%v.txt", i)
+		if errs[path] != nil {
+			t.Errorf("%v: unexpected error %v", path, errs[path])
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("artifact not sent back: %v", err)
+			continue
+		}
+		if string(b) != fmt.Sprint(i) {
+			t.Errorf("%v: expected %q, found %q", path, fmt.Sprint(i), b)
+		}
+	}
+	if err := errs["out/failed.txt"]; err == nil || err.Error() != "remote failure" {
+		t.Errorf("expected the remote error, found %v", err)
+	}
+	if err := errs["out/escape.txt"]; err == nil || !strings.Contains(err.Error(), "escaped.txt is not an artifact") {
+		t.Errorf("expected the job sending back another file to fail, found %v", err)
+	}
+	for _, path := range []string{"out/escape.txt", "escaped.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("%v written by the coordinator", path)
+		}
+	}
+	if err := errs[train.ID()]; err != nil {
+		t.Errorf("training failed: %v", err)
+	}
+	f, err := LoadFingerprint(PredictorDirectory(filepath.Join(dir, train.Savepath)))
+	if err != nil {
+		t.Errorf("fingerprint of the trained predictor not sent back: %v", err)
+	} else if fmt.Sprint(f.InputFeatures) != "[feat1]" {
+		t.Errorf("wrong fingerprint sent back: %+v", f)
+	}
+	if err := errs["local"]; err != nil {
+		t.Errorf("local job failed: %v", err)
+	}
+
+	coordinator.Quit()
+	for i, cmd := range workers {
+		err := cmd.Wait()
+		if err != nil {
+			t.Errorf("worker %v: %v", i, err)
+		}
+	}
+}
+
+// TestHelperBatchJob is run by the scripts submitted in TestBatchScheduler.
+func TestHelperBatchJob(t *testing.T) {
+	if os.Getenv("RANSUQ_TEST_BATCH") == "" {
+		return
+	}
+	args := flag.Args()
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "batch job: expected spec and result files, found", args)
+		os.Exit(2)
+	}
+	err := RunJobFile(args[0], args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "batch job:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// The fake batch system runs each script in the background. The ID of a job is
+// its script, which is marked when the job exits.
+const (
+	fakeSubmit = `#!/bin/sh
+(RANSUQ_TEST_BATCH=1 sh "$1"; touch "$1.exit") > "$1.out" 2>&1 &
+echo "$1;fake"
+`
+	fakeStatus = `#!/bin/sh
+[ -e "$1.exit" ] || echo "$1"
+`
+)
+
+func TestBatchScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, script := range map[string]string{"submit": fakeSubmit, "status": fakeStatus} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scheduler := &BatchScheduler{
+		Local:        NewLocalScheduler(),
+		Dir:          filepath.Join(dir, "jobs"),
+		Submit:       []string{filepath.Join(dir, "submit")},
+		Status:       []string{filepath.Join(dir, "status")},
+		Runner:       []string{os.Args[0], "-test.run=^TestHelperBatchJob$", "--"},
+		PollInterval: 50 * time.Millisecond,
+	}
+	scheduler.Launch()
+	defer scheduler.Quit()
+
+	var jobs []Generatable
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, &remoteWrite{Path: filepath.Join(dir, "out", fmt.Sprintf("job%v.txt", i)), Content: fmt.Sprint(i)})
+	}
+	failed := &remoteWrite{Path: filepath.Join(dir, "failed.txt"), Fail: true}
+	exited := &remoteWrite{Path: filepath.Join(dir, "exited.txt"), Exit: true}
+	jobs = append(jobs, failed, exited, &flakyGeneratable{GeneratableDataset: GeneratableDataset{"local", 1}})
+
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished)}
+	scheduler.AddChannel(io)
+	go func() {
+		for _, job := range jobs {
+			io.In <- job
+		}
+		close(io.In)
+	}()
+	errs := make(map[string]error)
+	timeout := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case fin, ok := <-io.Out:
+			if !ok {
+				done = true
+				break
+			}
+			errs[fin.ID()] = fin.Err
+		case <-timeout:
+			t.Fatal("timed out waiting for the jobs")
+		}
+	}
+
+	if len(errs) != len(jobs) {
+		t.Errorf("expected %v finished jobs, found %v", len(jobs), len(errs))
+	}
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, "out", fmt.Sprintf("job%v.txt", i))
+		if errs[path] != nil {
+			t.Errorf("job %v: unexpected error %v", i, errs[path])
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("job %v: %v", i, err)
+			continue
+		}
+		if string(b) != fmt.Sprint(i) {
+			t.Errorf("job %v: expected %q, found %q", i, fmt.Sprint(i), b)
+		}
+	}
+	if err := errs[failed.ID()]; err == nil || err.Error() != "remote failure" {
+		t.Errorf("expected the error of the job, found %v", err)
+	}
+	if err := errs[exited.ID()]; err == nil || !strings.Contains(err.Error(), "without a result") {
+		t.Errorf("expected an error for the job without a result, found %v", err)
+	}
+	if err := errs["local"]; err != nil {
+		t.Errorf("local job failed: %v", err)
+	}
+}
+
+func TestBatchSchedulerQuit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rec := &recordSink{}
+	SetEventSink(rec)
+	defer SetEventSink(QuietSink{W: os.Stdout})
+
+	// Quitting before launching does not panic.
+	(&BatchScheduler{}).Quit()
+
+	// The jobs are submitted but never run, so only Quit finishes them. The
+	// PollInterval is left as zero. Cancelled jobs are recorded in a file.
+	cancelled := filepath.Join(dir, "cancelled")
+	scheduler := &BatchScheduler{
+		Dir:    filepath.Join(dir, "jobs"),
+		Submit: []string{"echo", "never-run"},
+		Cancel: []string{"sh", "-c", `echo "$1" >> "$0"`, cancelled},
+		Runner: []string{"false"},
+	}
+	scheduler.Launch()
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished)}
+	scheduler.AddChannel(io)
+	io.In <- &remoteWrite{Path: filepath.Join(dir, "submitted.txt")}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		var started bool
+		for _, e := range rec.recorded() {
+			started = started || e.Kind == EventJobStarted
+		}
+		if started {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the job to be submitted")
+		}
+	}
+	scheduler.Quit()
+	io.In <- &remoteWrite{Path: filepath.Join(dir, "late.txt")}
+	close(io.In)
+
+	errs := make(map[string]error)
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case fin, ok := <-io.Out:
+			if !ok {
+				done = true
+				break
+			}
+			errs[fin.ID()] = fin.Err
+		case <-timeout:
+			t.Fatal("timed out waiting for the jobs to fail")
+		}
+	}
+	for _, name := range []string{"submitted.txt", "late.txt"} {
+		if err, ok := errs[filepath.Join(dir, name)]; !ok || err != ErrSchedulerStopped {
+			t.Errorf("%v: expected ErrSchedulerStopped, found %v", name, err)
+		}
+	}
+	if b, err := ioutil.ReadFile(cancelled); err != nil || string(b) != "never-run\n" {
+		t.Errorf("expected the submitted job to be cancelled, found %q, %v", b, err)
+	}
+
+	// A submit command which prints no job ID fails the job.
+	scheduler = &BatchScheduler{
+		Dir:    filepath.Join(dir, "jobs"),
+		Submit: []string{"true"},
+		Runner: []string{"false"},
+	}
+	scheduler.Launch()
+	defer scheduler.Quit()
+	noID := &remoteWrite{Path: filepath.Join(dir, "noid.txt")}
+	errs = runJobs(t, scheduler, []Generatable{noID})
+	if err := errs[noID.ID()]; err == nil || !strings.Contains(err.Error(), "no job ID") {
+		t.Errorf("expected an error for the missing job ID, found %v", err)
+	}
+}
+
+// runJobs sends the jobs to the scheduler and returns their errors by ID.
+func runJobs(t *testing.T, scheduler Scheduler, jobs []Generatable) map[string]error {
+	io := GeneratableIO{In: make(chan Generatable), Out: make(chan GenerateFinished)}
+	scheduler.AddChannel(io)
+	go func() {
+		for _, job := range jobs {
+			io.In <- job
+		}
+		close(io.In)
+	}()
+	errs := make(map[string]error)
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case fin, ok := <-io.Out:
+			if !ok {
+				if len(errs) != len(jobs) {
+					t.Errorf("expected %v finished jobs, found %v", len(jobs), len(errs))
+				}
+				return errs
+			}
+			errs[fin.ID()] = fin.Err
+		case <-timeout:
+			t.Fatal("timed out waiting for the jobs")
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	scheduler := NewLocalScheduler()
+	scheduler.Launch()
+	defer scheduler.Quit()
+
+	errs := runJobs(t, scheduler, []Generatable{
+		&remoteWrite{Path: "panic", Panic: true},
+		&GeneratableDataset{"big", 1 << 20},
+		&flakyGeneratable{GeneratableDataset: GeneratableDataset{"next", 1}},
+	})
+	if err, ok := errs["panic"].(PanicError); !ok || err.Value != "remote panic" || len(err.Stack) == 0 {
+		t.Errorf("expected a PanicError with a stack, found %v", errs["panic"])
+	}
+	if err := errs["big"]; err == nil || !strings.Contains(err.Error(), "not enough available cores") {
+		t.Errorf("expected an error for too many cores, found %v", err)
+	}
+	if err := errs["next"]; err != nil {
+		t.Errorf("job after the panic failed: %v", err)
+	}
+}
+
+// TestHelperSubprocess is run as a child process by TestSubprocess.
+func TestHelperSubprocess(t *testing.T) {
+	RunSubprocessJob()
+}
+
+func TestSubprocess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scheduler := NewLocalScheduler()
+	scheduler.Subprocess = true
+	scheduler.SubprocessCommand = []string{os.Args[0], "-test.run=^TestHelperSubprocess$"}
+	scheduler.Launch()
+	defer scheduler.Quit()
+
+	written := &remoteWrite{Path: filepath.Join(dir, "written.txt"), Content: "written"}
+	failed := &remoteWrite{Path: filepath.Join(dir, "failed.txt"), Fail: true}
+	exited := &remoteWrite{Path: filepath.Join(dir, "exited.txt"), Exit: true}
+	panicked := &remoteWrite{Path: filepath.Join(dir, "panicked.txt"), Panic: true}
+	errs := runJobs(t, scheduler, []Generatable{written, failed, exited, panicked,
+		&flakyGeneratable{GeneratableDataset: GeneratableDataset{"local", 1}}})
+
+	if err := errs[written.ID()]; err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if b, err := ioutil.ReadFile(written.Path); err != nil || string(b) != "written" {
+		t.Errorf("expected the child to write the file, found %q, %v", b, err)
+	}
+	if err := errs[failed.ID()]; err == nil || err.Error() != "remote failure" {
+		t.Errorf("expected the error of the job, found %v", err)
+	}
+	if _, ok := errs[exited.ID()].(SubprocessError); !ok {
+		t.Errorf("expected a SubprocessError, found %v", errs[exited.ID()])
+	}
+	if err := errs[panicked.ID()]; err == nil || !strings.Contains(err.Error(), "panic: remote panic") {
+		t.Errorf("expected the panic of the child, found %v", err)
+	}
+	if err := errs["local"]; err != nil {
+		t.Errorf("local job failed: %v", err)
+	}
+}
@@ -0,0 +1,655 @@
+package ransuq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CapabilitySU2 is the capability of a worker which can run SU2.
+const CapabilitySU2 = "su2"
+
+// A RemoteGeneratable is a Generatable which can be run by a Worker. JobSpec
+// returns the kind of the job and the data needed to rebuild it. The worker
+// rebuilds the job with the function registered for the kind, so the kind
+// must be registered in the worker program as well.
+type RemoteGeneratable interface {
+	Generatable
+	JobSpec() (kind string, spec []byte, err error)
+}
+
+// A Requirer is a Generatable which can only be run by workers with all of
+// the capabilities it returns.
+type Requirer interface {
+	Requirements() []string
+}
+
+var (
+	jobKindMux sync.RWMutex
+	jobKinds   = make(map[string]func(spec []byte) (Generatable, error))
+)
+
+// RegisterJobKind sets the function a worker uses to rebuild jobs of the kind
+// from their spec. It is normally called from init.
+func RegisterJobKind(kind string, rebuild func(spec []byte) (Generatable, error)) {
+	jobKindMux.Lock()
+	jobKinds[kind] = rebuild
+	jobKindMux.Unlock()
+}
+
+func rebuildJob(kind string, spec []byte) (Generatable, error) {
+	jobKindMux.RLock()
+	rebuild, ok := jobKinds[kind]
+	jobKindMux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("job kind %q not registered", kind)
+	}
+	return rebuild(spec)
+}
+
+// WorkerInfo describes a worker to the coordinator.
+type WorkerInfo struct {
+	Name         string
+	Cores        int
+	Capabilities []string
+}
+
+// PullArgs is a request from a worker for a job.
+type PullArgs struct {
+	FreeCores int
+}
+
+// Task is a job sent to a worker. A Task with an ID of zero means there was no
+// job for the worker.
+type Task struct {
+	ID       int
+	JobID    string // ID of the Generatable
+	Kind     string
+	Spec     []byte
+	Cores    int
+	Shutdown bool // The coordinator has quit
+}
+
+// TaskResult is the outcome of a Task run by a worker.
+type TaskResult struct {
+	ID        int
+	Err       string
+	Artifacts []ArtifactFile
+}
+
+// ArtifactFile is a file produced by a task.
+type ArtifactFile struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// DefaultPollInterval is the PollInterval of a new Coordinator.
+const DefaultPollInterval = time.Second
+
+// Coordinator is a Scheduler which sends jobs to workers connected over the
+// network. Workers pull jobs which fit in their free cores and have the
+// capabilities the job requires. The artifacts of each job are sent back and
+// written to the same paths on the coordinator. A job fails if its worker
+// sends back a file outside of the Artifacts of the job. Jobs running on a
+// worker whose connection is lost are queued again. A job which none of the connected
+// workers can run is reported, and stays queued until a worker which can run
+// it connects.
+type Coordinator struct {
+	// Local runs the Generatables which are not RemoteGeneratables, such as
+	// training. If it is nil, they fail.
+	Local Scheduler
+
+	// PollInterval is the longest a request from a worker waits for a job.
+	// The worker then asks again with its current number of free cores.
+	PollInterval time.Duration
+
+	listener net.Listener
+	launch   sync.Once
+
+	mux     sync.Mutex
+	changed chan struct{} // Closed and replaced when the queue changes
+	queue   []*remoteTask
+	running map[int]*remoteTask
+	workers map[*workerConn]bool
+	nextID  int
+	quit    bool
+}
+
+type remoteTask struct {
+	Task
+	gen      Generatable
+	seq      uint64
+	reqs     []string
+	worker   *workerConn
+	finish   func(error)
+	reported bool // Whether the task was reported as unservable
+}
+
+// NewCoordinator returns a coordinator which accepts workers on the listener.
+func NewCoordinator(l net.Listener) *Coordinator {
+	return &Coordinator{
+		PollInterval: DefaultPollInterval,
+		listener:     l,
+		changed:      make(chan struct{}),
+		running:      make(map[int]*remoteTask),
+		workers:      make(map[*workerConn]bool),
+	}
+}
+
+// ListenCoordinator returns a coordinator listening on the address. The
+// network is "tcp" or "unix".
+func ListenCoordinator(network, address string) (*Coordinator, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewCoordinator(l), nil
+}
+
+// Addr returns the address workers connect to.
+func (c *Coordinator) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Workers returns the workers which are connected.
+func (c *Coordinator) Workers() []WorkerInfo {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var infos []WorkerInfo
+	for w := range c.workers {
+		infos = append(infos, w.info)
+	}
+	return infos
+}
+
+// Launch starts accepting workers. Calling Launch again has no effect.
+func (c *Coordinator) Launch() {
+	c.launch.Do(func() {
+		if c.Local != nil {
+			c.Local.Launch()
+		}
+		go c.serve()
+	})
+}
+
+// Quit stops accepting workers and tells the connected workers to stop. Queued
+// jobs, jobs running on workers, and jobs received afterwards fail with
+// ErrSchedulerStopped. The results of jobs still running on workers are
+// ignored.
+func (c *Coordinator) Quit() {
+	c.mux.Lock()
+	c.quit = true
+	stopped := c.queue
+	c.queue = nil
+	for id, t := range c.running {
+		delete(c.running, id)
+		stopped = append(stopped, t)
+	}
+	c.notify()
+	c.mux.Unlock()
+	for _, t := range stopped {
+		c.fail(t, ErrSchedulerStopped)
+	}
+	c.listener.Close()
+	if c.Local != nil {
+		c.Local.Quit()
+	}
+}
+
+func (c *Coordinator) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.serveConn(conn)
+	}
+}
+
+// serveConn serves the requests of one worker. Each connection has its own
+// RPC server so that the coordinator knows which worker made a request.
+func (c *Coordinator) serveConn(conn net.Conn) {
+	w := &workerConn{c: c}
+	server := rpc.NewServer()
+	server.RegisterName("Coordinator", w)
+	server.ServeConn(conn)
+	c.dropWorker(w)
+}
+
+// notify wakes the waiting requests and reports the queued tasks which none of
+// the connected workers can run. The lock must be held.
+func (c *Coordinator) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+	if len(c.workers) == 0 {
+		return
+	}
+	for _, t := range c.queue {
+		if t.reported || c.servable(t) {
+			continue
+		}
+		t.reported = true
+		Infof("%v needs %v cores and capabilities %v, which no connected worker has. It stays queued until such a worker connects", t.JobID, t.Cores, t.reqs)
+	}
+}
+
+// servable returns whether a connected worker could run the task once it has
+// enough free cores. The lock must be held.
+func (c *Coordinator) servable(t *remoteTask) bool {
+	for w := range c.workers {
+		if t.Cores <= w.info.Cores && w.info.has(t.reqs) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail finishes the task with the error.
+func (c *Coordinator) fail(t *remoteTask, err error) {
+	emitJob(t.gen, Event{Kind: EventJobFinished, ID: t.JobID, Seq: t.seq, Status: statusOf(err), Error: errString(err)})
+	go t.finish(err)
+}
+
+// dropWorker queues the tasks of a disconnected worker again.
+func (c *Coordinator) dropWorker(w *workerConn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.workers, w)
+	var requeued []*remoteTask
+	for id, t := range c.running {
+		if t.worker != w {
+			continue
+		}
+		delete(c.running, id)
+		t.worker = nil
+		requeued = append(requeued, t)
+	}
+	if w.info.Name != "" {
+		Infof("lost worker %v, queueing its %v jobs again", w.info.Name, len(requeued))
+	}
+	c.queue = append(requeued, c.queue...)
+	c.notify()
+}
+
+// AddChannel receives Generatables on the input channel and sends each one to
+// a worker, or to Local if it is not a RemoteGeneratable.
+func (c *Coordinator) AddChannel(io GeneratableIO) {
+	splitChannel(io, c.Local, "coordinator", c.enqueue)
+}
+
+// splitChannel passes the RemoteGeneratables received on the input channel to
+// enqueue and the others to the local scheduler. Each job is finished by
+// calling the function passed to enqueue. The output channel is closed once
+// the input channel is closed and every job has finished.
+func splitChannel(io GeneratableIO, local Scheduler, name string, enqueue func(Generatable, RemoteGeneratable, func(error))) {
+	go func() {
+		wg := &sync.WaitGroup{}
+		var localIO *GeneratableIO
+		for gen := range io.In {
+			wg.Add(1)
+			finish := func(gen Generatable) func(error) {
+				return func(err error) {
+					io.Out <- GenerateFinished{gen, err}
+					wg.Done()
+				}
+			}(gen)
+			inner, _, _ := unwrapGeneratable(gen)
+			r, ok := inner.(RemoteGeneratable)
+			if ok {
+				enqueue(gen, r, finish)
+				continue
+			}
+			if local == nil {
+				go finish(errors.New(name + ": " + gen.ID() + " cannot be run remotely and there is no local scheduler"))
+				continue
+			}
+			if localIO == nil {
+				localIO = &GeneratableIO{
+					In:  make(chan Generatable),
+					Out: make(chan GenerateFinished),
+				}
+				local.AddChannel(*localIO)
+				go func(out chan GenerateFinished) {
+					for fin := range out {
+						io.Out <- fin
+						wg.Done()
+					}
+				}(localIO.Out)
+			}
+			localIO.In <- gen
+		}
+		if localIO != nil {
+			close(localIO.In)
+		}
+		wg.Wait()
+		close(io.Out)
+	}()
+}
+
+func (c *Coordinator) enqueue(gen Generatable, r RemoteGeneratable, finish func(error)) {
+	if t, ok := gen.(*trackedGeneratable); ok && t.ctx.Err() != nil {
+		go finish(ErrSkipped)
+		return
+	}
+	kind, spec, err := r.JobSpec()
+	if err != nil {
+		go finish(err)
+		return
+	}
+	t := &remoteTask{
+		Task: Task{
+			JobID: gen.ID(),
+			Kind:  kind,
+			Spec:  spec,
+			Cores: gen.NumCores(),
+		},
+		gen:    gen,
+		seq:    nextJobSeq(),
+		finish: finish,
+	}
+	if req, ok := r.(Requirer); ok {
+		t.reqs = req.Requirements()
+	}
+	c.mux.Lock()
+	if c.quit {
+		c.mux.Unlock()
+		c.fail(t, ErrSchedulerStopped)
+		return
+	}
+	c.nextID++
+	t.ID = c.nextID
+	c.queue = append(c.queue, t)
+	c.notify()
+	c.mux.Unlock()
+	emitJob(t.gen, Event{Kind: EventJobQueued, ID: t.JobID, Seq: t.seq, Cores: t.Cores})
+}
+
+// take removes the first queued task the worker can run from the queue. Tasks
+// whose context was cancelled while queued are removed and finished with the
+// error of the context. The lock must be held.
+func (c *Coordinator) take(w *workerConn, freeCores int) *remoteTask {
+	for i, t := range c.queue {
+		if tr, ok := t.gen.(*trackedGeneratable); ok && tr.ctx.Err() != nil {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			c.fail(t, tr.ctx.Err())
+			return c.take(w, freeCores)
+		}
+		if t.Cores > freeCores || !w.info.has(t.reqs) {
+			continue
+		}
+		c.queue = append(c.queue[:i], c.queue[i+1:]...)
+		t.worker = w
+		c.running[t.ID] = t
+		if tr, ok := t.gen.(*trackedGeneratable); ok {
+			tr.start = time.Now()
+		}
+		return t
+	}
+	return nil
+}
+
+func (info WorkerInfo) has(reqs []string) bool {
+	for _, req := range reqs {
+		var found bool
+		for _, c := range info.Capabilities {
+			if c == req {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// workerConn is the RPC service for the connection to one worker.
+type workerConn struct {
+	c    *Coordinator
+	info WorkerInfo
+}
+
+// Register records the description of the worker.
+func (w *workerConn) Register(info WorkerInfo, ok *bool) error {
+	if info.Name == "" {
+		return errors.New("coordinator: worker has no name")
+	}
+	w.c.mux.Lock()
+	w.info = info
+	w.c.workers[w] = true
+	w.c.notify()
+	w.c.mux.Unlock()
+	Infof("worker %v connected with %v cores and capabilities %v", info.Name, info.Cores, info.Capabilities)
+	*ok = true
+	return nil
+}
+
+// Pull returns a job which fits in the free cores of the worker. If there is
+// none within the PollInterval, the Task has an ID of zero.
+func (w *workerConn) Pull(args PullArgs, task *Task) error {
+	c := w.c
+	timeout := time.After(c.PollInterval)
+	c.mux.Lock()
+	if w.info.Name == "" {
+		c.mux.Unlock()
+		return errors.New("coordinator: worker not registered")
+	}
+	for {
+		if c.quit {
+			c.mux.Unlock()
+			task.Shutdown = true
+			return nil
+		}
+		if t := c.take(w, args.FreeCores); t != nil {
+			c.mux.Unlock()
+			*task = t.Task
+			emitJob(t.gen, Event{Kind: EventJobStarted, ID: t.JobID, Seq: t.seq, Cores: t.Cores, Worker: w.info.Name})
+			return nil
+		}
+		changed := c.changed
+		c.mux.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+		c.mux.Lock()
+	}
+}
+
+// Complete records the result of a task and writes its artifacts.
+func (w *workerConn) Complete(result TaskResult, ok *bool) error {
+	c := w.c
+	c.mux.Lock()
+	t, found := c.running[result.ID]
+	if found && t.worker == w {
+		delete(c.running, result.ID)
+	} else {
+		found = false
+	}
+	c.mux.Unlock()
+	if !found {
+		return fmt.Errorf("coordinator: task %v is not running on worker %v", result.ID, w.info.Name)
+	}
+	var err error
+	if result.Err != "" {
+		err = errors.New(result.Err)
+	}
+	inner, _, _ := unwrapGeneratable(t.gen)
+	if werr := writeArtifacts(result.Artifacts, artifactsOf(inner)); werr != nil && err == nil {
+		err = errors.New("error writing artifacts: " + werr.Error())
+	}
+	if tr, ok := t.gen.(*trackedGeneratable); ok {
+		tr.end = time.Now()
+	}
+	emitJob(t.gen, Event{Kind: EventJobFinished, ID: t.JobID, Seq: t.seq, Status: statusOf(err), Error: errString(err), Worker: w.info.Name})
+	t.finish(err)
+	*ok = true
+	return nil
+}
+
+// Worker runs jobs pulled from a Coordinator.
+type Worker struct {
+	Name         string
+	Cores        int
+	Capabilities []string
+}
+
+// Run connects to the coordinator at the address and runs jobs until the
+// coordinator quits or the connection fails. The network is "tcp" or "unix".
+func (w *Worker) Run(network, address string) error {
+	client, err := rpc.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var ok bool
+	err = client.Call("Coordinator.Register", WorkerInfo{Name: w.Name, Cores: w.Cores, Capabilities: w.Capabilities}, &ok)
+	if err != nil {
+		return err
+	}
+
+	mux := &sync.Mutex{}
+	cond := sync.NewCond(mux)
+	free := w.Cores
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		mux.Lock()
+		for free == 0 {
+			cond.Wait()
+		}
+		nFree := free
+		mux.Unlock()
+
+		var task Task
+		err := client.Call("Coordinator.Pull", PullArgs{FreeCores: nFree}, &task)
+		if err != nil {
+			return err
+		}
+		if task.Shutdown {
+			return nil
+		}
+		if task.ID == 0 {
+			continue
+		}
+		mux.Lock()
+		free -= task.Cores
+		mux.Unlock()
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			result := runTask(task)
+			var ok bool
+			err := client.Call("Coordinator.Complete", result, &ok)
+			if err != nil {
+				Infof("error sending the result of %v: %v", task.JobID, err)
+			}
+			mux.Lock()
+			free += task.Cores
+			mux.Unlock()
+			cond.Signal()
+		}(task)
+	}
+}
+
+// runTask rebuilds and runs the job of the task and collects its artifacts.
+func runTask(task Task) TaskResult {
+	result := TaskResult{ID: task.ID}
+	gen, err := rebuildJob(task.Kind, task.Spec)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	seq := nextJobSeq()
+	Emit(Event{Kind: EventJobStarted, ID: task.JobID, Seq: seq, Cores: task.Cores})
+	err = newTracked(gen, context.Background()).Run()
+	Emit(Event{Kind: EventJobFinished, ID: task.JobID, Seq: seq, Status: statusOf(err), Error: errString(err)})
+	if err != nil {
+		result.Err = err.Error()
+	}
+	result.Artifacts, err = readArtifacts(artifactsOf(gen))
+	if err != nil && result.Err == "" {
+		result.Err = "error reading artifacts: " + err.Error()
+	}
+	return result
+}
+
+// readArtifacts reads the files, and the files in the directories, which
+// exist.
+func readArtifacts(paths []string) ([]ArtifactFile, error) {
+	var files []ArtifactFile
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			files = append(files, ArtifactFile{Path: name, Mode: info.Mode().Perm(), Data: data})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeArtifacts writes the files sent back by a worker. Each file must be one
+// of the artifacts of the job or lie in one of them, so that a worker cannot
+// write anywhere else. No file is written if any of them is not allowed.
+func writeArtifacts(files []ArtifactFile, artifacts []string) error {
+	for _, f := range files {
+		if !inArtifacts(f.Path, artifacts) {
+			return fmt.Errorf("%v is not an artifact of the job", f.Path)
+		}
+	}
+	for _, f := range files {
+		path := filepath.Clean(f.Path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, f.Data, f.Mode.Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inArtifacts returns whether the path is one of the artifacts or lies in the
+// directory of one of them.
+func inArtifacts(path string, artifacts []string) bool {
+	path = filepath.Clean(path)
+	for _, artifact := range artifacts {
+		rel, err := filepath.Rel(filepath.Clean(artifact), path)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
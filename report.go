@@ -0,0 +1,218 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phase is a step in running a settings case.
+type Phase string
+
+const (
+	PhaseGenerate    Phase = "generate-data" // Generating one of the datasets
+	PhaseTrain       Phase = "train"         // Training the algorithm
+	PhaseCompare     Phase = "compare"       // Running a comparison with the trained algorithm
+	PhasePostprocess Phase = "postprocess"   // Plotting the predictions on the data
+)
+
+// Phases lists every phase in the order they are run.
+var Phases = []Phase{PhaseGenerate, PhaseTrain, PhaseCompare, PhasePostprocess}
+
+// ParsePhases parses a comma-separated list of phases.
+func ParsePhases(s string) ([]Phase, error) {
+	var phases []Phase
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		var found bool
+		for _, p := range Phases {
+			if Phase(str) == p {
+				phases = append(phases, p)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown phase %q, options are %v", str, Phases)
+		}
+	}
+	return phases, nil
+}
+
+// phaseSelection is the set of phases chosen to run. A nil selection runs
+// every phase, reusing results which are up to date.
+type phaseSelection map[Phase]bool
+
+func newPhaseSelection(phases []Phase) phaseSelection {
+	if len(phases) == 0 {
+		return nil
+	}
+	sel := make(phaseSelection)
+	for _, p := range phases {
+		sel[p] = true
+	}
+	return sel
+}
+
+// selected returns whether the phase may run.
+func (s phaseSelection) selected(p Phase) bool {
+	return s == nil || s[p]
+}
+
+// redo returns whether the phase runs even if its results exist.
+func (s phaseSelection) redo(p Phase) bool {
+	return s != nil && s[p]
+}
+
+// Status is the outcome of a phase or a run.
+type Status string
+
+const (
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusSkipped   Status = "skipped" // Not run because the run was cancelled
+	StatusCached    Status = "cached"  // Already generated by an earlier run
+)
+
+// statusOf returns the status of a phase which was run and returned err.
+func statusOf(err error) Status {
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case isCancelled(err):
+		return StatusSkipped
+	default:
+		return StatusFailed
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// An ArtifactLister can report the files and directories it produces.
+// Datasets and Generatables may implement ArtifactLister so that their outputs
+// are recorded in the run report.
+type ArtifactLister interface {
+	Artifacts() []string
+}
+
+func artifactsOf(v interface{}) []string {
+	a, ok := v.(ArtifactLister)
+	if !ok {
+		return nil
+	}
+	return a.Artifacts()
+}
+
+// PhaseReport records one phase of a run. Start and End are the same for
+// phases which were not run.
+type PhaseReport struct {
+	Phase     Phase
+	ID        string
+	Start     time.Time
+	End       time.Time
+	Status    Status
+	Error     string    `json:",omitempty"`
+	Artifacts []string  `json:",omitempty"`
+	Attempts  []Attempt `json:",omitempty"`
+}
+
+// RunReport records what happened when running a Settings case. It is saved
+// as report.json in the Savepath of the case.
+type RunReport struct {
+	Savepath   string
+	FeatureSet string
+	Start      time.Time
+	End        time.Time
+	Status     Status
+	Error      string `json:",omitempty"`
+	Phases     []PhaseReport
+	NonFinite  []NonFiniteReport `json:",omitempty"` // Training datasets with rows dropped or clamped
+
+	mux sync.Mutex
+}
+
+func newRunReport(set *Settings) *RunReport {
+	return &RunReport{
+		Savepath:   set.Savepath,
+		FeatureSet: set.FeatureSet,
+		Start:      time.Now(),
+	}
+}
+
+// add appends the phase to the report. It is safe to call concurrently.
+func (r *RunReport) add(p PhaseReport) {
+	r.mux.Lock()
+	r.Phases = append(r.Phases, p)
+	r.mux.Unlock()
+}
+
+// finish records the final error of the run.
+func (r *RunReport) finish(err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.End = time.Now()
+	r.Error = errString(err)
+	switch err.(type) {
+	case nil:
+		r.Status = StatusSucceeded
+	case SkippedError:
+		r.Status = StatusSkipped
+	default:
+		r.Status = StatusFailed
+	}
+}
+
+// ReportFilename returns the location of the run report in the savepath.
+func ReportFilename(savepath string) string {
+	return filepath.Join(savepath, "report.json")
+}
+
+// Save writes the report to the Savepath.
+func (r *RunReport) Save() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	err := os.MkdirAll(r.Savepath, 0700)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(ReportFilename(r.Savepath))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadRunReport reads the run report saved in the savepath.
+func LoadRunReport(savepath string) (*RunReport, error) {
+	f, err := os.Open(ReportFilename(savepath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &RunReport{}
+	err = json.NewDecoder(f).Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
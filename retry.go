@@ -0,0 +1,93 @@
+package ransuq
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy sets how a Generatable which fails is run again. The zero value
+// runs each Generatable once.
+type RetryPolicy struct {
+	MaxAttempts int           // Number of times to run, including the first. Values below 1 mean 1
+	Backoff     time.Duration // Wait before the second attempt
+	Multiplier  float64       // Growth of the wait between attempts. Values below 1 mean 1
+	MaxBackoff  time.Duration // Longest wait between attempts if nonzero
+}
+
+// A Retrier is a Generatable which can change itself before it is run again
+// after failing, for example by making a solver more conservative. attempt is
+// the number of the attempt that failed, starting at 1, and err is its error.
+// If PrepareRetry returns an error, the Generatable is not run again.
+type Retrier interface {
+	PrepareRetry(attempt int, err error) error
+}
+
+// Attempt records one run of a Generatable.
+type Attempt struct {
+	ID     string
+	Number int
+	Start  time.Time
+	End    time.Time
+	Status Status
+	Error  string `json:",omitempty"`
+}
+
+// wait returns the time to wait after the failed attempt before the next one.
+func (r RetryPolicy) wait(attempt int) time.Duration {
+	mul := r.Multiplier
+	if mul < 1 {
+		mul = 1
+	}
+	wait := float64(r.Backoff)
+	for i := 1; i < attempt; i++ {
+		wait *= mul
+	}
+	if r.MaxBackoff != 0 && wait > float64(r.MaxBackoff) {
+		return r.MaxBackoff
+	}
+	return time.Duration(wait)
+}
+
+// retryable returns whether a Generatable should be run again after the
+// attempt failed with err. Cancelled runs and panics are not retried.
+func (r RetryPolicy) retryable(attempt int, err error) bool {
+	if attempt >= r.MaxAttempts || isCancelled(err) {
+		return false
+	}
+	_, isPanic := err.(PanicError)
+	return !isPanic
+}
+
+// run calls submit until the Generatable succeeds or the policy gives up. Each
+// attempt is appended to attempts. The error of the last attempt is returned.
+func (r RetryPolicy) run(ctx context.Context, gen Generatable, submit SubmitFunc, attempts *[]Attempt) error {
+	for n := 1; ; n++ {
+		start := time.Now()
+		err := submit(gen)
+		*attempts = append(*attempts, Attempt{
+			ID:     gen.ID(),
+			Number: n,
+			Start:  start,
+			End:    time.Now(),
+			Status: statusOf(err),
+			Error:  errString(err),
+		})
+		if err == nil || !r.retryable(n, err) {
+			return err
+		}
+		if rt, ok := gen.(Retrier); ok {
+			perr := rt.PrepareRetry(n, err)
+			if perr != nil {
+				Infof("not retrying %v: %v", gen.ID(), perr)
+				return err
+			}
+		}
+		wait := r.wait(n)
+		Emit(Event{Kind: EventJobRetrying, ID: gen.ID(), Attempt: n, Error: errString(err), Wait: wait})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
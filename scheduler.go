@@ -1,10 +1,13 @@
 package ransuq
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Scheduler interface {
@@ -15,22 +18,114 @@ type Scheduler interface {
 	AddChannel(GeneratableIO) // Adds a unique channel for generatable IO
 }
 
+// A Prioritizer is a Generatable with a priority. The LocalScheduler starts
+// queued jobs with a higher priority first. Generatables which are not
+// Prioritizers have priority zero.
+type Prioritizer interface {
+	Priority() int
+}
+
+func priorityOf(gen Generatable) int {
+	gen, _, _ = unwrapGeneratable(gen)
+	if p, ok := gen.(Prioritizer); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// A MemoryEstimator is a Generatable which can estimate the memory it needs to
+// run. The LocalScheduler only starts it once that much of the memory budget
+// is free. Generatables which are not MemoryEstimators are assumed to need no
+// memory.
+type MemoryEstimator interface {
+	MemoryEstimate() int64 // Bytes needed to run
+}
+
+func memoryOf(gen Generatable) int64 {
+	gen, _, _ = unwrapGeneratable(gen)
+	if m, ok := gen.(MemoryEstimator); ok {
+		return m.MemoryEstimate()
+	}
+	return 0
+}
+
+// A Timeouter is a Generatable with a limit on how long it may run. A zero
+// Timeout uses the Timeout of the LocalScheduler.
+type Timeouter interface {
+	Timeout() time.Duration
+}
+
+func timeoutOf(gen Generatable, def time.Duration) time.Duration {
+	inner, _, _ := unwrapGeneratable(gen)
+	if t, ok := inner.(Timeouter); ok && t.Timeout() > 0 {
+		return t.Timeout()
+	}
+	return def
+}
+
 // Local Scheduler is a scheduler that assumes a shared-memory environment for
-//
+// running the jobs. Jobs are queued by priority and then by arrival, and are
+// started in that order as cores and memory become available. A job which
+// needs more cores or memory than are free does not hold up the jobs behind
+// it. They are started while it waits, until MaxBypass jobs which arrived
+// after it have started first. The cores it needs are then reserved, and other
+// jobs only start in what is left over until it starts.
 type LocalScheduler struct {
+	// MaxBypass is the number of jobs which may start ahead of a waiting job
+	// before cores are reserved for it. Every job which arrived after the
+	// waiting job and starts before it counts, including jobs with a higher
+	// priority. While cores are reserved, other jobs only start if they fit
+	// in the cores and memory left over. Zero reserves cores for the first
+	// job in the queue. It must not be changed after Launch.
+	MaxBypass int
+
+	// MemoryBudget is the number of bytes of memory the running jobs may
+	// use. Zero is no limit. A job estimated to need more than the budget
+	// waits until the whole budget is free. It must not be changed after
+	// Launch.
+	MemoryBudget int64
+
+	// Timeout is the longest a job may run if it is not a Timeouter. Zero is
+	// no limit. A job which runs for longer fails with a TimeoutError. A
+	// ContextRunner is told to stop and a job in a child process is killed,
+	// and their cores are freed once they have returned. Any other job cannot
+	// be stopped, so it is abandoned rather than stopped: its error is sent
+	// at once, but it keeps running, and its cores and memory stay reserved
+	// until it returns.
+	Timeout time.Duration
+
+	// Subprocess, if true, runs each RemoteGeneratable in a child process so
+	// that a crash or running out of memory only fails that job. The program
+	// must call RunSubprocessJob at the start of main. Other Generatables
+	// run in this process.
+	Subprocess bool
+
+	// SubprocessCommand is the command for the child processes. If it is
+	// empty, the current executable is run with the same arguments.
+	SubprocessCommand []string
+
 	//compute         chan Generatable
 	//done            chan GenerateFinished
 	nCores          int
 	nAvailableCores int
-	cond            *sync.Cond
-	mux             *sync.Mutex
+	availableMemory int64
 
 	addMux *sync.RWMutex
+	launch sync.Once
 
-	quit chan struct{}
-	gen  chan generateChanIdx
+	quit     chan struct{} // Closed by Quit
+	quitOnce sync.Once
+	done     chan struct{} // Closed when the scheduler stops
+	gen      chan generateChanIdx
+	freed    chan *queuedGen
 	//done chan generateChanIdx
 
+	stopping chan struct{} // Closed by Shutdown
+	stopOnce sync.Once
+	channels sync.WaitGroup // Goroutines started by AddChannel
+
+	queue []*queuedGen // Jobs waiting for cores in the order they are started
+
 	genIOs []GeneratableIO
 	//quitGen []chan struct{}
 	wgs []*sync.WaitGroup
@@ -40,30 +135,76 @@ type generateChanIdx struct {
 	Gen Generatable
 	Idx int
 	Err error
+	Seq uint64 // Set when the job is queued
+}
+
+// queuedGen is a Generatable waiting in the queue of the LocalScheduler.
+type queuedGen struct {
+	generateChanIdx
+	cores    int
+	memory   int64
+	priority int
+	bypassed int // Number of jobs which arrived later and started while this one waited
 }
 
+// DefaultMaxBypass is the MaxBypass of a new LocalScheduler.
+const DefaultMaxBypass = 16
+
 func NewLocalScheduler() *LocalScheduler {
 	l := &LocalScheduler{
+		MaxBypass:       DefaultMaxBypass,
 		nCores:          runtime.GOMAXPROCS(0),
 		nAvailableCores: runtime.GOMAXPROCS(0),
-		mux:             &sync.Mutex{},
 		quit:            make(chan struct{}),
+		done:            make(chan struct{}),
+		stopping:        make(chan struct{}),
 		gen:             make(chan generateChanIdx),
+		freed:           make(chan *queuedGen),
 		//done:            make(chan GenerateFinished),
 		addMux: &sync.RWMutex{},
 	}
-	l.cond = sync.NewCond(l.mux)
 	return l
 }
 
+// Launch starts the scheduler. Calling Launch again has no effect, so the
+// scheduler can be shared by several runs.
 func (l *LocalScheduler) Launch() {
-	go func() {
-		l.compute()
-	}()
+	l.launch.Do(func() {
+		go l.compute()
+	})
 }
 
+// Quit stops the scheduler without waiting for the jobs. Queued jobs, and
+// jobs received afterwards, fail with ErrSchedulerStopped. Running jobs are
+// not stopped and their results are still sent.
 func (l *LocalScheduler) Quit() {
-	l.quit <- struct{}{}
+	l.quitOnce.Do(func() {
+		close(l.quit)
+	})
+}
+
+// Shutdown stops the scheduler once the jobs it has received are done. The
+// channels stop receiving, so no Generatables may be sent and AddChannel may
+// not be called after Shutdown. Queued jobs are still run, and the output
+// channel of each GeneratableIO is closed once its jobs have finished. If the
+// context ends first, Shutdown calls Quit and returns the context error.
+func (l *LocalScheduler) Shutdown(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		close(l.stopping)
+	})
+	finished := make(chan struct{})
+	go func() {
+		l.channels.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.Quit()
+	return err
 }
 
 /*
@@ -80,25 +221,50 @@ func (l *LocalScheduler) AddChannel(g GeneratableIO) {
 	l.genIOs = append(l.genIOs, g)
 	l.wgs = append(l.wgs, &sync.WaitGroup{})
 	l.addMux.Unlock()
+	l.channels.Add(1)
 
 	// Launch the data type for sending new compute tasks
 	go func(idx int) {
+		defer l.channels.Done()
 		l.addMux.RLock()
 		c := l.genIOs[idx].In
 		wg := l.wgs[idx]
 		l.addMux.RUnlock()
 
-		for gen := range c {
-			wg.Add(1)
-			// Send the task to be computed
-			l.gen <- generateChanIdx{gen, idx, nil}
+	receive:
+		for {
+			// Stop receiving once Shutdown is called, even if there are
+			// Generatables waiting to be sent.
+			select {
+			case <-l.stopping:
+				break receive
+			default:
+			}
+			select {
+			case gen, ok := <-c:
+				if !ok {
+					break receive
+				}
+				wg.Add(1)
+				// Send the task to be computed
+				g := generateChanIdx{Gen: gen, Idx: idx}
+				select {
+				case l.gen <- g:
+				case <-l.quit:
+					l.fail(g, ErrSchedulerStopped)
+				}
+			case <-l.stopping:
+				break receive
+			}
 		}
 		// The receive channel has been closed. Wait until all of the tasks are done
-		// and then close the read chan
+		// and then close the read chan. The lock is not held while waiting so
+		// that AddChannel is not blocked.
 		l.addMux.RLock()
-		l.wgs[idx].Wait()
-		close(l.genIOs[idx].Out)
+		out := l.genIOs[idx].Out
 		l.addMux.RUnlock()
+		wg.Wait()
+		close(out)
 	}(idx)
 }
 
@@ -109,53 +275,271 @@ func (l *LocalScheduler) Done() GenerateFinished {
 */
 
 func (l *LocalScheduler) compute() {
+	defer close(l.done)
+	l.availableMemory = l.MemoryBudget
 	for {
 		select {
 		case <-l.quit:
-			return
 		case gen := <-l.gen:
-			neededCores := gen.Gen.NumCores()
-			if neededCores > l.nCores {
-				str := fmt.Sprintf("not enough available cores: %v requested %v available. generatable: %v", neededCores, l.nCores, gen.Gen.ID())
-				panic(str)
-			}
-			log.Print("gen received")
-			fmt.Println("ncores = ", l.nCores)
-			fmt.Println("avail cores = ", l.nAvailableCores)
-			// Wait until a processor is available
-			// TODO: Need to change this such that it doesn't block, but lets
-			// smaller jobs through.
-			l.cond.L.Lock()
-			for l.nAvailableCores < neededCores {
-				l.cond.Wait()
+			l.enqueue(gen)
+		case q := <-l.freed:
+			l.nAvailableCores += q.cores
+			l.availableMemory += q.memory
+			emitJob(q.Gen, Event{Kind: EventCoresFreed, ID: q.Gen.ID(), Seq: q.Seq, Cores: q.cores, AvailableCores: l.nAvailableCores,
+				Memory: q.memory, AvailableMemory: l.availableMemory})
+		}
+		// Quit may have been called while another case was chosen, so check
+		// it before starting any more jobs.
+		select {
+		case <-l.quit:
+			for _, q := range l.queue {
+				l.fail(q.generateChanIdx, ErrSchedulerStopped)
 			}
-			l.nAvailableCores -= neededCores
-			if l.nAvailableCores < 0 {
-				panic("nAvail should never be negative")
+			l.queue = nil
+			return
+		default:
+		}
+		l.dispatch()
+	}
+}
+
+// enqueue adds the job to the queue behind the jobs with the same or a higher
+// priority. A job which needs more cores than the scheduler has fails.
+func (l *LocalScheduler) enqueue(gen generateChanIdx) {
+	gen.Seq = nextJobSeq()
+	neededCores := gen.Gen.NumCores()
+	if neededCores > l.nCores {
+		l.fail(gen, fmt.Errorf("not enough available cores: %v requested %v available. generatable: %v", neededCores, l.nCores, gen.Gen.ID()))
+		return
+	}
+	q := &queuedGen{
+		generateChanIdx: gen,
+		cores:           neededCores,
+		priority:        priorityOf(gen.Gen),
+	}
+	if l.MemoryBudget != 0 {
+		q.memory = memoryOf(gen.Gen)
+		if q.memory > l.MemoryBudget {
+			Infof("%v needs %v bytes of memory but the budget is %v bytes. Running it on its own", gen.Gen.ID(), q.memory, l.MemoryBudget)
+			q.memory = l.MemoryBudget
+		}
+	}
+	i := sort.Search(len(l.queue), func(i int) bool {
+		return l.queue[i].priority < q.priority
+	})
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = q
+	emitJob(gen.Gen, Event{Kind: EventJobQueued, ID: gen.Gen.ID(), Seq: gen.Seq, Cores: neededCores, Memory: q.memory})
+}
+
+// fits returns whether there are enough free cores and memory to start the job.
+func (l *LocalScheduler) fits(q *queuedGen) bool {
+	return q.cores <= l.nAvailableCores && q.memory <= l.availableMemory
+}
+
+// fitsBeside returns whether there are enough free cores and memory to start
+// the job and still run the reserved job.
+func (l *LocalScheduler) fitsBeside(q, reserved *queuedGen) bool {
+	return q.cores <= l.nAvailableCores-reserved.cores && q.memory <= l.availableMemory-reserved.memory
+}
+
+// dispatch starts the queued jobs which fit in the available resources, going
+// through the queue in order. A job which does not fit is passed over until it
+// has been passed over MaxBypass times. The first such job in the queue is
+// started as soon as it fits, and until then no other job, wherever it is in
+// the queue, is started unless it fits beside it.
+func (l *LocalScheduler) dispatch() {
+	var reserved *queuedGen
+	for reserved == nil {
+		i := l.reservedIndex()
+		if i < 0 {
+			break
+		}
+		if !l.fits(l.queue[i]) {
+			reserved = l.queue[i]
+			break
+		}
+		l.startQueued(i)
+	}
+	for i := 0; i < len(l.queue); {
+		q := l.queue[i]
+		if q == reserved || !l.fits(q) || (reserved != nil && !l.fitsBeside(q, reserved)) {
+			i++
+			continue
+		}
+		l.startQueued(i)
+	}
+}
+
+// reservedIndex returns the index of the first job in the queue which has
+// been passed over MaxBypass times, or -1 if there is none.
+func (l *LocalScheduler) reservedIndex() int {
+	for i, q := range l.queue {
+		if q.bypassed >= l.MaxBypass {
+			return i
+		}
+	}
+	return -1
+}
+
+// startQueued removes the ith job from the queue and starts it. It is counted
+// as passing over the waiting jobs which arrived before it.
+func (l *LocalScheduler) startQueued(i int) {
+	q := l.queue[i]
+	l.queue = append(l.queue[:i], l.queue[i+1:]...)
+	for _, w := range l.queue {
+		if w.Seq < q.Seq {
+			w.bypassed++
+		}
+	}
+	l.start(q)
+}
+
+func (l *LocalScheduler) start(q *queuedGen) {
+	l.nAvailableCores -= q.cores
+	l.availableMemory -= q.memory
+	if l.nAvailableCores < 0 {
+		panic("nAvail should never be negative")
+	}
+	emitJob(q.Gen, Event{Kind: EventJobStarted, ID: q.Gen.ID(), Seq: q.Seq, Cores: q.cores, AvailableCores: l.nAvailableCores,
+		Memory: q.memory, AvailableMemory: l.availableMemory})
+	// Launch the case
+	go func() {
+		gen := q.Gen
+		// Run the case
+		finished, err := runJob(gen, l.runFunc(gen), timeoutOf(gen, l.Timeout), l.stoppable(gen))
+		emitJob(gen, Event{Kind: EventJobFinished, ID: gen.ID(), Seq: q.Seq, Status: statusOf(err), Error: errString(err)})
+		select {
+		case <-finished:
+		default:
+			// The job was abandoned after timing out. Its error is sent now,
+			// but the cores are only free once it returns.
+			l.send(q.generateChanIdx, err)
+			<-finished
+			l.release(q)
+			return
+		}
+		l.release(q)
+		l.send(q.generateChanIdx, err)
+	}()
+}
+
+// release tells the scheduler that the cores and memory of the job are free
+// again.
+func (l *LocalScheduler) release(q *queuedGen) {
+	select {
+	case l.freed <- q:
+	case <-l.done:
+	}
+}
+
+// stoppable returns whether the job returns once its context is cancelled,
+// which is if it runs in a child process or is a ContextRunner.
+func (l *LocalScheduler) stoppable(gen Generatable) bool {
+	inner, _, _ := unwrapGeneratable(gen)
+	if _, ok := inner.(RemoteGeneratable); ok && l.Subprocess {
+		return true
+	}
+	_, ok := inner.(ContextRunner)
+	return ok
+}
+
+// fail finishes a job which was not run.
+func (l *LocalScheduler) fail(g generateChanIdx, err error) {
+	emitJob(g.Gen, Event{Kind: EventJobFinished, ID: g.Gen.ID(), Seq: g.Seq, Status: statusOf(err), Error: errString(err)})
+	go l.send(g, err)
+}
+
+// send sends the finished job back on the proper channel. Make sure we aren't
+// appending at the same time. The task is only marked done once it has been
+// sent so that Out is not closed early.
+func (l *LocalScheduler) send(g generateChanIdx, err error) {
+	l.addMux.RLock()
+	out := l.genIOs[g.Idx].Out
+	wg := l.wgs[g.Idx]
+	l.addMux.RUnlock()
+	out <- GenerateFinished{g.Gen, err}
+	wg.Done()
+}
+
+// runFunc returns the function which runs the job, in a child process if
+// Subprocess is set and the job is a RemoteGeneratable.
+func (l *LocalScheduler) runFunc(gen Generatable) func(context.Context) error {
+	inner, _, _ := unwrapGeneratable(gen)
+	r, ok := inner.(RemoteGeneratable)
+	if !l.Subprocess || !ok {
+		return func(ctx context.Context) error {
+			if c, ok := gen.(ContextRunner); ok {
+				return c.RunContext(ctx)
 			}
-			// Launch the case
-			go func(genIdx generateChanIdx) {
-				gen := genIdx.Gen
-				// Run the case
-				log.Print("Scheduler started " + gen.ID())
-				err := gen.Run()
-				log.Print("Scheduler finished " + gen.ID())
-				// Tell the scheduler that the cores are free again, and signal
-				// to the waiting goroutines that they can wait
-				l.mux.Lock()
-				l.nAvailableCores += gen.NumCores()
-				fmt.Println(gen.NumCores(), " readded to available")
-				l.mux.Unlock()
-				l.cond.Broadcast()
-
-				// Send the finished case back on the proper channel. Make sure
-				// we aren't appending at the same time
-				l.addMux.RLock()
-				l.wgs[genIdx.Idx].Done()
-				l.genIOs[genIdx.Idx].Out <- GenerateFinished{gen, err}
-				l.addMux.RUnlock()
-			}(gen)
-			l.cond.L.Unlock()
+			return gen.Run()
+		}
+	}
+	child := func(ctx context.Context) error {
+		return runSubprocess(ctx, l.SubprocessCommand, gen.ID(), r)
+	}
+	if t, ok := gen.(*trackedGeneratable); ok {
+		return func(ctx context.Context) error {
+			return t.runWith(ctx, child)
+		}
+	}
+	return child
+}
+
+// runJob runs the job with the context of the tracked Generatable, turning a
+// panic into a PanicError. finished is closed once the job has returned. If
+// the timeout is nonzero and the job runs for longer, the context is
+// cancelled and the error is a TimeoutError. A stoppable job is waited for
+// after it is cancelled. Any other job is abandoned, and runJob returns while
+// it is still running.
+func runJob(gen Generatable, run func(context.Context) error, timeout time.Duration, stoppable bool) (finished <-chan struct{}, err error) {
+	parent := context.Background()
+	if t, ok := gen.(*trackedGeneratable); ok {
+		parent = t.ctx
+	}
+	closed := make(chan struct{})
+	if timeout <= 0 {
+		err = runRecovered(parent, run)
+		close(closed)
+		return closed, err
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := runRecovered(ctx, run)
+		close(closed)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return closed, TimeoutError{ID: gen.ID(), Timeout: timeout}
 		}
+		return closed, err
+	case <-ctx.Done():
 	}
+	if parent.Err() != nil {
+		// The run was cancelled rather than timed out, so the job is waited
+		// for as it would be without a timeout.
+		return closed, <-done
+	}
+	if stoppable {
+		<-done
+		Infof("%v timed out after %v and was stopped", gen.ID(), timeout)
+		return closed, TimeoutError{ID: gen.ID(), Timeout: timeout}
+	}
+	Infof("%v timed out after %v and was abandoned. Its cores stay in use until it returns", gen.ID(), timeout)
+	return closed, TimeoutError{ID: gen.ID(), Timeout: timeout}
+}
+
+// runRecovered calls run, turning a panic into a PanicError.
+func runRecovered(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return run(ctx)
 }
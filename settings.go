@@ -18,7 +18,10 @@ type Settings struct {
 	OutputFeatures []string
 	WeightFeatures []string
 	WeightFunc     func([]float64) float64
-	Savepath       string // Location of where to save the algorithm and plots
+	WeightSpec     string          // Identifies WeightFunc, so training is redone when it changes
+	Savepath       string          // Location of where to save the algorithm and plots
+	LoadStyle      LoadStyle       // How the training and testing data are loaded
+	NonFinite      NonFinitePolicy // What is done with non-finite values in the training and testing data
 
 	Trainer *Trainer
 }
@@ -0,0 +1,92 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/btracey/ransuq"
+	"github.com/btracey/su2tools/driver"
+)
+
+// Config is the layout of the machine the cases are run on.
+type Config struct {
+	DataRoot    string // Directory holding the datasets
+	ResultsRoot string // Directory the results of each case are saved under
+	SU2Path     string // Directory holding the SU2 executables. Only needed to run SU2 datasets
+
+	// RetryCFLFactor multiplies the CFL number of an SU2 dataset each time a
+	// failed run is retried. Zero retries with the same CFL number.
+	RetryCFLFactor float64
+}
+
+// DefaultConfig returns the configuration from the environment. The data are
+// in $GOPATH/data/ransuq, the results are saved in $GOPATH/results/ransuq, and
+// SU2 is in $SU2_RUN.
+func DefaultConfig() (*Config, error) {
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		return nil, errors.New("settings: GOPATH not set")
+	}
+	return &Config{
+		DataRoot:    filepath.Join(gopath, "data", "ransuq"),
+		ResultsRoot: filepath.Join(gopath, "results", "ransuq"),
+		SU2Path:     os.Getenv("SU2_RUN"),
+	}, nil
+}
+
+// LoadConfig reads a configuration saved as JSON. Relative paths are relative
+// to the directory of the file.
+func LoadConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &Config{}
+	err = json.NewDecoder(f).Decode(c)
+	if err != nil {
+		return nil, errors.New("settings: error decoding config: " + err.Error())
+	}
+	if c.DataRoot == "" {
+		return nil, errors.New("settings: config has no DataRoot")
+	}
+	if c.ResultsRoot == "" {
+		return nil, errors.New("settings: config has no ResultsRoot")
+	}
+	dir := filepath.Dir(filename)
+	for _, path := range []*string{&c.DataRoot, &c.ResultsRoot, &c.SU2Path} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	return c, nil
+}
+
+// GetSettings returns the settings for the options using DefaultConfig.
+func GetSettings(
+	training,
+	testing,
+	features,
+	weightSet,
+	algorithm,
+	trainSettings string,
+	caller driver.Syscaller,
+	extraStringsSetting []string,
+) (*ransuq.Settings, error) {
+	c, err := DefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetSettings(training, testing, features, weightSet, algorithm, trainSettings, caller, extraStringsSetting)
+}
+
+// GetDatasets returns the datasets for the string using DefaultConfig.
+func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error) {
+	c, err := DefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetDatasets(data, caller)
+}
@@ -0,0 +1,104 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ransuq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := filepath.Join(dir, "elsewhere", "results")
+	for _, test := range []struct {
+		name   string
+		json   string
+		config *Config
+	}{
+		{
+			name: "relative",
+			json: `{"DataRoot": "data", "ResultsRoot": "` + results + `", "SU2Path": "su2/bin", "RetryCFLFactor": 0.5}`,
+			config: &Config{
+				DataRoot:       filepath.Join(dir, "data"),
+				ResultsRoot:    results,
+				SU2Path:        filepath.Join(dir, "su2", "bin"),
+				RetryCFLFactor: 0.5,
+			},
+		},
+		{
+			name: "no su2",
+			json: `{"DataRoot": "data", "ResultsRoot": "results"}`,
+			config: &Config{
+				DataRoot:    filepath.Join(dir, "data"),
+				ResultsRoot: filepath.Join(dir, "results"),
+			},
+		},
+		{
+			name: "no data",
+			json: `{"ResultsRoot": "results"}`,
+		},
+		{
+			name: "no results",
+			json: `{"DataRoot": "data"}`,
+		},
+		{
+			name: "bad json",
+			json: `{"DataRoot": `,
+		},
+	} {
+		filename := filepath.Join(dir, "config.json")
+		err := ioutil.WriteFile(filename, []byte(test.json), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := LoadConfig(filename)
+		if test.config == nil {
+			if err == nil {
+				t.Errorf("%v: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if *c != *test.config {
+			t.Errorf("%v: expected %+v, found %+v", test.name, test.config, c)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("no error for a missing config file")
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	gopath, su2run := os.Getenv("GOPATH"), os.Getenv("SU2_RUN")
+	defer os.Setenv("GOPATH", gopath)
+	defer os.Setenv("SU2_RUN", su2run)
+
+	os.Setenv("GOPATH", "/go")
+	os.Setenv("SU2_RUN", "/su2/bin")
+	c, err := DefaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		DataRoot:    filepath.Join("/go", "data", "ransuq"),
+		ResultsRoot: filepath.Join("/go", "results", "ransuq"),
+		SU2Path:     "/su2/bin",
+	}
+	if *c != want {
+		t.Errorf("expected %+v, found %+v", want, c)
+	}
+
+	os.Setenv("GOPATH", "")
+	if _, err := DefaultConfig(); err == nil {
+		t.Errorf("no error without GOPATH")
+	}
+}
@@ -19,21 +19,6 @@ import (
 	"github.com/btracey/ransuq/synthetic"
 )
 
-var gopath string
-var supath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-	if gopath == "" {
-		panic("gopath not set")
-	}
-
-	supath = os.Getenv("SU2_RUN")
-	if supath == "" {
-		panic("SU2_RUN not set")
-	}
-}
-
 //
 func init() {
 	sortedDatasets = append(sortedDatasets,
@@ -45,8 +30,6 @@ func init() {
 		SingleRae,
 	)
 	sort.Strings(sortedDatasets)
-
-	lavalLoc = filepath.Join(gopath, "data", "ransuq", "laval", "laval_csv_computed.dat")
 }
 
 var sortedDatasets []string
@@ -105,30 +88,28 @@ var budgetFieldMap = map[string]string{
 	"WallDistance": "WallDist",
 }
 
-var lavalLoc string
-
-// All of these assume that the working directory is $GOPATH, which should be set
-// from the main script
-
-func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error) {
+// GetDatasets returns the datasets for the string. The data are located in the
+// DataRoot of the config, and SU2 is run from its SU2Path if it is set. Failed
+// SU2 runs are retried with the CFL number multiplied by the RetryCFLFactor.
+func (c *Config) GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error) {
 	var datasets []ransuq.Dataset
 
-	flatplate3_06 := newFlatplate(3e6, 0, "med", "atwall")
-	flatplate4_06 := newFlatplate(4e6, 0, "med", "atwall")
-	flatplate5_06 := newFlatplate(5e6, 0, "med", "atwall")
-	flatplate6_06 := newFlatplate(6e6, 0, "med", "atwall")
-	flatplate7_06 := newFlatplate(7e6, 0, "med", "atwall")
+	flatplate3_06 := c.newFlatplate(3e6, 0, "med", "atwall")
+	flatplate4_06 := c.newFlatplate(4e6, 0, "med", "atwall")
+	flatplate5_06 := c.newFlatplate(5e6, 0, "med", "atwall")
+	flatplate6_06 := c.newFlatplate(6e6, 0, "med", "atwall")
+	flatplate7_06 := c.newFlatplate(7e6, 0, "med", "atwall")
 
-	flatplate3_06_BL := newFlatplate(3e6, 0, "med", "justbl")
-	flatplate4_06_BL := newFlatplate(4e6, 0, "med", "justbl")
-	flatplate5_06_BL := newFlatplate(5e6, 0, "med", "justbl")
-	flatplate6_06_BL := newFlatplate(6e6, 0, "med", "justbl")
-	flatplate7_06_BL := newFlatplate(7e6, 0, "med", "justbl")
+	flatplate3_06_BL := c.newFlatplate(3e6, 0, "med", "justbl")
+	flatplate4_06_BL := c.newFlatplate(4e6, 0, "med", "justbl")
+	flatplate5_06_BL := c.newFlatplate(5e6, 0, "med", "justbl")
+	flatplate6_06_BL := c.newFlatplate(6e6, 0, "med", "justbl")
+	flatplate7_06_BL := c.newFlatplate(7e6, 0, "med", "justbl")
 
 	blIgnoreNames, blIgnoreFunc := GetIgnoreData("justbl")
 
 	// TODO: Move these to a function
-	flatplateLoc := filepath.Join(gopath, "data", "ransuq", "flatplate", "med")
+	flatplateLoc := filepath.Join(c.DataRoot, "flatplate", "med")
 
 	flatplate3_06_budget_BL_Loc := filepath.Join(flatplateLoc, "Flatplate_Re_3e_06", "turb_flatplate_sol_budget.dat")
 	flatplate3_06_budget_BL := &datawrapper.CSV{
@@ -136,6 +117,7 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 		Name:        "Flat306Budget",
 		IgnoreFunc:  blIgnoreFunc,
 		IgnoreNames: blIgnoreNames,
+		IgnoreSpec:  "justbl",
 		FieldMap:    budgetFieldMap,
 	}
 
@@ -145,6 +127,7 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 		Name:        "Flat506Budget",
 		IgnoreFunc:  blIgnoreFunc,
 		IgnoreNames: blIgnoreNames,
+		IgnoreSpec:  "justbl",
 		FieldMap:    budgetFieldMap,
 	}
 
@@ -154,6 +137,7 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 		Name:        "Flat706Budget",
 		IgnoreFunc:  blIgnoreFunc,
 		IgnoreNames: blIgnoreNames,
+		IgnoreSpec:  "justbl",
 		FieldMap:    budgetFieldMap,
 	}
 
@@ -177,7 +161,7 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 	case MultiFlatplateBL:
 		datasets = []ransuq.Dataset{flatplate3_06_BL, flatplate5_06_BL, flatplate7_06_BL}
 	case ExtraFlatplate:
-		datasets = []ransuq.Dataset{newFlatplate(1e6, 0, "med", "atwall"), newFlatplate(2e6, 0, "med", "atwall"), newFlatplate(1.5e6, 0, "med", "atwall")}
+		datasets = []ransuq.Dataset{c.newFlatplate(1e6, 0, "med", "atwall"), c.newFlatplate(2e6, 0, "med", "atwall"), c.newFlatplate(1.5e6, 0, "med", "atwall")}
 	case FlatplateSweep:
 		datasets = flatplateSweep
 	case FlatplateSweepBl:
@@ -189,25 +173,26 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 			flatplate7_06_BL,
 		}
 	case SyntheticFlatplateProduction:
-		datasets = []ransuq.Dataset{synthetic.Production{synthetic.FlatplateBounds}}
+		datasets = []ransuq.Dataset{synthetic.Production{Bounds: synthetic.FlatplateBounds, Root: c.DataRoot}}
 	case MultiAndSynthFlatplate:
-		datasets = []ransuq.Dataset{synthetic.Production{synthetic.FlatplateBounds}}
+		datasets = []ransuq.Dataset{synthetic.Production{Bounds: synthetic.FlatplateBounds, Root: c.DataRoot}}
 		datasets = append(datasets, flatplateSweep...)
 	case SingleRae:
-		datasets = []ransuq.Dataset{newAirfoil()}
+		datasets = []ransuq.Dataset{c.newAirfoil()}
 	case LES4:
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:   filepath.Join(gopath, "data", "ransuq", "HiFi", "exp4_mod.txt"),
+				Location:   filepath.Join(c.DataRoot, "HiFi", "exp4_mod.txt"),
 				Name:       "LES_exp4",
 				IgnoreFunc: func([]float64) bool { return false },
+				IgnoreSpec: "none",
 			},
 		}
 		// Need to check correctness of this case
 		/*
 			case SingleFlatplateBudget:
 
-				location := filepath.Join(gopath, "data", "ransuq", "flatplate", "med", "Flatplate_Re_5e_06", "turb_flatplate_sol_budget.dat")
+				location := filepath.Join(c.DataRoot, "flatplate", "med", "Flatplate_Re_5e_06", "turb_flatplate_sol_budget.dat")
 				datasets = []ransuq.Dataset{
 					&datawrapper.CSV{
 						Location:    location,
@@ -227,31 +212,34 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 	case DNS5n:
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:   filepath.Join(gopath, "data", "ransuq", "HiFi", "exp5xn.txt"),
+				Location:   filepath.Join(c.DataRoot, "HiFi", "exp5xn.txt"),
 				Name:       "DNS5n",
 				IgnoreFunc: func([]float64) bool { return false },
+				IgnoreSpec: "none",
 			},
 		}
 	case LES4Tenth:
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location: filepath.Join(gopath, "data", "ransuq", "LES", "exp4_mod.txt"),
+				Location: filepath.Join(c.DataRoot, "LES", "exp4_mod.txt"),
 				Name:     "LES_exp4",
 				IgnoreFunc: func(a []float64) bool {
 					intpoint := int(a[0])
 					return (intpoint % 10) != 0
 				},
 				IgnoreNames: []string{"Datapoint"},
+				IgnoreSpec:  "tenth",
 			},
 		}
 	case FwNACA0012:
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location: filepath.Join(gopath, "data", "ransuq", "RANS_Shivaji", "naca0012_fw.dat"),
+				Location: filepath.Join(c.DataRoot, "RANS_Shivaji", "naca0012_fw.dat"),
 				Name:     "NACA_0012_Shivaji",
 				IgnoreFunc: func([]float64) bool {
 					return false
 				},
+				IgnoreSpec: "none",
 			},
 		}
 	case FlatPress:
@@ -261,51 +249,51 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 			flatplate5_06,
 			flatplate6_06,
 			flatplate6_06,
-			newFlatplate(5e6, .30, "med", "atwall"),
-			newFlatplate(5e6, .10, "med", "atwall"),
-			newFlatplate(5e6, .03, "med", "atwall"),
-			newFlatplate(5e6, .01, "med", "atwall"),
-			newFlatplate(5e6, 0, "med", "atwall"),
-			newFlatplate(5e6, -.01, "med", "atwall"),
-			newFlatplate(5e6, -.03, "med", "atwall"),
-			newFlatplate(5e6, -.10, "med", "atwall"),
-			newFlatplate(5e6, -.30, "med", "atwall"),
+			c.newFlatplate(5e6, .30, "med", "atwall"),
+			c.newFlatplate(5e6, .10, "med", "atwall"),
+			c.newFlatplate(5e6, .03, "med", "atwall"),
+			c.newFlatplate(5e6, .01, "med", "atwall"),
+			c.newFlatplate(5e6, 0, "med", "atwall"),
+			c.newFlatplate(5e6, -.01, "med", "atwall"),
+			c.newFlatplate(5e6, -.03, "med", "atwall"),
+			c.newFlatplate(5e6, -.10, "med", "atwall"),
+			c.newFlatplate(5e6, -.30, "med", "atwall"),
 		}
 	case NacaPressureFlatSmall:
 		datasets = []ransuq.Dataset{
 			flatplate5_06,
-			newNaca0012(3, "atwall"),
-			newFlatplate(5e6, .30, "med", "atwall"),
-			newFlatplate(5e6, -.30, "med", "atwall"),
+			c.newNaca0012(3, "atwall"),
+			c.newFlatplate(5e6, .30, "med", "atwall"),
+			c.newFlatplate(5e6, -.30, "med", "atwall"),
 		}
 	case NacaPressureFlatMedium:
 		datasets = []ransuq.Dataset{
 			flatplate3_06,
 			flatplate5_06,
 			flatplate7_06,
-			newNaca0012(0, "atwall"),
-			newNaca0012(6, "atwall"),
-			newNaca0012(12, "atwall"),
-			newFlatplate(5e6, .30, "med", "atwall"),
-			newFlatplate(5e6, -.30, "med", "atwall"),
+			c.newNaca0012(0, "atwall"),
+			c.newNaca0012(6, "atwall"),
+			c.newNaca0012(12, "atwall"),
+			c.newFlatplate(5e6, .30, "med", "atwall"),
+			c.newFlatplate(5e6, -.30, "med", "atwall"),
 		}
 	case NacaPressureFlatMediumBL:
 		datasets = []ransuq.Dataset{
 			flatplate3_06_BL,
 			flatplate5_06_BL,
 			flatplate7_06_BL,
-			newNaca0012(0, "justbl"),
-			newNaca0012(6, "justbl"),
-			newNaca0012(12, "justbl"),
-			newFlatplate(5e6, .30, "med", "justbl"),
-			newFlatplate(5e6, -.30, "med", "justbl"),
+			c.newNaca0012(0, "justbl"),
+			c.newNaca0012(6, "justbl"),
+			c.newNaca0012(12, "justbl"),
+			c.newFlatplate(5e6, .30, "med", "justbl"),
+			c.newFlatplate(5e6, -.30, "med", "justbl"),
 		}
 	case NacaPressureFlatSmallBL:
 		datasets = []ransuq.Dataset{
 			flatplate5_06_BL,
-			newNaca0012(3, "justbl"),
-			newFlatplate(5e6, .30, "med", "justbl"),
-			newFlatplate(5e6, -.30, "med", "justbl"),
+			c.newNaca0012(3, "justbl"),
+			c.newFlatplate(5e6, .30, "med", "justbl"),
+			c.newFlatplate(5e6, -.30, "med", "justbl"),
 		}
 	case NacaPressureFlat:
 		datasets = []ransuq.Dataset{
@@ -314,67 +302,67 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 			flatplate5_06,
 			flatplate6_06,
 			flatplate7_06,
-			newFlatplate(5e6, .30, "med", "atwall"),
-			newFlatplate(5e6, .10, "med", "atwall"),
-			newFlatplate(5e6, .03, "med", "atwall"),
-			newFlatplate(5e6, .01, "med", "atwall"),
-			newFlatplate(5e6, -.01, "med", "atwall"),
-			newFlatplate(5e6, -.03, "med", "atwall"),
-			newFlatplate(5e6, -.10, "med", "atwall"),
-			newFlatplate(5e6, -.30, "med", "atwall"),
-			newNaca0012(0, "atwall"),
-			newNaca0012(1, "atwall"),
-			newNaca0012(2, "atwall"),
-			newNaca0012(3, "atwall"),
-			newNaca0012(4, "atwall"),
-			newNaca0012(5, "atwall"),
-			newNaca0012(6, "atwall"),
-			newNaca0012(7, "atwall"),
-			newNaca0012(8, "atwall"),
-			newNaca0012(9, "atwall"),
-			newNaca0012(10, "atwall"),
-			newNaca0012(11, "atwall"),
-			newNaca0012(12, "atwall"),
+			c.newFlatplate(5e6, .30, "med", "atwall"),
+			c.newFlatplate(5e6, .10, "med", "atwall"),
+			c.newFlatplate(5e6, .03, "med", "atwall"),
+			c.newFlatplate(5e6, .01, "med", "atwall"),
+			c.newFlatplate(5e6, -.01, "med", "atwall"),
+			c.newFlatplate(5e6, -.03, "med", "atwall"),
+			c.newFlatplate(5e6, -.10, "med", "atwall"),
+			c.newFlatplate(5e6, -.30, "med", "atwall"),
+			c.newNaca0012(0, "atwall"),
+			c.newNaca0012(1, "atwall"),
+			c.newNaca0012(2, "atwall"),
+			c.newNaca0012(3, "atwall"),
+			c.newNaca0012(4, "atwall"),
+			c.newNaca0012(5, "atwall"),
+			c.newNaca0012(6, "atwall"),
+			c.newNaca0012(7, "atwall"),
+			c.newNaca0012(8, "atwall"),
+			c.newNaca0012(9, "atwall"),
+			c.newNaca0012(10, "atwall"),
+			c.newNaca0012(11, "atwall"),
+			c.newNaca0012(12, "atwall"),
 		}
 	case NacaPressureFlatBl:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "justbl"),
-			newNaca0012(1, "justbl"),
-			newNaca0012(2, "justbl"),
-			newNaca0012(3, "justbl"),
-			newNaca0012(4, "justbl"),
-			newNaca0012(5, "justbl"),
-			newNaca0012(6, "justbl"),
-			newNaca0012(7, "justbl"),
-			newNaca0012(8, "justbl"),
-			newNaca0012(9, "justbl"),
-			newNaca0012(10, "justbl"),
-			newNaca0012(11, "justbl"),
-			newNaca0012(12, "justbl"),
+			c.newNaca0012(0, "justbl"),
+			c.newNaca0012(1, "justbl"),
+			c.newNaca0012(2, "justbl"),
+			c.newNaca0012(3, "justbl"),
+			c.newNaca0012(4, "justbl"),
+			c.newNaca0012(5, "justbl"),
+			c.newNaca0012(6, "justbl"),
+			c.newNaca0012(7, "justbl"),
+			c.newNaca0012(8, "justbl"),
+			c.newNaca0012(9, "justbl"),
+			c.newNaca0012(10, "justbl"),
+			c.newNaca0012(11, "justbl"),
+			c.newNaca0012(12, "justbl"),
 			flatplate3_06_BL,
 			flatplate4_06_BL,
 			flatplate5_06_BL,
 			flatplate6_06_BL,
 			flatplate7_06_BL,
-			newFlatplate(5e6, .30, "med", "justbl"),
-			newFlatplate(5e6, .10, "med", "justbl"),
-			newFlatplate(5e6, .03, "med", "justbl"),
-			newFlatplate(5e6, .01, "med", "justbl"),
-			newFlatplate(5e6, -.01, "med", "justbl"),
-			newFlatplate(5e6, -.03, "med", "justbl"),
-			newFlatplate(5e6, -.10, "med", "justbl"),
-			newFlatplate(5e6, -.30, "med", "justbl"),
+			c.newFlatplate(5e6, .30, "med", "justbl"),
+			c.newFlatplate(5e6, .10, "med", "justbl"),
+			c.newFlatplate(5e6, .03, "med", "justbl"),
+			c.newFlatplate(5e6, .01, "med", "justbl"),
+			c.newFlatplate(5e6, -.01, "med", "justbl"),
+			c.newFlatplate(5e6, -.03, "med", "justbl"),
+			c.newFlatplate(5e6, -.10, "med", "justbl"),
+			c.newFlatplate(5e6, -.30, "med", "justbl"),
 		}
 	case PressureBl:
 		datasets = []ransuq.Dataset{
-			newFlatplate(5e6, .30, "med", "justbl"),
-			newFlatplate(5e6, .10, "med", "justbl"),
-			newFlatplate(5e6, .03, "med", "justbl"),
-			newFlatplate(5e6, .01, "med", "justbl"),
-			newFlatplate(5e6, -.01, "med", "justbl"),
-			newFlatplate(5e6, -.03, "med", "justbl"),
-			newFlatplate(5e6, -.10, "med", "justbl"),
-			newFlatplate(5e6, -.30, "med", "justbl"),
+			c.newFlatplate(5e6, .30, "med", "justbl"),
+			c.newFlatplate(5e6, .10, "med", "justbl"),
+			c.newFlatplate(5e6, .03, "med", "justbl"),
+			c.newFlatplate(5e6, .01, "med", "justbl"),
+			c.newFlatplate(5e6, -.01, "med", "justbl"),
+			c.newFlatplate(5e6, -.03, "med", "justbl"),
+			c.newFlatplate(5e6, -.10, "med", "justbl"),
+			c.newFlatplate(5e6, -.30, "med", "justbl"),
 		}
 	case FlatPressureBl:
 		datasets = []ransuq.Dataset{
@@ -383,126 +371,127 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 			flatplate5_06_BL,
 			flatplate6_06_BL,
 			flatplate7_06_BL,
-			newFlatplate(5e6, .30, "med", "justbl"),
-			newFlatplate(5e6, .10, "med", "justbl"),
-			newFlatplate(5e6, .03, "med", "justbl"),
-			newFlatplate(5e6, .01, "med", "justbl"),
-			newFlatplate(5e6, -.01, "med", "justbl"),
-			newFlatplate(5e6, -.03, "med", "justbl"),
-			newFlatplate(5e6, -.10, "med", "justbl"),
-			newFlatplate(5e6, -.30, "med", "justbl"),
+			c.newFlatplate(5e6, .30, "med", "justbl"),
+			c.newFlatplate(5e6, .10, "med", "justbl"),
+			c.newFlatplate(5e6, .03, "med", "justbl"),
+			c.newFlatplate(5e6, .01, "med", "justbl"),
+			c.newFlatplate(5e6, -.01, "med", "justbl"),
+			c.newFlatplate(5e6, -.03, "med", "justbl"),
+			c.newFlatplate(5e6, -.10, "med", "justbl"),
+			c.newFlatplate(5e6, -.30, "med", "justbl"),
 		}
 	case SingleNaca0012:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "atwall"),
+			c.newNaca0012(0, "atwall"),
 		}
 	case SingleNaca0012Bl:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "justbl"),
+			c.newNaca0012(0, "justbl"),
 		}
 	case MultiNaca0012:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "atwall"),
-			newNaca0012(3, "atwall"),
-			newNaca0012(6, "atwall"),
-			newNaca0012(9, "atwall"),
-			newNaca0012(12, "atwall"),
+			c.newNaca0012(0, "atwall"),
+			c.newNaca0012(3, "atwall"),
+			c.newNaca0012(6, "atwall"),
+			c.newNaca0012(9, "atwall"),
+			c.newNaca0012(12, "atwall"),
 		}
 	case MultiNaca0012Bl:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "justbl"),
-			newNaca0012(3, "justbl"),
-			newNaca0012(6, "justbl"),
-			newNaca0012(9, "justbl"),
-			newNaca0012(12, "justbl"),
+			c.newNaca0012(0, "justbl"),
+			c.newNaca0012(3, "justbl"),
+			c.newNaca0012(6, "justbl"),
+			c.newNaca0012(9, "justbl"),
+			c.newNaca0012(12, "justbl"),
 		}
 	case Naca0012SweepBl:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "justbl"),
-			newNaca0012(1, "justbl"),
-			newNaca0012(2, "justbl"),
-			newNaca0012(3, "justbl"),
-			newNaca0012(4, "justbl"),
-			newNaca0012(5, "justbl"),
-			newNaca0012(6, "justbl"),
-			newNaca0012(7, "justbl"),
-			newNaca0012(8, "justbl"),
-			newNaca0012(9, "justbl"),
-			newNaca0012(10, "justbl"),
-			newNaca0012(11, "justbl"),
-			newNaca0012(12, "justbl"),
+			c.newNaca0012(0, "justbl"),
+			c.newNaca0012(1, "justbl"),
+			c.newNaca0012(2, "justbl"),
+			c.newNaca0012(3, "justbl"),
+			c.newNaca0012(4, "justbl"),
+			c.newNaca0012(5, "justbl"),
+			c.newNaca0012(6, "justbl"),
+			c.newNaca0012(7, "justbl"),
+			c.newNaca0012(8, "justbl"),
+			c.newNaca0012(9, "justbl"),
+			c.newNaca0012(10, "justbl"),
+			c.newNaca0012(11, "justbl"),
+			c.newNaca0012(12, "justbl"),
 		}
 	case Naca0012Sweep:
 		datasets = []ransuq.Dataset{
-			newNaca0012(0, "atwall"),
-			newNaca0012(1, "atwall"),
-			newNaca0012(2, "atwall"),
-			newNaca0012(3, "atwall"),
-			newNaca0012(4, "atwall"),
-			newNaca0012(5, "atwall"),
-			newNaca0012(6, "atwall"),
-			newNaca0012(7, "atwall"),
-			newNaca0012(8, "atwall"),
-			newNaca0012(9, "atwall"),
-			newNaca0012(10, "atwall"),
-			newNaca0012(11, "atwall"),
-			newNaca0012(12, "atwall"),
+			c.newNaca0012(0, "atwall"),
+			c.newNaca0012(1, "atwall"),
+			c.newNaca0012(2, "atwall"),
+			c.newNaca0012(3, "atwall"),
+			c.newNaca0012(4, "atwall"),
+			c.newNaca0012(5, "atwall"),
+			c.newNaca0012(6, "atwall"),
+			c.newNaca0012(7, "atwall"),
+			c.newNaca0012(8, "atwall"),
+			c.newNaca0012(9, "atwall"),
+			c.newNaca0012(10, "atwall"),
+			c.newNaca0012(11, "atwall"),
+			c.newNaca0012(12, "atwall"),
 		}
 	case PressureGradientMultiSmall:
 		datasets = []ransuq.Dataset{
-			newFlatplate(5e6, .30, "med", "atwall"),
-			newFlatplate(5e6, .10, "med", "atwall"),
-			newFlatplate(5e6, .03, "med", "atwall"),
-			newFlatplate(5e6, .01, "med", "atwall"),
-			newFlatplate(5e6, 0, "med", "atwall"),
-			newFlatplate(5e6, -.01, "med", "atwall"),
-			newFlatplate(5e6, -.03, "med", "atwall"),
-			newFlatplate(5e6, -.10, "med", "atwall"),
-			newFlatplate(5e6, -.30, "med", "atwall"),
+			c.newFlatplate(5e6, .30, "med", "atwall"),
+			c.newFlatplate(5e6, .10, "med", "atwall"),
+			c.newFlatplate(5e6, .03, "med", "atwall"),
+			c.newFlatplate(5e6, .01, "med", "atwall"),
+			c.newFlatplate(5e6, 0, "med", "atwall"),
+			c.newFlatplate(5e6, -.01, "med", "atwall"),
+			c.newFlatplate(5e6, -.03, "med", "atwall"),
+			c.newFlatplate(5e6, -.10, "med", "atwall"),
+			c.newFlatplate(5e6, -.30, "med", "atwall"),
 		}
 	case PressureGradientMulti:
 		datasets = []ransuq.Dataset{
-			newFlatplate(5e6, 30, "med", "atwall"),
-			newFlatplate(5e6, 10, "med", "atwall"),
-			newFlatplate(5e6, 3, "med", "atwall"),
-			newFlatplate(5e6, 1, "med", "atwall"),
-			newFlatplate(5e6, .1, "med", "atwall"),
-			newFlatplate(5e6, 0, "med", "atwall"),
-			newFlatplate(5e6, -.1, "med", "atwall"),
-			newFlatplate(5e6, -1, "med", "atwall"),
-			newFlatplate(5e6, -3, "med", "atwall"),
-			newFlatplate(5e6, -10, "med", "atwall"),
+			c.newFlatplate(5e6, 30, "med", "atwall"),
+			c.newFlatplate(5e6, 10, "med", "atwall"),
+			c.newFlatplate(5e6, 3, "med", "atwall"),
+			c.newFlatplate(5e6, 1, "med", "atwall"),
+			c.newFlatplate(5e6, .1, "med", "atwall"),
+			c.newFlatplate(5e6, 0, "med", "atwall"),
+			c.newFlatplate(5e6, -.1, "med", "atwall"),
+			c.newFlatplate(5e6, -1, "med", "atwall"),
+			c.newFlatplate(5e6, -3, "med", "atwall"),
+			c.newFlatplate(5e6, -10, "med", "atwall"),
 		}
 	case OneraM6:
 		datasets = []ransuq.Dataset{
-			newOneraM6(3.06, "atwall"),
+			c.newOneraM6(3.06, "atwall"),
 		}
 	case OneraM6BL:
 		datasets = []ransuq.Dataset{
-			newOneraM6(3.06, "justbl"),
+			c.newOneraM6(3.06, "justbl"),
 		}
 	case OneraM6Sweep:
 		datasets = []ransuq.Dataset{
-			newOneraM6(3.06, "atwall"),
-			newOneraM6(1, "atwall"),
-			newOneraM6(2, "atwall"),
-			newOneraM6(0, "atwall"),
-			newOneraM6(4, "atwall"),
+			c.newOneraM6(3.06, "atwall"),
+			c.newOneraM6(1, "atwall"),
+			c.newOneraM6(2, "atwall"),
+			c.newOneraM6(0, "atwall"),
+			c.newOneraM6(4, "atwall"),
 		}
 	case MultiOneraM6:
 		datasets = []ransuq.Dataset{
-			newOneraM6(0, "atwall"),
-			newOneraM6(2, "atwall"),
-			newOneraM6(4, "atwall"),
+			c.newOneraM6(0, "atwall"),
+			c.newOneraM6(2, "atwall"),
+			c.newOneraM6(4, "atwall"),
 		}
 	case LavalDNS, LavalDNSBL, LavalDNSBLAll, LavalDNSCrop:
 		ignoreNames, ignoreFunc := GetIgnoreData(data)
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:    lavalLoc,
+				Location:    filepath.Join(c.DataRoot, "laval", "laval_csv_computed.dat"),
 				Name:        "Laval",
 				IgnoreFunc:  ignoreFunc,
 				IgnoreNames: ignoreNames,
+				IgnoreSpec:  data,
 				FieldMap:    datawrapper.LavalMap,
 			},
 		}
@@ -510,30 +499,33 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 		ignoreNames, ingoreFunc := GetIgnoreData("atwall")
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:    filepath.Join(gopath, "data", "ransuq", "RANS_Shivaji", "bigrans", "data_extracomputed.txt"),
+				Location:    filepath.Join(c.DataRoot, "RANS_Shivaji", "bigrans", "data_extracomputed.txt"),
 				Name:        "RANS_Shivaji",
 				IgnoreFunc:  ingoreFunc,
 				IgnoreNames: ignoreNames,
+				IgnoreSpec:  "atwall",
 			},
 		}
 	case ShivajiComputed:
 		ignoreNames, ingoreFunc := GetIgnoreData("atwall")
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:    filepath.Join(gopath, "data", "ransuq", "RANS_Shivaji", "bigrans", "data_recomputed.txt"),
+				Location:    filepath.Join(c.DataRoot, "RANS_Shivaji", "bigrans", "data_recomputed.txt"),
 				Name:        "RANS_Shivaji_Computed",
 				IgnoreFunc:  ingoreFunc,
 				IgnoreNames: ignoreNames,
+				IgnoreSpec:  "atwall",
 			},
 		}
 	case LESKarthik:
 		ignoreNames, ingoreFunc := GetIgnoreData("none")
 		datasets = []ransuq.Dataset{
 			&datawrapper.CSV{
-				Location:    filepath.Join(gopath, "data", "ransuq", "les_karthik", "sadatacomputed.txt"),
+				Location:    filepath.Join(c.DataRoot, "les_karthik", "sadatacomputed.txt"),
 				Name:        "LES_Karthik",
 				IgnoreFunc:  ingoreFunc,
 				IgnoreNames: ignoreNames,
+				IgnoreSpec:  "none",
 			},
 		}
 	}
@@ -547,6 +539,8 @@ func GetDatasets(data string, caller driver.Syscaller) ([]ransuq.Dataset, error)
 		if ok {
 			fmt.Println("in setting syscaller")
 			su2.SetSyscaller(caller)
+			su2.SU2Path = c.SU2Path
+			su2.RetryCFLFactor = c.RetryCFLFactor
 		}
 	}
 	return datasets, nil
@@ -559,9 +553,9 @@ type FlatplateDataset struct {
 // re = reynolds number
 // cp = coefficient of pressure -- delta p * length * dynamic pressure ()
 // uses farfield pressure for zero cp, and symmetry up top for non-zero cp
-func newFlatplate(re float64, cp float64, fidelity string, ignoreType string) ransuq.Dataset {
+func (c *Config) newFlatplate(re float64, cp float64, fidelity string, ignoreType string) ransuq.Dataset {
 	var basepath, baseconfig string
-	flatplateBase := filepath.Join(gopath, "data", "ransuq", "flatplate")
+	flatplateBase := filepath.Join(c.DataRoot, "flatplate")
 	if cp == 0 {
 		basepath = flatplateBase
 		baseconfig = filepath.Join(basepath, "base_flatplate_config.cfg")
@@ -688,14 +682,15 @@ func newFlatplate(re float64, cp float64, fidelity string, ignoreType string) ra
 		Driver:      drive,
 		Su2Caller:   driver.Serial{}, // TODO: Need to figure out how to do this better
 		IgnoreNames: ignoreNames,
+		IgnoreSpec:  ignoreType,
 		IgnoreFunc:  ignoreFunc,
 		Name:        name,
 		ComparisonPostprocessor: datawrapper.FlatplatePostprocessor{},
 	}
 }
 
-func newOneraM6(aoa float64, ignoreType string) ransuq.Dataset {
-	basepath := filepath.Join(gopath, "data", "ransuq", "airfoil", "oneram6_tom")
+func (c *Config) newOneraM6(aoa float64, ignoreType string) ransuq.Dataset {
+	basepath := filepath.Join(c.DataRoot, "airfoil", "oneram6_tom")
 	configName := "turb_ONERAM6.cfg"
 	mshName := "mesh_ONERAM6_turb_hexa_43008.su2"
 	baseconfig := filepath.Join(basepath, "testcase", configName)
@@ -748,13 +743,14 @@ func newOneraM6(aoa float64, ignoreType string) ransuq.Dataset {
 		Driver:      drive,
 		Su2Caller:   driver.Serial{}, // TODO: Need to figure out how to do this better
 		IgnoreNames: ignoreNames,
+		IgnoreSpec:  ignoreType,
 		IgnoreFunc:  ignoreFunc,
 		Name:        name,
 	}
 }
 
-func newAirfoil() ransuq.Dataset {
-	basepath := filepath.Join(gopath, "data", "ransuq", "airfoil", "rae")
+func (c *Config) newAirfoil() ransuq.Dataset {
+	basepath := filepath.Join(c.DataRoot, "airfoil", "rae")
 	configName := "turb_SA_RAE2822.cfg"
 	meshName := "mesh_RAE2822_turb.su2"
 	baseconfig := filepath.Join(basepath, "testcase", configName)
@@ -806,13 +802,14 @@ func newAirfoil() ransuq.Dataset {
 		Su2Caller:   driver.Serial{}, // TODO: Need to figure out how to do this better
 		IgnoreNames: []string{"WallDistance"},
 		IgnoreFunc:  func(d []float64) bool { return d[0] < wallDistIgnore },
+		IgnoreSpec:  "atwall",
 		Name:        name,
 	}
 }
 
-func newNaca0012(aoa float64, ignoreType string) ransuq.Dataset {
+func (c *Config) newNaca0012(aoa float64, ignoreType string) ransuq.Dataset {
 	conv := 4.2
-	basepath := filepath.Join(gopath, "data", "ransuq", "airfoil", "naca0012")
+	basepath := filepath.Join(c.DataRoot, "airfoil", "naca0012")
 	configName := "turb_NACA0012.cfg"
 	meshName := "mesh_NACA0012_turb_897x257.su2"
 	baseconfig := filepath.Join(basepath, "ransuqbase", configName)
@@ -871,6 +868,7 @@ func newNaca0012(aoa float64, ignoreType string) ransuq.Dataset {
 		Driver:      drive,
 		Su2Caller:   driver.Serial{}, // TODO: Need to figure out how to do this better
 		IgnoreNames: ignoreName,
+		IgnoreSpec:  ignoreType,
 		IgnoreFunc:  ignoreFunc,
 		Name:        name,
 		ComparisonPostprocessor: datawrapper.AirfoilPostprocessor{},
@@ -9,8 +9,9 @@ import (
 	"github.com/btracey/su2tools/driver"
 )
 
-// GetSettings returns a populated settings structure for the given options
-func GetSettings(
+// GetSettings returns a populated settings structure for the given options.
+// The results are saved under the ResultsRoot of the config.
+func (c *Config) GetSettings(
 	training,
 	testing,
 	features,
@@ -21,12 +22,12 @@ func GetSettings(
 	extraStringsSetting []string,
 ) (*ransuq.Settings, error) {
 	// Get the training data sets
-	trainingData, err := GetDatasets(training, caller)
+	trainingData, err := c.GetDatasets(training, caller)
 	if err != nil {
 		return nil, errors.New("training " + err.Error())
 	}
 
-	baseTestingData, err := GetDatasets(testing, caller)
+	baseTestingData, err := c.GetDatasets(testing, caller)
 	if err != nil {
 		return nil, errors.New("testing " + err.Error())
 	}
@@ -47,12 +48,16 @@ func GetSettings(
 				newSU2 := &datawrapper.SU2{
 					Driver:      su2.Driver,
 					Su2Caller:   su2.Su2Caller,
+					SU2Path:     su2.SU2Path,
 					IgnoreNames: su2.IgnoreNames,
 					IgnoreFunc:  su2.IgnoreFunc,
+					IgnoreSpec:  su2.IgnoreSpec,
 					Name:        su2.Name,
 					ComparisonPostprocessor: su2.ComparisonPostprocessor,
 					ExtraMlStrings:          extraStrings,
 					ComparisonNameAddendum:  set,
+					RetryCFLFactor:          su2.RetryCFLFactor,
+					Memory:                  su2.Memory,
 				}
 
 				testingData = append(testingData, newSU2)
@@ -92,8 +97,9 @@ func GetSettings(
 		OutputFeatures: outputs,
 		WeightFeatures: weights,
 		WeightFunc:     f,
-		Savepath:       filepath.Join(gopath, "results", "ransuq", training, features, weightSet, algorithm, trainSettings),
-		//Savepath:       filepath.Join(gopath, "results", "ransuq", features, weightSet, algorithm, trainSettings, training),
+		WeightSpec:     weightSet,
+		Savepath:       filepath.Join(c.ResultsRoot, training, features, weightSet, algorithm, trainSettings),
+		//Savepath:       filepath.Join(c.ResultsRoot, features, weightSet, algorithm, trainSettings, training),
 		Trainer: trainer,
 	}
 	return set, nil
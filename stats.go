@@ -0,0 +1,275 @@
+package ransuq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gonum/stat"
+)
+
+// StatsFilename is the name of the file in the stats directory of the
+// postprocessing which stores the StatsReport.
+const StatsFilename = "stats.json"
+
+// StatsQuantiles are the quantiles recorded for each feature.
+var StatsQuantiles = []float64{0.01, 0.05, 0.25, 0.5, 0.75, 0.95, 0.99}
+
+// overlapQuantile sets the range of a feature compared for the overlap, which
+// is from overlapQuantile to 1-overlapQuantile so that a few outliers do not
+// count.
+const overlapQuantile = 0.01
+
+// StatsReport summarizes the distributions of the input and output features
+// of the training and testing data of a Settings, and how far each testing
+// dataset is from the training data.
+type StatsReport struct {
+	Quantiles     []float64
+	Training      []DatasetStats
+	TrainingUnion DatasetStats // All of the training data together
+	Testing       []DatasetStats
+	Shift         []DatasetShift // Of each testing dataset from TrainingUnion
+}
+
+// DatasetStats is the distribution of each feature of a dataset.
+type DatasetStats struct {
+	Dataset  string
+	Features []FeatureStats
+}
+
+// FeatureStats summarizes the values of a feature. The values are all zero if
+// there are no samples.
+type FeatureStats struct {
+	Feature   string
+	N         int
+	Min       float64
+	Max       float64
+	Mean      float64
+	Std       float64
+	Quantiles []float64 // At StatsQuantiles
+}
+
+// DatasetShift is the shift in the distribution of each feature of a testing
+// dataset from the training data.
+type DatasetShift struct {
+	Dataset  string
+	Features []FeatureShift
+}
+
+// FeatureShift compares the distribution of a feature in the testing data to
+// the training data.
+type FeatureShift struct {
+	Feature string
+
+	// KS is the two-sample Kolmogorov-Smirnov statistic, the largest
+	// difference between the empirical CDFs. 0 is the same distribution and 1
+	// is no overlap.
+	KS float64
+
+	// Overlap is the fraction of the central range of the testing data which
+	// is inside the central range of the training data, where the central
+	// range is between the 1% and 99% quantiles.
+	Overlap float64
+}
+
+func (d DatasetShift) String() string {
+	strs := make([]string, len(d.Features))
+	for i, f := range d.Features {
+		strs[i] = fmt.Sprintf("%v KS %.3f overlap %.3f", f.Feature, f.KS, f.Overlap)
+	}
+	return fmt.Sprintf("%v: %v", d.Dataset, strings.Join(strs, ", "))
+}
+
+// ComputeStats loads the training and testing data of the settings and
+// summarizes the input and output features. The datasets are loaded one at a
+// time and only the sorted features are kept, so that at most one dataset and
+// the training data are in memory at once.
+func ComputeStats(settings *Settings) (*StatsReport, error) {
+	features, _, _, _ := uniqueFeatures(settings.InputFeatures, settings.OutputFeatures, nil)
+	nTrain := len(settings.TrainingData)
+	errs := make([]error, nTrain+len(settings.TestingData))
+
+	report := &StatsReport{Quantiles: StatsQuantiles}
+	loader := settings.loader()
+	union := make([][]float64, len(features))
+	for i, dataset := range settings.TrainingData {
+		columns, err := sortedColumns(loader, dataset, settings.LoadStyle, features)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		report.Training = append(report.Training, datasetStats(dataset.ID(), features, columns))
+		for j := range features {
+			union[j] = append(union[j], columns[j]...)
+		}
+	}
+	for j := range union {
+		sort.Float64s(union[j])
+	}
+	report.TrainingUnion = datasetStats("training", features, union)
+
+	for i, dataset := range settings.TestingData {
+		columns, err := sortedColumns(loader, dataset, settings.LoadStyle, features)
+		if err != nil {
+			errs[nTrain+i] = err
+			continue
+		}
+		report.Testing = append(report.Testing, datasetStats(dataset.ID(), features, columns))
+		shift := DatasetShift{Dataset: dataset.ID()}
+		for j, feature := range features {
+			shift.Features = append(shift.Features, FeatureShift{
+				Feature: feature,
+				KS:      ksStatistic(union[j], columns[j]),
+				Overlap: quantileOverlap(union[j], columns[j]),
+			})
+		}
+		report.Shift = append(report.Shift, shift)
+	}
+	errs = reduceError(errs)
+	if errs != nil {
+		return nil, LoadError(errs)
+	}
+	return report, nil
+}
+
+// Save writes the report as JSON.
+func (r *StatsReport) Save(filename string) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// sortedColumns loads the features of the dataset with the loader and returns
+// each one sorted.
+func sortedColumns(loader *Loader, dataset Dataset, loadStyle LoadStyle, features []string) ([][]float64, error) {
+	data, _, _, err := loader.LoadData(dataset, loadStyle, features, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	nSamples, _ := data.Dims()
+	columns := make([][]float64, len(features))
+	for j := range columns {
+		columns[j] = make([]float64, nSamples)
+		for i := range columns[j] {
+			columns[j][i] = data.At(i, j)
+		}
+		sort.Float64s(columns[j])
+	}
+	return columns, nil
+}
+
+func datasetStats(id string, features []string, columns [][]float64) DatasetStats {
+	s := DatasetStats{Dataset: id}
+	for j, feature := range features {
+		s.Features = append(s.Features, featureStats(feature, columns[j]))
+	}
+	return s
+}
+
+// featureStats summarizes the sorted values of the feature.
+func featureStats(feature string, sorted []float64) FeatureStats {
+	f := FeatureStats{
+		Feature: feature,
+		N:       len(sorted),
+	}
+	if len(sorted) == 0 {
+		return f
+	}
+	f.Min = sorted[0]
+	f.Max = sorted[len(sorted)-1]
+	f.Mean, f.Std = stat.MeanStdDev(sorted, nil)
+	if len(sorted) == 1 {
+		f.Std = 0
+	}
+	f.Quantiles = make([]float64, len(StatsQuantiles))
+	for i, q := range StatsQuantiles {
+		f.Quantiles[i] = stat.Quantile(q, stat.Empirical, sorted, nil)
+	}
+	return f
+}
+
+// ksStatistic returns the two-sample Kolmogorov-Smirnov statistic of the
+// sorted samples. It is zero if either is empty.
+func ksStatistic(x, y []float64) float64 {
+	var d float64
+	var i, j int
+	for i < len(x) && j < len(y) {
+		v := math.Min(x[i], y[j])
+		for i < len(x) && x[i] <= v {
+			i++
+		}
+		for j < len(y) && y[j] <= v {
+			j++
+		}
+		d = math.Max(d, math.Abs(float64(i)/float64(len(x))-float64(j)/float64(len(y))))
+	}
+	return d
+}
+
+// quantileOverlap returns the fraction of the central range of the sorted
+// testing values which is inside the central range of the sorted training
+// values. It is zero if either is empty.
+func quantileOverlap(train, test []float64) float64 {
+	if len(train) == 0 || len(test) == 0 {
+		return 0
+	}
+	trainLo := stat.Quantile(overlapQuantile, stat.Empirical, train, nil)
+	trainHi := stat.Quantile(1-overlapQuantile, stat.Empirical, train, nil)
+	testLo := stat.Quantile(overlapQuantile, stat.Empirical, test, nil)
+	testHi := stat.Quantile(1-overlapQuantile, stat.Empirical, test, nil)
+	if testHi == testLo {
+		// The testing data are a single value.
+		if testLo >= trainLo && testLo <= trainHi {
+			return 1
+		}
+		return 0
+	}
+	inside := math.Min(trainHi, testHi) - math.Max(trainLo, testLo)
+	return math.Max(inside, 0) / (testHi - testLo)
+}
+
+// saveStats writes the StatsReport of the settings to the stats directory in
+// path unless it is already up to date, and logs the shift of each testing
+// dataset. If redo is true, the report is always made again.
+func saveStats(settings *Settings, path string, redo bool) error {
+	fingerprint := statsFingerprint(settings)
+	filename := filepath.Join(path, StatsFilename)
+	var err error
+	if redo {
+		err = os.RemoveAll(path)
+	} else {
+		err = removeStalePlots(path, fingerprint)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filename)
+	if err == nil {
+		Debugf("stats in %v already generated", path)
+		return nil
+	}
+
+	report, err := ComputeStats(settings)
+	if err != nil {
+		return err
+	}
+	for _, shift := range report.Shift {
+		Infof("shift from training: %v", shift)
+	}
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return err
+	}
+	err = report.Save(filename)
+	if err != nil {
+		return err
+	}
+	return fingerprint.Save(path)
+}
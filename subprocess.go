@@ -0,0 +1,134 @@
+package ransuq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// The environment variables which tell a child process started by a
+// LocalScheduler which job to run and where to write its result.
+const (
+	subprocessSpecEnv   = "RANSUQ_SUBPROCESS_SPEC"
+	subprocessResultEnv = "RANSUQ_SUBPROCESS_RESULT"
+)
+
+// subprocessOutput is the number of bytes of the standard error of a child
+// process kept for the error if it fails.
+const subprocessOutput = 16 << 10
+
+// SubprocessError is the error of a job whose child process failed without
+// writing a result, such as from a crash or being killed for using too much
+// memory.
+type SubprocessError struct {
+	ID     string
+	Err    error
+	Stderr string // The end of the standard error of the process
+}
+
+func (s SubprocessError) Error() string {
+	str := fmt.Sprintf("child process for %v failed: %v", s.ID, s.Err)
+	if s.Stderr != "" {
+		str += "\n" + s.Stderr
+	}
+	return str
+}
+
+// RunSubprocessJob runs the job and exits if the process was started by a
+// LocalScheduler to run a job in a child process. Otherwise it returns
+// immediately. Programs which set Subprocess must call it at the start of
+// main, so the child does not do anything else. The packages registering the
+// job kinds must be imported.
+func RunSubprocessJob() {
+	spec := os.Getenv(subprocessSpecEnv)
+	if spec == "" {
+		return
+	}
+	err := runSubprocessJob(spec, os.Getenv(subprocessResultEnv))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runSubprocessJob is RunJobFile without the events, which the parent emits.
+func runSubprocessJob(specFile, resultFile string) error {
+	data, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return err
+	}
+	var spec batchSpec
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return errors.New("error reading job spec: " + err.Error())
+	}
+	gen, err := rebuildJob(spec.Kind, spec.Spec)
+	if err == nil {
+		err = newTracked(gen, context.Background()).Run()
+	}
+	return writeJobResult(resultFile, err)
+}
+
+// runSubprocess runs the job in a child process running the command, or the
+// current executable if it is empty. The process is killed if the context is
+// cancelled.
+func runSubprocess(ctx context.Context, command []string, id string, r RemoteGeneratable) error {
+	if len(command) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		command = append([]string{exe}, os.Args[1:]...)
+	}
+	dir, err := ioutil.TempDir("", "ransuq-job")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	specFile := filepath.Join(dir, "job.json")
+	resultFile := filepath.Join(dir, "job.result")
+	err = writeJobSpec(specFile, id, r)
+	if err != nil {
+		return err
+	}
+
+	stderr := &tailWriter{max: subprocessOutput}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), subprocessSpecEnv+"="+specFile, subprocessResultEnv+"="+resultFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	err = cmd.Run()
+
+	data, rerr := ioutil.ReadFile(resultFile)
+	if rerr == nil {
+		return parseJobResult(data)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = errors.New("no result written")
+	}
+	return SubprocessError{ID: id, Err: err, Stderr: string(stderr.buf)}
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
@@ -2,6 +2,7 @@ package synthetic
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
@@ -17,12 +18,6 @@ import (
 
 var syntheticDatasetSize int = 1e5
 
-var gopath string
-
-func init() {
-	gopath = os.Getenv("GOPATH")
-}
-
 var FlatplateBounds = &SABounds{
 	Name:        "Flatplate",
 	LogChi:      [2]float64{-3, 6},
@@ -39,8 +34,24 @@ type SABounds struct {
 	LogNu       [2]float64
 }
 
+// productionJobKind is the kind of the remote jobs which generate production
+// data.
+const productionJobKind = "synthetic-production"
+
+func init() {
+	ransuq.RegisterJobKind(productionJobKind, func(spec []byte) (ransuq.Generatable, error) {
+		var p Production
+		err := json.Unmarshal(spec, &p)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	})
+}
+
 type Production struct {
 	Bounds *SABounds
+	Root   string // Data directory. If empty, $GOPATH/data/ransuq is used
 }
 
 func (p Production) ID() string {
@@ -53,7 +64,11 @@ func (p Production) Filename() string {
 
 // Returns the data path
 func (p Production) Path() string {
-	return filepath.Join(gopath, "data", "ransuq", "synthetic", "production", p.Bounds.Name)
+	root := p.Root
+	if root == "" {
+		root = filepath.Join(os.Getenv("GOPATH"), "data", "ransuq")
+	}
+	return filepath.Join(root, "synthetic", "production", p.Bounds.Name)
 }
 
 /*
@@ -70,10 +85,34 @@ func (p Production) Generated() bool {
 	return b
 }
 
+// Artifacts returns the location of the generated data.
+func (p Production) Artifacts() []string {
+	return []string{filepath.Join(p.Path(), p.Filename())}
+}
+
+// SourceFiles returns the location of the generated data.
+func (p Production) SourceFiles() []string {
+	return []string{filepath.Join(p.Path(), p.Filename())}
+}
+
 func (p Production) NumCores() int {
 	return 1
 }
 
+// MemoryEstimate returns the memory needed to generate the data. Each value
+// is held as a float64 and then formatted as a string to be written.
+func (p Production) MemoryEstimate() int64 {
+	const nHeadings = 7
+	return int64(syntheticDatasetSize) * nHeadings * 64
+}
+
+// JobSpec returns the production settings so the data can be generated by a
+// ransuq.Worker.
+func (p Production) JobSpec() (string, []byte, error) {
+	b, err := json.Marshal(p)
+	return productionJobKind, b, err
+}
+
 func (p Production) Run() error {
 	fmt.Println("In production run")
 	logChiBounds := p.Bounds.LogChi
@@ -17,13 +17,16 @@ func TestMulti(t *testing.T) {
 		"net_2_50",
 		settings.StandardTraining,
 		driver.Serial{true},
+		[]string{settings.NoExtraStrings},
 	)
 	if err != nil {
-		t.Errorf(err)
+		t.Fatal(err)
 	}
 
-	err = ransuq.MultiTurb([]*ransuq.Settings{set})
-	if err != nil {
-		t.Error(err)
+	_, errs := ransuq.MultiTurb([]*ransuq.Settings{set}, ransuq.NewLocalScheduler())
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
 	}
 }
@@ -134,6 +134,35 @@ type TrainResults struct {
 
 // Train trains the algorithm returning a predictor
 func (t *Trainer) Train(inputs, outputs common.RowMatrix, weights []float64) (Predictor, TrainResults, error) {
+	return t.train("", inputs, outputs, weights)
+}
+
+// observedProblem emits an event each time the objective is evaluated.
+type observedProblem struct {
+	*regtrain.BatchGradient
+	id   string
+	iter int
+}
+
+func (o *observedProblem) Func(params []float64) float64 {
+	f := o.BatchGradient.Func(params)
+	o.emit(f)
+	return f
+}
+
+func (o *observedProblem) FuncGrad(params, deriv []float64) float64 {
+	f := o.BatchGradient.FuncGrad(params, deriv)
+	o.emit(f)
+	return f
+}
+
+func (o *observedProblem) emit(f float64) {
+	o.iter++
+	Emit(Event{Kind: EventTrainingIteration, ID: o.id, Iteration: o.iter, Objective: f})
+}
+
+// train trains the algorithm, labeling the training events with id.
+func (t *Trainer) train(id string, inputs, outputs common.RowMatrix, weights []float64) (Predictor, TrainResults, error) {
 
 	inputScaler := t.InputScaler
 	outputScaler := t.OutputScaler
@@ -172,7 +201,7 @@ func (t *Trainer) Train(inputs, outputs common.RowMatrix, weights []float64) (Pr
 	if regtrain.CanLinearSolve(algorithm, losser, regularizer) {
 		linearTrainable := algorithm.(regtrain.LinearTrainable)
 
-		fmt.Println("In linear solve")
+		Debugf("%v: training with a linear solve", id)
 		parameters := regtrain.LinearSolve(linearTrainable, nil, inputs, outputs, weights, regularizer)
 		if parameters == nil {
 			return nil, emptyResults, fmt.Errorf("mldriver: error during linear solve")
@@ -181,13 +210,10 @@ func (t *Trainer) Train(inputs, outputs common.RowMatrix, weights []float64) (Pr
 		return algorithm.Predictor(), emptyResults, nil
 	}
 
-	fmt.Println("starting algorithm training")
+	Debugf("%v: starting training with losser %v", id, losser)
 	algorithm.RandomizeParameters()
 	param := algorithm.Parameters(nil)
 
-	fmt.Println("before newbatch")
-	fmt.Println("losser is ", losser)
-
 	// Create the trainer
 	/*
 		problem := &regtrain.GradOptimizable{
@@ -219,7 +245,7 @@ func (t *Trainer) Train(inputs, outputs common.RowMatrix, weights []float64) (Pr
 	settings.FunctionThreshold = t.TrainSettings.ObjAbsTol
 
 	problem.Init()
-	result, err := optimize.Local(problem, param, settings, nil)
+	result, err := optimize.Local(&observedProblem{BatchGradient: problem, id: id}, param, settings, nil)
 	if err != nil {
 		return nil, emptyResults, err
 	}